@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+)
+
+// isAdmin reports whether the user has been promoted with `user promote`.
+func isAdmin(ctx context.Context, db *sql.DB, userID string) (bool, error) {
+	var admin bool
+	err := db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+// withAdmin must sit inside withAuth.
+func withAdmin(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, err := isAdmin(r.Context(), db, r.Context().Value(userIDKey).(string))
+		if err != nil {
+			writeServerError(w, r, "failed to check permissions", err)
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusForbidden, "admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
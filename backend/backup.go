@@ -0,0 +1,700 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackupDir      = "./data/backups"
+	defaultBackupSchedule = "15 3 * * *"
+	defaultBackupRetain   = 7
+
+	// backupFormat is bumped whenever the archive layout changes.
+	backupFormat       = 1
+	backupPrefix       = "coffee-"
+	backupSuffix       = ".tar.gz"
+	backupTimeLayout   = "20060102T150405Z"
+	backupManifestName = "manifest.json"
+	backupTablesDir    = "tables/"
+	backupFilesDir     = "files/"
+)
+
+// BackupManifest describes an archive. It is written last, once every
+// table and file is in.
+type BackupManifest struct {
+	Format    int    `json:"format"`
+	CreatedAt string `json:"created_at"`
+	Dialect   string `json:"dialect"`
+	// Migrations lists schema_migrations at the time of the snapshot; a
+	// restore only goes ahead into a database with exactly these applied.
+	Migrations    []string       `json:"migrations"`
+	SchemaVersion string         `json:"schema_version"`
+	Tables        map[string]int `json:"tables"`
+	Files         int            `json:"files"`
+	MissingFiles  []string       `json:"missing_files,omitempty"`
+}
+
+type Backup struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+	CreatedAt string `json:"created_at"`
+}
+
+// backupMu keeps backups in this process from overlapping; two started in
+// the same second would otherwise share a name.
+var backupMu sync.Mutex
+
+// createBackup writes a snapshot of every table plus the uploaded files to
+// dir and then prunes the oldest archives beyond retain. The tables are
+// read in one transaction so they are consistent with each other; blobs
+// are immutable once written, so copying them afterwards is safe.
+func createBackup(ctx context.Context, store Store, blobs BlobStore, dir string, retain int) (Backup, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format(backupTimeLayout) + backupSuffix
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Backup{}, err
+	}
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return Backup{}, fmt.Errorf("backup %s already exists", name)
+	}
+
+	manifest := BackupManifest{Format: backupFormat, CreatedAt: now.Format(time.RFC3339), Dialect: store.Dialect(), Tables: map[string]int{}}
+	tables, keys, err := snapshotTables(ctx, store, &manifest)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	// Write to a temporary name so a crash never leaves a truncated archive
+	// that looks complete.
+	partial := target + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return Backup{}, err
+	}
+	defer os.Remove(partial)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, table := range sortedKeys(tables) {
+		if err := writeTarFile(tw, backupTablesDir+table+".json", now, tables[table]); err != nil {
+			return Backup{}, err
+		}
+	}
+	for _, key := range keys {
+		data, err := readBlob(ctx, blobs, key)
+		if errors.Is(err, errBlobNotFound) {
+			logger(ctx).Warn("backup skipped a missing file", "key", key)
+			manifest.MissingFiles = append(manifest.MissingFiles, key)
+			continue
+		}
+		if err != nil {
+			return Backup{}, fmt.Errorf("read %s: %w", key, err)
+		}
+		if err := writeTarFile(tw, backupFilesDir+key, now, data); err != nil {
+			return Backup{}, err
+		}
+		manifest.Files++
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := writeTarFile(tw, backupManifestName, now, manifestJSON); err != nil {
+		return Backup{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return Backup{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return Backup{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return Backup{}, err
+	}
+	if err := f.Close(); err != nil {
+		return Backup{}, err
+	}
+	if err := os.Rename(partial, target); err != nil {
+		return Backup{}, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return Backup{}, err
+	}
+	logger(ctx).Info("backup created", "name", name, "bytes", info.Size(), "files", manifest.Files)
+
+	if err := pruneBackups(dir, retain); err != nil {
+		logger(ctx).Error("failed to prune old backups", "err", err)
+	}
+	return Backup{Name: name, SizeBytes: info.Size(), CreatedAt: manifest.CreatedAt}, nil
+}
+
+// snapshotTables dumps every table except schema_migrations as a JSON
+// array and collects the blob keys the photos point at, filling in the
+// manifest's schema and row counts.
+func snapshotTables(ctx context.Context, store Store, manifest *BackupManifest) (map[string][]byte, []string, error) {
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	if store.Dialect() == dialectSQLite {
+		// A transaction on SQLite's single connection is already a
+		// consistent snapshot.
+		opts = nil
+	}
+	tx, err := store.DB().BeginTx(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if manifest.Migrations, err = appliedMigrationNames(ctx, tx); err != nil {
+		return nil, nil, err
+	}
+	if len(manifest.Migrations) > 0 {
+		manifest.SchemaVersion = manifest.Migrations[len(manifest.Migrations)-1]
+	}
+
+	names, err := backupTables(ctx, tx, store.Dialect())
+	if err != nil {
+		return nil, nil, err
+	}
+	tables := map[string][]byte{}
+	for _, table := range names {
+		query, err := dumpTableQuery(ctx, tx, store.Dialect(), table)
+		if err != nil {
+			return nil, nil, err
+		}
+		var data string
+		var rows int
+		if err := tx.QueryRowContext(ctx, query).Scan(&data, &rows); err != nil {
+			return nil, nil, fmt.Errorf("dump %s: %w", table, err)
+		}
+		tables[table] = []byte(data)
+		manifest.Tables[table] = rows
+	}
+
+	var keys []string
+	if slices.Contains(names, "photos") {
+		rows, err := tx.QueryContext(ctx, "SELECT original_key, thumb_key FROM photos ORDER BY id")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var original, thumb string
+			if err := rows.Scan(&original, &thumb); err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, original, thumb)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return tables, keys, tx.Commit()
+}
+
+// restoreBackup replaces every table's contents with the archive's and
+// puts its files back into blobs. The database must already be migrated
+// to exactly the schema the backup was taken at; nothing is touched
+// otherwise. The tables are loaded in a single transaction.
+func restoreBackup(ctx context.Context, store Store, blobs BlobStore, archive string) (BackupManifest, error) {
+	manifest, err := readBackupManifest(archive)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if manifest.Format != backupFormat {
+		return BackupManifest{}, fmt.Errorf("backup format %d is not supported (expected %d)", manifest.Format, backupFormat)
+	}
+	if manifest.Dialect != store.Dialect() {
+		return BackupManifest{}, fmt.Errorf("backup was taken from %s, database is %s", manifest.Dialect, store.Dialect())
+	}
+
+	db := store.DB()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer tx.Rollback()
+
+	applied, err := appliedMigrationNames(ctx, tx)
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("read schema_migrations (run migrate up first): %w", err)
+	}
+	if !slices.Equal(applied, manifest.Migrations) {
+		current := "no migrations"
+		if len(applied) > 0 {
+			current = applied[len(applied)-1] + " applied"
+		}
+		return BackupManifest{}, fmt.Errorf("backup is at schema %s but the database has %s; migrate the database to the backup's version first",
+			manifest.SchemaVersion, current)
+	}
+	tables, err := backupTables(ctx, tx, store.Dialect())
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	for table := range manifest.Tables {
+		if !slices.Contains(tables, table) {
+			return BackupManifest{}, fmt.Errorf("backup has table %s, which the database does not", table)
+		}
+	}
+	order, err := tableLoadOrder(ctx, tx, store.Dialect(), tables)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+quoteIdent(order[i])); err != nil {
+			return BackupManifest{}, fmt.Errorf("clear %s: %w", order[i], err)
+		}
+	}
+
+	// Second pass over the archive. Files go straight back into blobs
+	// (their keys are unique, so a failed restore only leaves unused
+	// copies); tables are held until all are read so they can be loaded in
+	// dependency order.
+	data := map[string][]byte{}
+	files := 0
+	err = walkBackup(archive, func(name string, r io.Reader) error {
+		switch {
+		case strings.HasPrefix(name, backupTablesDir):
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			data[strings.TrimSuffix(strings.TrimPrefix(name, backupTablesDir), ".json")] = content
+		case strings.HasPrefix(name, backupFilesDir):
+			key := strings.TrimPrefix(name, backupFilesDir)
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if err := blobs.Put(ctx, key, http.DetectContentType(content), content); err != nil {
+				return fmt.Errorf("restore %s: %w", key, err)
+			}
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	for _, table := range order {
+		content, ok := data[table]
+		if !ok {
+			continue
+		}
+		query, err := loadTableQuery(ctx, tx, store.Dialect(), table)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if _, err := tx.ExecContext(ctx, query, string(content)); err != nil {
+			return BackupManifest{}, fmt.Errorf("load %s: %w", table, err)
+		}
+	}
+	if store.Dialect() == dialectPostgres {
+		if err := resetSequences(ctx, tx); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return BackupManifest{}, err
+	}
+	slog.Info("backup restored", "archive", archive, "tables", len(data), "files", files)
+	return manifest, nil
+}
+
+// listBackups returns the archives in dir, newest first.
+func listBackups(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []Backup{}
+	for _, entry := range entries {
+		created, ok := backupTime(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, Backup{Name: entry.Name(), SizeBytes: info.Size(), CreatedAt: created.Format(time.RFC3339)})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// pruneBackups deletes all but the newest keep archives.
+func pruneBackups(dir string, keep int) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	for _, b := range backups[keep:] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return err
+		}
+		slog.Info("pruned backup", "name", b.Name)
+	}
+	return nil
+}
+
+// backupTime parses the timestamp out of an archive name, rejecting
+// anything that is not one of ours (including paths).
+func backupTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, backupPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, backupSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeLayout, stamp)
+	return t, err == nil
+}
+
+// runBackupSchedule creates a backup whenever spec matches, until ctx is
+// done. It is only used on SQLite; on Postgres the job queue schedules
+// backups so that one replica takes each.
+func runBackupSchedule(ctx context.Context, spec cronSpec, backup func(ctx context.Context) error) {
+	for {
+		next := time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if !spec.matches(next) {
+			continue
+		}
+		if err := backup(ctx); err != nil {
+			slog.Error("scheduled backup failed", "err", err)
+		}
+	}
+}
+
+func handleListBackups(w http.ResponseWriter, r *http.Request, cfg Config) {
+	backups, err := listBackups(cfg.BackupDir)
+	if err != nil {
+		writeServerError(w, r, "failed to list backups", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+func handleCreateBackup(w http.ResponseWriter, r *http.Request, store Store, blobs BlobStore, cfg Config) {
+	backup, err := createBackup(r.Context(), store, blobs, cfg.BackupDir, cfg.BackupRetain)
+	if err != nil {
+		writeServerError(w, r, "failed to create backup", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, backup)
+}
+
+// handleDownloadBackup sends the archive named by {name}. Only names the
+// backup job produces are accepted, so the path cannot leave BackupDir.
+func handleDownloadBackup(w http.ResponseWriter, r *http.Request, cfg Config) {
+	name := r.PathValue("name")
+	if _, ok := backupTime(name); !ok {
+		writeError(w, r, http.StatusNotFound, "backup not found")
+		return
+	}
+	f, err := os.Open(filepath.Join(cfg.BackupDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, http.StatusNotFound, "backup not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, "failed to open backup", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeServerError(w, r, "failed to open backup", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func appliedMigrationNames(ctx context.Context, q querier) ([]string, error) {
+	return queryStrings(ctx, q, "SELECT filename FROM schema_migrations ORDER BY filename")
+}
+
+// backupTables lists the application's tables; schema_migrations belongs
+// to the database rather than its contents and is never copied.
+func backupTables(ctx context.Context, q querier, dialect string) ([]string, error) {
+	if dialect == dialectSQLite {
+		return queryStrings(ctx, q,
+			`SELECT name FROM sqlite_master
+			 WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name <> 'schema_migrations'
+			 ORDER BY name`)
+	}
+	return queryStrings(ctx, q,
+		`SELECT tablename FROM pg_tables
+		 WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'
+		 ORDER BY tablename`)
+}
+
+func tableColumns(ctx context.Context, q querier, table string) ([]string, error) {
+	return queryStrings(ctx, q, "SELECT name FROM pragma_table_info($1) ORDER BY cid", table)
+}
+
+// dumpTableQuery returns a query yielding the whole table as a JSON array
+// of objects and its row count. Each database does its own encoding, so
+// types round-trip through loadTableQuery without the Go side knowing
+// them.
+func dumpTableQuery(ctx context.Context, q querier, dialect string, table string) (string, error) {
+	if dialect == dialectSQLite {
+		columns, err := tableColumns(ctx, q, table)
+		if err != nil {
+			return "", err
+		}
+		pairs := make([]string, len(columns))
+		for i, c := range columns {
+			pairs[i] = "'" + c + "', " + quoteIdent(c)
+		}
+		return `SELECT json_group_array(json_object(` + strings.Join(pairs, ", ") + `)), COUNT(*) FROM ` + quoteIdent(table), nil
+	}
+	return `SELECT COALESCE(json_agg(t), '[]')::text, COUNT(*) FROM ` + quoteIdent(table) + ` t`, nil
+}
+
+// loadTableQuery returns an INSERT that takes a dumpTableQuery array as
+// its only argument. The whole table goes in as one statement, so rows
+// referring to others in the same table (flavor descriptor parents) load
+// in any order.
+func loadTableQuery(ctx context.Context, q querier, dialect string, table string) (string, error) {
+	if dialect == dialectSQLite {
+		columns, err := tableColumns(ctx, q, table)
+		if err != nil {
+			return "", err
+		}
+		quoted := make([]string, len(columns))
+		values := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = quoteIdent(c)
+			values[i] = "json_extract(value, '$." + c + "')"
+		}
+		return `INSERT INTO ` + quoteIdent(table) + ` (` + strings.Join(quoted, ", ") + `)
+			SELECT ` + strings.Join(values, ", ") + ` FROM json_each($1)`, nil
+	}
+	return `INSERT INTO ` + quoteIdent(table) + ` SELECT * FROM json_populate_recordset(NULL::` + quoteIdent(table) + `, $1::json)`, nil
+}
+
+// tableLoadOrder sorts tables so that every table comes after the ones
+// its foreign keys point at.
+func tableLoadOrder(ctx context.Context, q querier, dialect string, tables []string) ([]string, error) {
+	query := `SELECT conrelid::regclass::text, confrelid::regclass::text
+		FROM pg_constraint
+		WHERE contype = 'f' AND connamespace = current_schema()::regnamespace`
+	if dialect == dialectSQLite {
+		query = `SELECT m.name, f."table"
+			FROM sqlite_master m, pragma_foreign_key_list(m.name) f
+			WHERE m.type = 'table'`
+	}
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deps := map[string][]string{}
+	for rows.Next() {
+		var table, parent string
+		if err := rows.Scan(&table, &parent); err != nil {
+			return nil, err
+		}
+		if table != parent {
+			deps[table] = append(deps[table], parent)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	order := []string{}
+	state := map[string]int{} // 1 visiting, 2 done
+	var visit func(table string) error
+	visit = func(table string) error {
+		switch state[table] {
+		case 1:
+			return fmt.Errorf("foreign keys form a cycle through %s", table)
+		case 2:
+			return nil
+		}
+		state[table] = 1
+		for _, parent := range deps[table] {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		state[table] = 2
+		order = append(order, table)
+		return nil
+	}
+	for _, table := range tables {
+		if err := visit(table); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// resetSequences moves every serial column's sequence past the restored
+// rows so new inserts don't collide with them.
+func resetSequences(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT table_name, column_name FROM information_schema.columns
+		 WHERE table_schema = current_schema() AND column_default LIKE 'nextval(%'`)
+	if err != nil {
+		return err
+	}
+	type serial struct{ table, column string }
+	var serials []serial
+	for rows.Next() {
+		var s serial
+		if err := rows.Scan(&s.table, &s.column); err != nil {
+			rows.Close()
+			return err
+		}
+		serials = append(serials, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range serials {
+		if _, err := tx.ExecContext(ctx,
+			`SELECT setval(pg_get_serial_sequence($1, $2), COALESCE((SELECT MAX(`+quoteIdent(s.column)+`) FROM `+quoteIdent(s.table)+`), 0) + 1, false)`,
+			s.table, s.column,
+		); err != nil {
+			return fmt.Errorf("reset sequence for %s.%s: %w", s.table, s.column, err)
+		}
+	}
+	return nil
+}
+
+func queryStrings(ctx context.Context, q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// quoteIdent quotes a table or column name read from the catalog.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func readBlob(ctx context.Context, blobs BlobStore, key string) ([]byte, error) {
+	body, err := blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func writeTarFile(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// walkBackup calls fn for every regular file in the archive. Names are
+// cleaned, and ones that would escape the archive are rejected.
+func walkBackup(archive string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s is not a backup archive: %w", archive, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q is outside the archive", hdr.Name)
+		}
+		if err := fn(name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readBackupManifest reads the manifest, which sits at the end of the
+// archive, so it is a full pass over the file.
+func readBackupManifest(archive string) (BackupManifest, error) {
+	var manifest BackupManifest
+	found := false
+	err := walkBackup(archive, func(name string, r io.Reader) error {
+		if name != backupManifestName {
+			return nil
+		}
+		found = true
+		return json.NewDecoder(r).Decode(&manifest)
+	})
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if !found {
+		return BackupManifest{}, fmt.Errorf("%s has no %s; the backup is incomplete", archive, backupManifestName)
+	}
+	return manifest, nil
+}
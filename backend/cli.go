@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+const cliUsage = `usage: coffee-backend <command> [arguments]
+
+commands:
+  serve                                        start the API server (the default)
+  migrate up | down [steps] | status           apply, roll back or list migrations
+  user create --email EMAIL [--password PW]    create an account
+  user disable --user USER                     block sign-in and revoke tokens
+  user enable --user USER                      undo user disable
+  user promote --user USER                     allow the user to use /api/admin
+  user demote --user USER                      undo user promote
+  user reset-password --user USER [--password PW]
+  vapid generate                               print a new VAPID key pair for .env
+  export --user USER [--out FILE]              write a user's data as JSON
+  push send --user USER [--title T] [--body B] [--url URL]
+  backup create | list                         take a backup now, or list them
+  backup restore BACKUP                        load a backup into the database
+
+USER is a user id or email. A password is generated and printed when
+--password is omitted.
+BACKUP is a name from backup list or a path to an archive. Stop the
+server before restoring: every table is replaced.
+`
+
+// runCommand dispatches the operator subcommands. They use the same
+// configuration and data functions as the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return withCommandStore(func(ctx context.Context, cfg Config, store Store) error {
+			return runMigrate(ctx, store, args[1:])
+		})
+	case "user":
+		return withCommandStore(func(ctx context.Context, cfg Config, store Store) error {
+			return runUser(ctx, store, args[1:])
+		})
+	case "vapid":
+		if len(args) < 2 || args[1] != "generate" {
+			return errors.New("usage: vapid generate")
+		}
+		privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("VAPID_PUBLIC_KEY=%s\nVAPID_PRIVATE_KEY=%s\n", publicKey, privateKey)
+		return nil
+	case "export":
+		return withCommandStore(func(ctx context.Context, cfg Config, store Store) error {
+			return runExport(ctx, store, args[1:])
+		})
+	case "push":
+		if len(args) < 2 || args[1] != "send" {
+			return errors.New("usage: push send --user USER [--title T] [--body B] [--url URL]")
+		}
+		return withCommandStore(func(ctx context.Context, cfg Config, store Store) error {
+			return runPushSend(ctx, cfg, store, args[2:])
+		})
+	case "backup":
+		return withCommandStore(func(ctx context.Context, cfg Config, store Store) error {
+			return runBackup(ctx, cfg, store, args[1:])
+		})
+	case "help", "-h", "-help", "--help":
+		fmt.Print(cliUsage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func withCommandStore(fn func(ctx context.Context, cfg Config, store Store) error) error {
+	cfg := loadConfig()
+	store, err := openStore(cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer store.DB().Close()
+	return fn(context.Background(), cfg, store)
+}
+
+func runMigrate(ctx context.Context, store Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+	db, dialect := store.DB(), store.Dialect()
+	migrations := migrationsFor(dialect)
+	switch args[0] {
+	case "up":
+		return applyMigrations(ctx, db, dialect, migrations)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New("steps must be a positive integer")
+			}
+			steps = n
+		}
+		return rollbackMigrations(ctx, db, dialect, migrations, steps)
+	case "status":
+		states, err := migrationStatus(ctx, db, dialect, migrations)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tSTATUS\tAPPLIED AT\tDOWN")
+		for _, s := range states {
+			down := "no"
+			if s.Reversible {
+				down = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Status, s.AppliedAt, down)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+func runUser(ctx context.Context, store Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: user create | disable | enable | promote | demote | reset-password")
+	}
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	email := flags.String("email", "", "email address for the new account")
+	ref := flags.String("user", "", "user id or email")
+	password := flags.String("password", "", "password (generated when omitted)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "create" {
+		generated := *password == ""
+		if generated {
+			*password = newToken()
+		}
+		user, err := createUser(ctx, store, *email, *password)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created user %s (%s)\n", user.Email, user.ID)
+		if generated {
+			fmt.Printf("password: %s\n", *password)
+		}
+		return nil
+	}
+
+	user, err := commandUser(ctx, store, *ref)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "disable", "enable":
+		disabled := args[0] == "disable"
+		if err := store.SetUserDisabled(ctx, user.ID, disabled); err != nil {
+			return err
+		}
+		fmt.Printf("%sd user %s\n", args[0], user.Email)
+		return nil
+	case "promote", "demote":
+		if err := store.SetUserAdmin(ctx, user.ID, args[0] == "promote"); err != nil {
+			return err
+		}
+		fmt.Printf("%sd user %s\n", args[0], user.Email)
+		return nil
+	case "reset-password":
+		generated := *password == ""
+		if generated {
+			*password = newToken()
+		}
+		if err := setUserPassword(ctx, store, user.ID, *password); err != nil {
+			return err
+		}
+		fmt.Printf("reset password for %s\n", user.Email)
+		if generated {
+			fmt.Printf("password: %s\n", *password)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown user command %q", args[0])
+}
+
+func runExport(ctx context.Context, store Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	ref := flags.String("user", "", "user id or email")
+	out := flags.String("out", "", "file to write (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	user, err := commandUser(ctx, store, *ref)
+	if err != nil {
+		return err
+	}
+
+	export, err := buildUserExport(ctx, store, user)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+func runPushSend(ctx context.Context, cfg Config, store Store, args []string) error {
+	flags := flag.NewFlagSet("push send", flag.ContinueOnError)
+	ref := flags.String("user", "", "user id or email")
+	title := flags.String("title", "Coffee Log", "notification title")
+	body := flags.String("body", "", "notification body")
+	url := flags.String("url", "/", "page to open when the notification is clicked")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	user, err := commandUser(ctx, store, *ref)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(*body) == "" {
+		return errors.New("--body is required")
+	}
+	if err := sendPush(ctx, store, cfg, user.ID, PushPayload{Title: *title, Body: *body, URL: *url}); err != nil {
+		return err
+	}
+	fmt.Printf("sent push to %s\n", user.Email)
+	return nil
+}
+
+func runBackup(ctx context.Context, cfg Config, store Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: backup create | list | restore BACKUP")
+	}
+	switch args[0] {
+	case "create":
+		blobs, err := newBlobStore(cfg)
+		if err != nil {
+			return err
+		}
+		backup, err := createBackup(ctx, store, blobs, cfg.BackupDir, cfg.BackupRetain)
+		if err != nil {
+			return err
+		}
+		fmt.Println(filepath.Join(cfg.BackupDir, backup.Name))
+		return nil
+	case "list":
+		backups, err := listBackups(cfg.BackupDir)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED AT\tSIZE")
+		for _, b := range backups {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", b.Name, b.CreatedAt, b.SizeBytes)
+		}
+		return w.Flush()
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("usage: backup restore BACKUP")
+		}
+		archive := args[1]
+		if _, ok := backupTime(archive); ok {
+			archive = filepath.Join(cfg.BackupDir, archive)
+		}
+		blobs, err := newBlobStore(cfg)
+		if err != nil {
+			return err
+		}
+		manifest, err := restoreBackup(ctx, store, blobs, archive)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %s (schema %s, %d tables, %d files)\n",
+			archive, manifest.SchemaVersion, len(manifest.Tables), manifest.Files)
+		return nil
+	}
+	return fmt.Errorf("unknown backup command %q", args[0])
+}
+
+func commandUser(ctx context.Context, store Store, ref string) (User, error) {
+	if strings.TrimSpace(ref) == "" {
+		return User{}, errors.New("--user is required")
+	}
+	user, found, err := store.FindUser(ctx, ref)
+	if err != nil {
+		return User{}, err
+	}
+	if !found {
+		return User{}, fmt.Errorf("no user matches %q", ref)
+	}
+	return user, nil
+}
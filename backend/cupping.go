@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// CuppingScore follows the SCA cupping form. The quality attributes are
+// scored 6.00-10.00 in quarter points; uniformity, clean cup and sweetness
+// award 2 points per cup over five cups; defects count the cups with a
+// taint (-2 each) or a fault (-4 each). Total is computed server side.
+type CuppingScore struct {
+	Fragrance  float64        `json:"fragrance"`
+	Flavor     float64        `json:"flavor"`
+	Aftertaste float64        `json:"aftertaste"`
+	Acidity    float64        `json:"acidity"`
+	Body       float64        `json:"body"`
+	Balance    float64        `json:"balance"`
+	Uniformity float64        `json:"uniformity"`
+	CleanCup   float64        `json:"clean_cup"`
+	Sweetness  float64        `json:"sweetness"`
+	Overall    float64        `json:"overall"`
+	Defects    CuppingDefects `json:"defects"`
+	Total      float64        `json:"total"`
+}
+
+type CuppingDefects struct {
+	Taints int `json:"taints"`
+	Faults int `json:"faults"`
+}
+
+// BeanCuppingStats compares cupping totals recorded for one bean.
+type BeanCuppingStats struct {
+	Beans        string  `json:"beans"`
+	Sessions     int     `json:"sessions"`
+	AverageTotal float64 `json:"average_total"`
+	MinTotal     float64 `json:"min_total"`
+	MaxTotal     float64 `json:"max_total"`
+	LastCuppedAt string  `json:"last_cupped_at"`
+}
+
+const cuppingCups = 5
+
+func validateCupping(score CuppingScore) error {
+	quality := []struct {
+		name  string
+		value float64
+	}{
+		{"fragrance", score.Fragrance},
+		{"flavor", score.Flavor},
+		{"aftertaste", score.Aftertaste},
+		{"acidity", score.Acidity},
+		{"body", score.Body},
+		{"balance", score.Balance},
+		{"overall", score.Overall},
+	}
+	fields := fieldErrors{}
+	for _, attr := range quality {
+		if attr.value < 6 || attr.value > 10 || !isMultiple(attr.value, 0.25) {
+			field := "cupping." + attr.name
+			fields.add(field, field+" must be between 6 and 10 in steps of 0.25")
+		}
+	}
+
+	cups := []struct {
+		name  string
+		value float64
+	}{
+		{"uniformity", score.Uniformity},
+		{"clean_cup", score.CleanCup},
+		{"sweetness", score.Sweetness},
+	}
+	for _, attr := range cups {
+		if attr.value < 0 || attr.value > 2*cuppingCups || !isMultiple(attr.value, 2) {
+			field := "cupping." + attr.name
+			fields.add(field, field+" must be between 0 and 10 in steps of 2")
+		}
+	}
+
+	if score.Defects.Taints < 0 || score.Defects.Faults < 0 {
+		fields.add("cupping.defects", "cupping.defects cannot be negative")
+	} else if score.Defects.Taints+score.Defects.Faults > cuppingCups {
+		fields.add("cupping.defects", "cupping.defects cannot exceed 5 cups")
+	}
+	return fields.err()
+}
+
+// cuppingTotal adds up the ten attributes and subtracts the defects.
+func cuppingTotal(score CuppingScore) float64 {
+	total := score.Fragrance + score.Flavor + score.Aftertaste + score.Acidity + score.Body +
+		score.Balance + score.Uniformity + score.CleanCup + score.Sweetness + score.Overall
+	total -= float64(2*score.Defects.Taints + 4*score.Defects.Faults)
+	return round2(total)
+}
+
+func isMultiple(value float64, step float64) bool {
+	ratio := value / step
+	return math.Abs(ratio-math.Round(ratio)) < 1e-9
+}
+
+// handleCuppingStats returns the cupping score summary per bean.
+func handleCuppingStats(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	stats, err := cuppingStatsByBean(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load cupping stats", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func cuppingStatsByBean(ctx context.Context, db *sql.DB, userID string) ([]BeanCuppingStats, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT beans, COUNT(*), AVG(cupping_total), MIN(cupping_total), MAX(cupping_total), MAX(brewed_at)
+		 FROM entries
+		 WHERE user_id = $1 AND cupping_total IS NOT NULL
+		 GROUP BY beans
+		 ORDER BY AVG(cupping_total) DESC, beans`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []BeanCuppingStats{}
+	for rows.Next() {
+		var s BeanCuppingStats
+		var last time.Time
+		if err := rows.Scan(&s.Beans, &s.Sessions, &s.AverageTotal, &s.MinTotal, &s.MaxTotal, &last); err != nil {
+			return nil, err
+		}
+		s.AverageTotal = round2(s.AverageTotal)
+		s.LastCuppedAt = last.UTC().Format(time.RFC3339)
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// cuppingColumns prepares a score for the entries.cupping and cupping_total
+// columns, filling in the computed total. A nil score maps to NULLs.
+func cuppingColumns(score *CuppingScore) (interface{}, sql.NullFloat64, error) {
+	if score == nil {
+		return nil, sql.NullFloat64{}, nil
+	}
+	scored := *score
+	scored.Total = cuppingTotal(scored)
+	data, err := json.Marshal(scored)
+	if err != nil {
+		return nil, sql.NullFloat64{}, err
+	}
+	return string(data), sql.NullFloat64{Float64: scored.Total, Valid: true}, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var equipmentTypes = map[string]bool{
+	"grinder": true,
+	"brewer":  true,
+	"kettle":  true,
+	"filter":  true,
+}
+
+// brewMethodAliases maps lower-cased spellings of common brew methods to a
+// canonical name. Keep in sync with migrations/005_equipment.sql.
+var brewMethodAliases = map[string]string{
+	"v60":            "V60",
+	"hario v60":      "V60",
+	"chemex":         "Chemex",
+	"aeropress":      "AeroPress",
+	"aero press":     "AeroPress",
+	"french press":   "French Press",
+	"frenchpress":    "French Press",
+	"cafetiere":      "French Press",
+	"espresso":       "Espresso",
+	"moka":           "Moka Pot",
+	"moka pot":       "Moka Pot",
+	"bialetti":       "Moka Pot",
+	"kalita":         "Kalita Wave",
+	"kalita wave":    "Kalita Wave",
+	"clever":         "Clever Dripper",
+	"clever dripper": "Clever Dripper",
+	"cold brew":      "Cold Brew",
+	"coldbrew":       "Cold Brew",
+	"siphon":         "Siphon",
+	"syphon":         "Siphon",
+	"pour over":      "Pour Over",
+	"pourover":       "Pour Over",
+	"pour-over":      "Pour Over",
+	"origami":        "Origami",
+}
+
+type Equipment struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Make      string `json:"make"`
+	Model     string `json:"model"`
+	Notes     string `json:"notes"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type EquipmentInput struct {
+	ID    string `json:"id,omitempty"`
+	Type  string `json:"type"`
+	Make  string `json:"make"`
+	Model string `json:"model"`
+	Notes string `json:"notes"`
+}
+
+// EquipmentUsage counts the entries that used a piece of equipment as
+// their grinder or brewer.
+type EquipmentUsage struct {
+	ID            string  `json:"id"`
+	Type          string  `json:"type"`
+	Make          string  `json:"make"`
+	Model         string  `json:"model"`
+	Brews         int     `json:"brews"`
+	AverageRating float64 `json:"average_rating"`
+	FirstUsedAt   string  `json:"first_used_at,omitempty"`
+	LastUsedAt    string  `json:"last_used_at,omitempty"`
+}
+
+const equipmentColumns = `id, type, make, model, notes, created_at, updated_at`
+
+func handleListEquipment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	items, err := listEquipment(r.Context(), db, userID, r.URL.Query().Get("type"))
+	if err != nil {
+		writeServerError(w, r, "failed to load equipment", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func handleCreateEquipment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input EquipmentInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateEquipment(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	item, err := createEquipment(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save equipment", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, item)
+}
+
+func handleEquipmentStats(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	usage, err := equipmentUsage(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load equipment stats", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func handleGetEquipment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	item, found, err := getEquipment(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load equipment", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "equipment not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+func handleUpdateEquipment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input EquipmentInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateEquipment(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	item, found, err := updateEquipment(r.Context(), db, userID, id, input)
+	if err != nil {
+		writeServerError(w, r, "failed to update equipment", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "equipment not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+func handleDeleteEquipment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM equipment WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to delete equipment", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "equipment not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func validateEquipment(input EquipmentInput) error {
+	fields := fieldErrors{}
+	fields.id("id", input.ID)
+	if !equipmentTypes[input.Type] {
+		fields.add("type", "type must be one of grinder, brewer, kettle or filter")
+	}
+	if strings.TrimSpace(input.Make) == "" && strings.TrimSpace(input.Model) == "" {
+		fields.add("make", "make or model is required")
+	}
+	return fields.err()
+}
+
+// validateEntryEquipment checks that the grinder and brewer an entry points
+// at belong to the user and have the matching type.
+func validateEntryEquipment(ctx context.Context, q querier, userID string, input EntryInput) error {
+	refs := []struct {
+		id    string
+		kind  string
+		field string
+	}{
+		{input.GrinderID, "grinder", "grinder_id"},
+		{input.BrewerID, "brewer", "brewer_id"},
+	}
+	fields := fieldErrors{}
+	for _, ref := range refs {
+		id, err := normalizeID(ref.id)
+		if err != nil {
+			fields.add(ref.field, ref.field+" contains invalid characters")
+			continue
+		}
+		if id == "" {
+			continue
+		}
+		item, found, err := getEquipment(ctx, q, userID, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			fields.add(ref.field, ref.field+" does not match any equipment")
+		} else if item.Type != ref.kind {
+			fields.add(ref.field, ref.field+" must reference a "+ref.kind)
+		}
+	}
+	return fields.err()
+}
+
+// normalizeBrewMethod collapses whitespace and maps well-known spellings
+// ("v60", "Hario V60") to a single canonical name.
+func normalizeBrewMethod(raw string) string {
+	cleaned := strings.Join(strings.Fields(raw), " ")
+	if canonical, ok := brewMethodAliases[strings.ToLower(cleaned)]; ok {
+		return canonical
+	}
+	return cleaned
+}
+
+// entryBrewMethod normalizes raw for an entry. A method that is not one of
+// the canonical names takes the user's most used spelling of it, folding
+// case the way migration 005 did for the entries already stored, so
+// "switch" and "Switch" stay one method.
+func entryBrewMethod(ctx context.Context, q querier, userID string, raw string) (string, error) {
+	method := normalizeBrewMethod(raw)
+	if _, ok := brewMethodAliases[strings.ToLower(method)]; ok || method == "" {
+		return method, nil
+	}
+	var existing string
+	err := q.QueryRowContext(ctx,
+		`SELECT brew_method FROM entries
+		 WHERE user_id = $1 AND lower(brew_method) = lower($2)
+		 GROUP BY brew_method
+		 ORDER BY count(*) DESC, brew_method
+		 LIMIT 1`,
+		userID, method,
+	).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return method, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return existing, nil
+}
+
+func listEquipment(ctx context.Context, db *sql.DB, userID string, kind string) ([]Equipment, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+equipmentColumns+`
+		 FROM equipment
+		 WHERE user_id = $1 AND ($2 = '' OR type = $2)
+		 ORDER BY type, make, model`,
+		userID, kind,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Equipment{}
+	for rows.Next() {
+		item, err := scanEquipment(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func getEquipment(ctx context.Context, q querier, userID string, id string) (Equipment, bool, error) {
+	row := q.QueryRowContext(ctx,
+		`SELECT `+equipmentColumns+` FROM equipment WHERE user_id = $1 AND id = $2`,
+		userID, id,
+	)
+	item, err := scanEquipment(row)
+	if err == sql.ErrNoRows {
+		return Equipment{}, false, nil
+	}
+	if err != nil {
+		return Equipment{}, false, err
+	}
+	return item, true, nil
+}
+
+func createEquipment(ctx context.Context, db *sql.DB, userID string, input EquipmentInput) (Equipment, error) {
+	id, err := normalizeID(input.ID)
+	if err != nil {
+		return Equipment{}, err
+	}
+	if id == "" {
+		id = newID()
+	}
+	now := time.Now().UTC()
+	row := db.QueryRowContext(ctx,
+		`INSERT INTO equipment (id, user_id, type, make, model, notes, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		 RETURNING `+equipmentColumns,
+		id, userID, input.Type, strings.TrimSpace(input.Make), strings.TrimSpace(input.Model), input.Notes, now,
+	)
+	return scanEquipment(row)
+}
+
+func updateEquipment(ctx context.Context, db *sql.DB, userID string, id string, input EquipmentInput) (Equipment, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`UPDATE equipment
+		 SET type = $1, make = $2, model = $3, notes = $4, updated_at = $5
+		 WHERE user_id = $6 AND id = $7
+		 RETURNING `+equipmentColumns,
+		input.Type, strings.TrimSpace(input.Make), strings.TrimSpace(input.Model), input.Notes,
+		time.Now().UTC(), userID, id,
+	)
+	item, err := scanEquipment(row)
+	if err == sql.ErrNoRows {
+		return Equipment{}, false, nil
+	}
+	if err != nil {
+		return Equipment{}, false, err
+	}
+	return item, true, nil
+}
+
+func equipmentUsage(ctx context.Context, db *sql.DB, userID string) ([]EquipmentUsage, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT q.id, q.type, q.make, q.model,
+		        COUNT(e.id), COALESCE(AVG(e.rating), 0), MIN(e.brewed_at), MAX(e.brewed_at)
+		 FROM equipment q
+		 LEFT JOIN entries e
+		   ON e.user_id = q.user_id AND (e.grinder_id = q.id OR e.brewer_id = q.id)
+		 WHERE q.user_id = $1
+		 GROUP BY q.id, q.type, q.make, q.model
+		 ORDER BY COUNT(e.id) DESC, q.make, q.model`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []EquipmentUsage{}
+	for rows.Next() {
+		var u EquipmentUsage
+		var first, last sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Type, &u.Make, &u.Model, &u.Brews, &u.AverageRating, &first, &last); err != nil {
+			return nil, err
+		}
+		if first.Valid {
+			u.FirstUsedAt = first.Time.UTC().Format(time.RFC3339)
+			u.LastUsedAt = last.Time.UTC().Format(time.RFC3339)
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+func scanEquipment(row rowScanner) (Equipment, error) {
+	var item Equipment
+	var created time.Time
+	var updated time.Time
+	if err := row.Scan(&item.ID, &item.Type, &item.Make, &item.Model, &item.Notes, &created, &updated); err != nil {
+		return Equipment{}, err
+	}
+	item.CreatedAt = created.UTC().Format(time.RFC3339)
+	item.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	return item, nil
+}
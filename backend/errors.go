@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Error codes are part of the API: clients switch on them (and localise the
+// message) instead of matching text, so a code must never change meaning.
+// Add a new one rather than reusing one that is close.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeInvalidJSON          = "invalid_json"
+	codeValidationFailed     = "validation_failed"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeAccountDisabled      = "account_disabled"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeEmailTaken           = "email_taken"
+	codeTagExists            = "tag_exists"
+	codeSessionClosed        = "session_closed"
+	codeSessionOpen          = "session_open"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeInternal             = "internal_error"
+	codeNotImplemented       = "not_implemented"
+)
+
+// statusCodes is the code sent for a status when nothing more specific
+// applies.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMediaType,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusNotImplemented:        codeNotImplemented,
+}
+
+// APIError is the body of every error response. Message is English for
+// people reading logs and curl output; Fields maps each invalid request
+// field (dotted for nested ones, e.g. cupping.body) to what is wrong with
+// it. Data functions return an APIError for problems the client caused so
+// handlers can pass them on unchanged.
+type APIError struct {
+	Status    int               `json:"-"`
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// writeAPIError sends e, stamped with the request's ID so a report can be
+// matched with the logs.
+func writeAPIError(w http.ResponseWriter, r *http.Request, e *APIError) {
+	body := *e
+	body.RequestID = requestID(r.Context())
+	writeJSON(w, body.Status, body)
+}
+
+// writeError sends message with the code that goes with status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInvalidRequest
+	}
+	writeAPIError(w, r, newAPIError(status, code, message))
+}
+
+// writeInvalid answers a request the client got wrong: an APIError as it
+// is, anything else as a 400 carrying the error's message.
+func writeInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		writeAPIError(w, r, apiErr)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, err.Error())
+}
+
+// fieldErrors collects every invalid field of a request so the client
+// hears about all of them in one response. Messages name their field, so
+// they read on their own; only the first problem with a field is kept.
+type fieldErrors map[string]string
+
+func (f fieldErrors) add(field string, message string) {
+	if _, ok := f[field]; !ok {
+		f[field] = message
+	}
+}
+
+// id records field when value is not a usable id.
+func (f fieldErrors) id(field string, value string) {
+	if _, err := normalizeID(value); err != nil {
+		f.add(field, field+" contains invalid characters")
+	}
+}
+
+// merge takes in the fields of a validation error from a nested check. Any
+// other error is handed back for the caller to deal with.
+func (f fieldErrors) merge(err error) error {
+	var apiErr *APIError
+	if err == nil {
+		return nil
+	}
+	if !errors.As(err, &apiErr) || apiErr.Code != codeValidationFailed {
+		return err
+	}
+	for field, message := range apiErr.Fields {
+		f.add(field, message)
+	}
+	return nil
+}
+
+// err is nil when every field was fine and a validation_failed APIError
+// otherwise.
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	return f.apiError()
+}
+
+func (f fieldErrors) apiError() *APIError {
+	messages := []string{}
+	for _, field := range sortedKeys(f) {
+		messages = append(messages, f[field])
+	}
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    codeValidationFailed,
+		Message: strings.Join(messages, "; "),
+		Fields:  f,
+	}
+}
+
+// fieldError is a validation error for a single field.
+func fieldError(field string, message string) *APIError {
+	return fieldErrors{field: message}.apiError()
+}
+
+// decodeError turns what encoding/json reports into an APIError that names
+// the offending field without exposing the decoder's wording (which
+// mentions Go types).
+func decodeError(err error) *APIError {
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			"request body is limited to "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+	case errors.Is(err, io.EOF):
+		return newAPIError(http.StatusBadRequest, codeInvalidJSON, "request body is empty")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fieldError(typeErr.Field, typeErr.Field+" must be "+jsonTypeName(typeErr.Type))
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if field, err := strconv.Unquote(name); err == nil {
+			return fieldError(field, field+" is not a known field")
+		}
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidJSON, "request body is not valid JSON")
+}
+
+// jsonTypeName describes a Go type by the JSON value it decodes from.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a valid value"
+}
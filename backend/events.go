@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	eventsChannel          = "entry_events"
+	eventsHeartbeat        = 25 * time.Second
+	eventsRetention        = 24 * time.Hour
+	eventsReplayLimit      = 500
+	eventsSubscriberBuffer = 32
+	eventsClientRetry      = 3 * time.Second
+	eventsListenBackoff    = 5 * time.Second
+)
+
+// eventsLockClass namespaces the per-user advisory locks that order event
+// inserts ("evnt" in ASCII).
+const eventsLockClass int32 = 0x65766e74
+
+// eventResync tells a client it missed more than can be replayed and
+// should refetch everything.
+const eventResync = "resync"
+
+type entryEvent struct {
+	seq     int64
+	event   string
+	payload []byte
+}
+
+// emitEntryEvent is the single place entry changes are published. It runs
+// inside the change's transaction: the event is logged for SSE replay,
+// NOTIFY wakes every replica's hub once the transaction commits, and
+// webhook deliveries are queued.
+//
+// seq is taken at INSERT but becomes visible at COMMIT, so two of a user's
+// changes could otherwise commit out of order and a stream that has seen
+// the later one would skip the earlier. The user's advisory lock, held
+// until commit, makes their events commit in seq order.
+func emitEntryEvent(ctx context.Context, tx *sql.Tx, userID string, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", eventsLockClass, userID); err != nil {
+		return err
+	}
+	var seq int64
+	if err := tx.QueryRowContext(ctx,
+		`INSERT INTO entry_events (user_id, event, payload, created_at) VALUES ($1, $2, $3, $4) RETURNING seq`,
+		userID, event, string(payload), time.Now().UTC(),
+	).Scan(&seq); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", eventsChannel, userID+":"+strconv.FormatInt(seq, 10)); err != nil {
+		return err
+	}
+	return enqueueWebhookEvent(ctx, tx, userID, event, data)
+}
+
+type eventSubscriber struct {
+	ch chan entryEvent
+}
+
+// eventHub fans NOTIFY messages out to the SSE connections held by this
+// replica. Each replica runs its own hub with its own LISTEN connection.
+type eventHub struct {
+	db   *sql.DB
+	mu   sync.Mutex
+	subs map[string]map[*eventSubscriber]struct{}
+}
+
+func newEventHub(db *sql.DB) *eventHub {
+	return &eventHub{db: db, subs: map[string]map[*eventSubscriber]struct{}{}}
+}
+
+func (h *eventHub) subscribe(userID string) *eventSubscriber {
+	sub := &eventSubscriber{ch: make(chan entryEvent, eventsSubscriberBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[*eventSubscriber]struct{}{}
+	}
+	h.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(userID string, sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(userID, sub)
+}
+
+// remove must be called with mu held. Closing the channel ends the
+// client's stream; the browser reconnects and resumes from Last-Event-ID.
+func (h *eventHub) remove(userID string, sub *eventSubscriber) {
+	if _, ok := h.subs[userID][sub]; !ok {
+		return
+	}
+	delete(h.subs[userID], sub)
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+	close(sub.ch)
+}
+
+func (h *eventHub) hasSubscribers(userID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[userID]) > 0
+}
+
+func (h *eventHub) broadcast(userID string, ev entryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[userID] {
+		select {
+		case sub.ch <- ev:
+		default:
+			// A client too slow to keep up is cut loose rather than
+			// blocking everyone else; it will replay on reconnect.
+			h.remove(userID, sub)
+		}
+	}
+}
+
+// dropAll disconnects every client. Used whenever the LISTEN connection is
+// (re)established, since notifications sent while it was down are lost.
+func (h *eventHub) dropAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, subs := range h.subs {
+		for sub := range subs {
+			h.remove(userID, sub)
+		}
+	}
+}
+
+// run keeps a LISTEN connection open until ctx is cancelled.
+func (h *eventHub) run(ctx context.Context) {
+	for {
+		err := h.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("events listener stopped", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventsListenBackoff):
+		}
+	}
+}
+
+func (h *eventHub) listen(ctx context.Context) error {
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+eventsChannel); err != nil {
+			return err
+		}
+		h.dropAll()
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			h.dispatch(ctx, notification.Payload)
+		}
+	})
+}
+
+func (h *eventHub) dispatch(ctx context.Context, payload string) {
+	userID, rawSeq, ok := strings.Cut(payload, ":")
+	seq, err := strconv.ParseInt(rawSeq, 10, 64)
+	if !ok || err != nil {
+		slog.Warn("malformed event notification", "payload", payload)
+		return
+	}
+	if !h.hasSubscribers(userID) {
+		return
+	}
+	ev := entryEvent{seq: seq}
+	err = h.db.QueryRowContext(ctx,
+		"SELECT event, payload FROM entry_events WHERE user_id = $1 AND seq = $2", userID, seq,
+	).Scan(&ev.event, &ev.payload)
+	if err != nil {
+		slog.Error("failed to load event", "seq", seq, "err", err)
+		return
+	}
+	h.broadcast(userID, ev)
+}
+
+// replayEvents returns the user's events after lastID. resync is true when
+// some of them can no longer be replayed, either because they were pruned
+// or because there are too many. Events are pruned oldest first, so while
+// the user's event lastID is still kept nothing after it is gone; other
+// users' events never come into it.
+func replayEvents(ctx context.Context, db *sql.DB, userID string, lastID int64) ([]entryEvent, bool, error) {
+	var kept bool
+	if err := db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM entry_events WHERE user_id = $1 AND seq = $2)", userID, lastID,
+	).Scan(&kept); err != nil {
+		return nil, false, err
+	}
+	if !kept {
+		return nil, true, nil
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT seq, event, payload FROM entry_events
+		 WHERE user_id = $1 AND seq > $2
+		 ORDER BY seq
+		 LIMIT $3`,
+		userID, lastID, eventsReplayLimit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	events := []entryEvent{}
+	for rows.Next() {
+		var ev entryEvent
+		if err := rows.Scan(&ev.seq, &ev.event, &ev.payload); err != nil {
+			return nil, false, err
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(events) > eventsReplayLimit {
+		return nil, true, nil
+	}
+	return events, false, nil
+}
+
+// handleEvents serves GET /api/v1/events as a Server-Sent Events stream of the
+// user's entry changes. Each event's id is its sequence number, so a
+// reconnecting EventSource picks up where it left off via Last-Event-ID.
+func handleEvents(w http.ResponseWriter, r *http.Request, hub *eventHub, userID string) {
+	var lastID int64
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		lastID = n
+	}
+
+	// Subscribe before replaying so nothing committed in between is lost;
+	// duplicates are skipped by sequence number below.
+	sub := hub.subscribe(userID)
+	defer hub.unsubscribe(userID, sub)
+
+	var replay []entryEvent
+	resync := false
+	if lastID > 0 {
+		var err error
+		replay, resync, err = replayEvents(r.Context(), hub.db, userID, lastID)
+		if err != nil {
+			writeServerError(w, r, "failed to load events", err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	// Streams outlive any server-wide write timeout.
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsClientRetry.Milliseconds())
+
+	if resync {
+		// The client refetches everything, so it can resume from the newest
+		// event it is about to see live.
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", eventResync)
+	}
+	for _, ev := range replay {
+		writeEvent(w, ev)
+		lastID = ev.seq
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if ev.seq <= lastID {
+				continue
+			}
+			writeEvent(w, ev)
+			lastID = ev.seq
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev entryEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.seq, ev.event, ev.payload)
+}
+
+// withQueryToken lets EventSource clients, which cannot set headers, pass
+// their bearer token as ?access_token=.
+func withQueryToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			if token := r.URL.Query().Get("access_token"); token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		next(w, r)
+	}
+}
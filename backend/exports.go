@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	jobExportUser   = "export.user"
+	jobExportDelete = "export.delete"
+	// exportRetention is how long a finished export can be downloaded. It
+	// matches how long jobs.prune keeps the succeeded job that tracks it.
+	exportRetention = 7 * 24 * time.Hour
+)
+
+// UserExport is everything a user's data export holds.
+type UserExport struct {
+	ExportedAt string           `json:"exported_at"`
+	User       User             `json:"user"`
+	Entries    []Entry          `json:"entries"`
+	Recipes    []Recipe         `json:"recipes"`
+	Equipment  []Equipment      `json:"equipment"`
+	Tags       []Tag            `json:"tags"`
+	Sessions   []TastingSession `json:"sessions"`
+}
+
+// Export is a requested data export. Its status follows the job that
+// writes it: pending, ready or failed.
+type Export struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	DownloadURL string `json:"download_url,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// ExportJob writes, or later deletes, one export.
+type ExportJob struct {
+	UserID   string `json:"user_id"`
+	ExportID string `json:"export_id"`
+}
+
+func exportKey(userID string, exportID string) string {
+	return "exports/" + userID + "/" + exportID + ".json"
+}
+
+// handleCreateExport queues an export of the user's data. The response
+// names the export to poll until it is ready to download.
+func handleCreateExport(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id := newID()
+	if _, err := enqueueJob(r.Context(), db, jobExportUser, ExportJob{UserID: userID, ExportID: id}, JobOptions{}); err != nil {
+		writeServerError(w, r, "failed to queue export", err)
+		return
+	}
+	export, _, err := getExport(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load export", err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, export)
+}
+
+func handleGetExport(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	export, ok := pathExport(w, r, db, userID)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+func handleDownloadExport(w http.ResponseWriter, r *http.Request, db *sql.DB, blobs BlobStore, userID string) {
+	export, ok := pathExport(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if export.Status != "ready" {
+		writeAPIError(w, r, newAPIError(http.StatusConflict, codeConflict, "export is "+export.Status))
+		return
+	}
+	body, err := blobs.Get(r.Context(), exportKey(userID, export.ID))
+	if errors.Is(err, errBlobNotFound) {
+		writeError(w, r, http.StatusNotFound, "export not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, "failed to load export", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="coffee-log-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, body)
+}
+
+func pathExport(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (Export, bool) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return Export{}, false
+	}
+	export, found, err := getExport(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load export", err)
+		return Export{}, false
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "export not found")
+		return Export{}, false
+	}
+	return export, true
+}
+
+// getExport reads an export's state from the job that writes it.
+func getExport(ctx context.Context, db *sql.DB, userID string, id string) (Export, bool, error) {
+	var status string
+	var created time.Time
+	err := db.QueryRowContext(ctx,
+		`SELECT status, created_at FROM jobs
+		 WHERE kind = $1 AND payload->>'user_id' = $2 AND payload->>'export_id' = $3`,
+		jobExportUser, userID, id,
+	).Scan(&status, &created)
+	if err == sql.ErrNoRows {
+		return Export{}, false, nil
+	}
+	if err != nil {
+		return Export{}, false, err
+	}
+	export := Export{ID: id, Status: "pending", CreatedAt: created.UTC().Format(time.RFC3339)}
+	switch status {
+	case jobStatusSucceeded:
+		export.Status = "ready"
+		export.DownloadURL = apiV1Prefix + "/exports/" + id + "/download"
+	case jobStatusDead:
+		export.Status = "failed"
+	}
+	return export, true, nil
+}
+
+// buildUserExport gathers everything the user has stored.
+func buildUserExport(ctx context.Context, store Store, user User) (UserExport, error) {
+	var err error
+	export := UserExport{ExportedAt: time.Now().UTC().Format(time.RFC3339), User: user}
+	if export.Entries, err = store.ListEntries(ctx, user.ID, EntryFilter{}); err != nil {
+		return UserExport{}, err
+	}
+	// The rest only exists on Postgres.
+	if store.Dialect() == dialectPostgres {
+		db := store.DB()
+		if export.Recipes, err = listRecipes(ctx, db, user.ID); err != nil {
+			return UserExport{}, err
+		}
+		if export.Equipment, err = listEquipment(ctx, db, user.ID, ""); err != nil {
+			return UserExport{}, err
+		}
+		if export.Tags, err = listTags(ctx, db, user.ID); err != nil {
+			return UserExport{}, err
+		}
+		if export.Sessions, err = listSessions(ctx, db, user.ID); err != nil {
+			return UserExport{}, err
+		}
+	}
+	return export, nil
+}
+
+// writeExport runs an export.user job: it stores the export and schedules
+// its deletion once the download window has passed.
+func writeExport(ctx context.Context, store Store, blobs BlobStore, job ExportJob) error {
+	user, found, err := store.FindUser(ctx, job.UserID)
+	if err != nil || !found {
+		// A deleted account has nothing left to export.
+		return err
+	}
+	export, err := buildUserExport(ctx, store, user)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := blobs.Put(ctx, exportKey(job.UserID, job.ExportID), "application/json", data); err != nil {
+		return err
+	}
+	_, err = enqueueJob(ctx, store.DB(), jobExportDelete, job, JobOptions{
+		RunAt:     time.Now().Add(exportRetention),
+		DedupeKey: jobExportDelete + ":" + job.ExportID,
+	})
+	return err
+}
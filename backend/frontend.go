@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Vite fingerprints everything it emits under assets/, so those files can
+// be cached forever. Everything else (index.html, sw.js, the manifest)
+// must be revalidated so a new deploy is picked up.
+const (
+	frontendImmutableCache = "public, max-age=31536000, immutable"
+	frontendRevalidate     = "no-cache"
+	frontendAssetsPrefix   = "assets/"
+	frontendIndex          = "index.html"
+)
+
+// frontendEncodings lists the precompressed variants looked for next to
+// each file, in order of preference.
+var frontendEncodings = []struct {
+	name   string
+	suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type frontendFile struct {
+	etag      string
+	encodings map[string]string // Content-Encoding -> path of the variant
+}
+
+// frontendHandler serves a built single-page app: real files with cache
+// headers and precompressed variants, and index.html for any other path so
+// client-side routes survive a reload.
+type frontendHandler struct {
+	fsys  fs.FS
+	files map[string]frontendFile
+}
+
+// frontendAssets returns the SPA to serve, if any: FRONTEND_DIR on disk
+// wins over a dist/ compiled in with the embedfrontend build tag.
+func frontendAssets(dir string) (fs.FS, error) {
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New("FRONTEND_DIR is not a directory")
+		}
+		return os.DirFS(dir), nil
+	}
+	return embeddedFrontend()
+}
+
+// newFrontendHandler indexes fsys up front, hashing each file for its ETag.
+func newFrontendHandler(fsys fs.FS) (*frontendHandler, error) {
+	if _, err := fs.Stat(fsys, frontendIndex); err != nil {
+		return nil, errors.New("frontend assets have no index.html")
+	}
+	h := &frontendHandler{fsys: fsys, files: map[string]frontendFile{}}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		for _, enc := range frontendEncodings {
+			if strings.HasSuffix(name, enc.suffix) {
+				return nil
+			}
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		file := frontendFile{etag: `"` + hex.EncodeToString(sum[:8]) + `"`, encodings: map[string]string{}}
+		for _, enc := range frontendEncodings {
+			if _, err := fs.Stat(fsys, name+enc.suffix); err == nil {
+				file.encodings[enc.name] = name + enc.suffix
+			}
+		}
+		h.files[name] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *frontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	file, ok := h.files[name]
+	if !ok {
+		// A missing file with an extension is a broken asset link, not a
+		// client-side route.
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		name = frontendIndex
+		file = h.files[name]
+	}
+
+	if strings.HasPrefix(name, frontendAssetsPrefix) {
+		w.Header().Set("Cache-Control", frontendImmutableCache)
+	} else {
+		w.Header().Set("Cache-Control", frontendRevalidate)
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", file.etag)
+
+	served := name
+	if len(file.encodings) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		accepted := r.Header.Get("Accept-Encoding")
+		for _, enc := range frontendEncodings {
+			if variant, ok := file.encodings[enc.name]; ok && acceptsEncoding(accepted, enc.name) {
+				served = variant
+				w.Header().Set("Content-Encoding", enc.name)
+				// Each encoding is a different representation.
+				w.Header().Set("ETag", strings.TrimSuffix(file.etag, `"`)+"-"+enc.name+`"`)
+				break
+			}
+		}
+	}
+
+	f, err := h.fsys.Open(served)
+	if err != nil {
+		writeServerError(w, r, "failed to open asset", err)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			writeServerError(w, r, "failed to read asset", err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	// Embedded files carry no modification time; the ETag drives
+	// conditional requests instead.
+	http.ServeContent(w, r, name, time.Time{}, content)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding,
+// honouring an explicit q=0.
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(token), coding) {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
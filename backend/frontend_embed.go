@@ -0,0 +1,17 @@
+//go:build embedfrontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Built by `make build-binary`, which copies frontend/dist here first.
+//
+//go:embed all:web/dist
+var embeddedFrontendFiles embed.FS
+
+func embeddedFrontend() (fs.FS, error) {
+	return fs.Sub(embeddedFrontendFiles, "web/dist")
+}
@@ -0,0 +1,11 @@
+//go:build !embedfrontend
+
+package main
+
+import "io/fs"
+
+// embeddedFrontend reports no assets unless the binary was built with the
+// embedfrontend tag.
+func embeddedFrontend() (fs.FS, error) {
+	return nil, nil
+}
@@ -0,0 +1,982 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+var errForbidden = errors.New("you do not have permission to do that")
+
+// Group is a shared shelf. Role is the requesting user's role in it.
+type Group struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Role      string        `json:"role"`
+	Members   []GroupMember `json:"members,omitempty"`
+	CreatedAt string        `json:"created_at"`
+	UpdatedAt string        `json:"updated_at"`
+}
+
+type GroupMember struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	JoinedAt string `json:"joined_at"`
+}
+
+type GroupInvitation struct {
+	ID        string `json:"id"`
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	Email     string `json:"email,omitempty"`
+	Role      string `json:"role"`
+	Token     string `json:"token"`
+	AcceptURL string `json:"accept_url"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+type InvitationInput struct {
+	Email          string `json:"email,omitempty"`
+	Role           string `json:"role"`
+	ExpiresInHours int    `json:"expires_in_hours,omitempty"`
+}
+
+// Bean is a bag on a group's shelf. Weights are in grams and roasted_on is
+// a calendar date (YYYY-MM-DD).
+type Bean struct {
+	ID             string  `json:"id"`
+	GroupID        string  `json:"group_id"`
+	Name           string  `json:"name"`
+	Roaster        string  `json:"roaster"`
+	Origin         string  `json:"origin"`
+	RoastedOn      string  `json:"roasted_on,omitempty"`
+	WeightGrams    float64 `json:"weight_grams"`
+	RemainingGrams float64 `json:"remaining_grams"`
+	Notes          string  `json:"notes"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+type BeanInput struct {
+	ID             string  `json:"id,omitempty"`
+	GroupID        string  `json:"group_id"`
+	Name           string  `json:"name"`
+	Roaster        string  `json:"roaster"`
+	Origin         string  `json:"origin"`
+	RoastedOn      string  `json:"roasted_on,omitempty"`
+	WeightGrams    float64 `json:"weight_grams"`
+	RemainingGrams float64 `json:"remaining_grams"`
+	Notes          string  `json:"notes"`
+}
+
+// SharedEntry is an entry seen through a shared bean, tagged with who
+// brewed it.
+type SharedEntry struct {
+	Entry
+	AuthorID    string `json:"author_id"`
+	AuthorEmail string `json:"author_email"`
+}
+
+const beanColumns = `id, group_id, name, roaster, origin, roasted_on, weight_grams, remaining_grams, notes, created_at, updated_at`
+
+// groupRole returns the user's role in a group, or "" when they are not a
+// member. Every group-scoped query goes through this (or joins
+// group_members itself) instead of filtering on user_id.
+func groupRole(ctx context.Context, db *sql.DB, groupID string, userID string) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx,
+		"SELECT role FROM group_members WHERE group_id = $1 AND user_id = $2",
+		groupID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func hasRole(role string, min string) bool {
+	return roleRanks[role] >= roleRanks[min]
+}
+
+func handleListGroups(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groups, err := listGroups(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load groups", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func handleCreateGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		writeInvalid(w, r, fieldError("name", "name is required"))
+		return
+	}
+	group, err := createGroup(r.Context(), db, userID, strings.TrimSpace(body.Name))
+	if err != nil {
+		writeServerError(w, r, "failed to create group", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, group)
+}
+
+// pathGroup resolves the {id} wildcard to a group the user belongs to and
+// their role in it, answering the request itself when there is none.
+// Non-members get the same 404 as a missing group.
+func pathGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (string, string, bool) {
+	groupID, err := normalizeID(r.PathValue("id"))
+	if err != nil || groupID == "" {
+		writeError(w, r, http.StatusNotFound, "group not found")
+		return "", "", false
+	}
+	role, err := groupRole(r.Context(), db, groupID, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load group", err)
+		return "", "", false
+	}
+	if role == "" {
+		writeError(w, r, http.StatusNotFound, "group not found")
+		return "", "", false
+	}
+	return groupID, role, true
+}
+
+// pathGroupOwner is pathGroup for the routes only owners may use.
+func pathGroupOwner(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (string, string, bool) {
+	groupID, role, ok := pathGroup(w, r, db, userID)
+	if ok && !hasRole(role, roleOwner) {
+		writeError(w, r, http.StatusForbidden, errForbidden.Error())
+		return "", "", false
+	}
+	return groupID, role, ok
+}
+
+func handleGetGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, role, ok := pathGroup(w, r, db, userID)
+	if !ok {
+		return
+	}
+	group, err := getGroup(r.Context(), db, groupID, role)
+	if err != nil {
+		writeServerError(w, r, "failed to load group", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+func handleRenameGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, role, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		writeInvalid(w, r, fieldError("name", "name is required"))
+		return
+	}
+	if _, err := db.ExecContext(r.Context(),
+		"UPDATE groups SET name = $1, updated_at = $2 WHERE id = $3",
+		strings.TrimSpace(body.Name), time.Now().UTC(), groupID,
+	); err != nil {
+		writeServerError(w, r, "failed to update group", err)
+		return
+	}
+	group, err := getGroup(r.Context(), db, groupID, role)
+	if err != nil {
+		writeServerError(w, r, "failed to load group", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+func handleDeleteGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, _, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM groups WHERE id = $1", groupID); err != nil {
+		writeServerError(w, r, "failed to delete group", err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleListMembers(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, role, ok := pathGroup(w, r, db, userID)
+	if !ok {
+		return
+	}
+	group, err := getGroup(r.Context(), db, groupID, role)
+	if err != nil {
+		writeServerError(w, r, "failed to load members", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group.Members)
+}
+
+func handleSetMemberRole(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, _, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	target := r.PathValue("user_id")
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if _, ok := roleRanks[body.Role]; !ok {
+		writeInvalid(w, r, fieldError("role", "role must be owner, editor or viewer"))
+		return
+	}
+	found, err := setMemberRole(r.Context(), db, groupID, target, body.Role)
+	if err != nil {
+		writeServerError(w, r, "failed to update member", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "member not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"user_id": target, "role": body.Role})
+}
+
+func handleRemoveMember(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, role, ok := pathGroup(w, r, db, userID)
+	if !ok {
+		return
+	}
+	target := r.PathValue("user_id")
+	// Owners can remove anyone; everyone else can only leave.
+	if target != userID && !hasRole(role, roleOwner) {
+		writeError(w, r, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+	found, err := removeMember(r.Context(), db, groupID, target)
+	if err != nil {
+		writeServerError(w, r, "failed to remove member", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "member not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleListGroupInvitations(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, _, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	invitations, err := listGroupInvitations(r.Context(), db, groupID)
+	if err != nil {
+		writeServerError(w, r, "failed to load invitations", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invitations)
+}
+
+func handleCreateInvitation(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, _, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	var input InvitationInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	invitation, err := createInvitation(r.Context(), db, groupID, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to create invitation", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, invitation)
+}
+
+func handleRevokeInvitation(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	groupID, _, ok := pathGroupOwner(w, r, db, userID)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(),
+		"DELETE FROM group_invitations WHERE group_id = $1 AND id = $2 AND accepted_at IS NULL",
+		groupID, r.PathValue("invitation_id"),
+	)
+	if err != nil {
+		writeServerError(w, r, "failed to revoke invitation", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "invitation not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// handleMyInvitations lists the pending invitations for the signed-in
+// user's email.
+func handleMyInvitations(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	invitations, err := listMyInvitations(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load invitations", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invitations)
+}
+
+func handleAcceptInvitation(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	group, err := acceptInvitation(r.Context(), db, userID, r.PathValue("token"))
+	if err != nil {
+		writeServerError(w, r, "failed to accept invitation", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+// handleListBeans lists the beans on the user's shelves, optionally just
+// one group's (?group_id=).
+func handleListBeans(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	beans, err := listBeans(r.Context(), db, userID, r.URL.Query().Get("group_id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load beans", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, beans)
+}
+
+func handleCreateBean(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input BeanInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateBean(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	role, err := groupRole(r.Context(), db, input.GroupID, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load group", err)
+		return
+	}
+	if !hasRole(role, roleEditor) {
+		writeError(w, r, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+	bean, err := createBean(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save bean", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, bean)
+}
+
+// pathBean loads the bean named by the {id} wildcard together with the
+// user's role in its group, answering the request itself when there is
+// none.
+func pathBean(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (Bean, string, bool) {
+	bean, role, found, err := getBean(r.Context(), db, userID, r.PathValue("id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load bean", err)
+		return Bean{}, "", false
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "bean not found")
+		return Bean{}, "", false
+	}
+	return bean, role, true
+}
+
+func handleGetBean(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	bean, _, ok := pathBean(w, r, db, userID)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, bean)
+}
+
+func handleUpdateBean(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	bean, role, ok := pathBean(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if !hasRole(role, roleEditor) {
+		writeError(w, r, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+	var input BeanInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	input.GroupID = bean.GroupID
+	if err := validateBean(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	bean, err := updateBean(r.Context(), db, bean.ID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to update bean", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bean)
+}
+
+func handleDeleteBean(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	bean, role, ok := pathBean(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if !hasRole(role, roleEditor) {
+		writeError(w, r, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM beans WHERE id = $1", bean.ID); err != nil {
+		writeServerError(w, r, "failed to delete bean", err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleBeanEntries(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	bean, _, ok := pathBean(w, r, db, userID)
+	if !ok {
+		return
+	}
+	entries, err := listBeanEntries(r.Context(), db, userID, bean.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load entries", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// validateEntryBean checks that the user belongs to the group whose shelf
+// holds the entry's bean.
+func validateEntryBean(ctx context.Context, q querier, userID string, input EntryInput) error {
+	id := strings.TrimSpace(input.BeanID)
+	if id == "" {
+		return nil
+	}
+	_, _, found, err := getBean(ctx, q, userID, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fieldError("bean_id", "bean_id does not match any bean on your shelves")
+	}
+	return nil
+}
+
+func validateBean(input BeanInput) error {
+	fields := fieldErrors{}
+	fields.id("id", input.ID)
+	if strings.TrimSpace(input.GroupID) == "" {
+		fields.add("group_id", "group_id is required")
+	}
+	if strings.TrimSpace(input.Name) == "" {
+		fields.add("name", "name is required")
+	}
+	if input.RoastedOn != "" {
+		if _, err := time.Parse(time.DateOnly, input.RoastedOn); err != nil {
+			fields.add("roasted_on", "roasted_on must be a date (e.g. 2024-05-01)")
+		}
+	}
+	if input.WeightGrams < 0 {
+		fields.add("weight_grams", "weight_grams cannot be negative")
+	}
+	if input.RemainingGrams < 0 {
+		fields.add("remaining_grams", "remaining_grams cannot be negative")
+	} else if input.RemainingGrams > input.WeightGrams {
+		fields.add("remaining_grams", "remaining_grams cannot exceed weight_grams")
+	}
+	return fields.err()
+}
+
+func createGroup(ctx context.Context, db *sql.DB, userID string, name string) (Group, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Group{}, err
+	}
+	defer tx.Rollback()
+
+	id := newID()
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO groups (id, name, created_at, updated_at) VALUES ($1, $2, $3, $3)",
+		id, name, now,
+	); err != nil {
+		return Group{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)",
+		id, userID, roleOwner, now,
+	); err != nil {
+		return Group{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Group{}, err
+	}
+	return getGroup(ctx, db, id, roleOwner)
+}
+
+func listGroups(ctx context.Context, db *sql.DB, userID string) ([]Group, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT g.id, g.name, m.role, g.created_at, g.updated_at
+		 FROM groups g
+		 JOIN group_members m ON m.group_id = g.id
+		 WHERE m.user_id = $1
+		 ORDER BY g.name`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		var created, updated time.Time
+		if err := rows.Scan(&group.ID, &group.Name, &group.Role, &created, &updated); err != nil {
+			return nil, err
+		}
+		group.CreatedAt = created.UTC().Format(time.RFC3339)
+		group.UpdatedAt = updated.UTC().Format(time.RFC3339)
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// getGroup loads a group and its members. Callers must already have checked
+// membership; role is echoed back as the caller's role.
+func getGroup(ctx context.Context, db *sql.DB, groupID string, role string) (Group, error) {
+	group := Group{ID: groupID, Role: role}
+	var created, updated time.Time
+	if err := db.QueryRowContext(ctx,
+		"SELECT name, created_at, updated_at FROM groups WHERE id = $1", groupID,
+	).Scan(&group.Name, &created, &updated); err != nil {
+		return Group{}, err
+	}
+	group.CreatedAt = created.UTC().Format(time.RFC3339)
+	group.UpdatedAt = updated.UTC().Format(time.RFC3339)
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT u.id, u.email, m.role, m.joined_at
+		 FROM group_members m
+		 JOIN users u ON u.id = m.user_id
+		 WHERE m.group_id = $1
+		 ORDER BY m.joined_at`,
+		groupID,
+	)
+	if err != nil {
+		return Group{}, err
+	}
+	defer rows.Close()
+
+	group.Members = []GroupMember{}
+	for rows.Next() {
+		var member GroupMember
+		var joined time.Time
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &joined); err != nil {
+			return Group{}, err
+		}
+		member.JoinedAt = joined.UTC().Format(time.RFC3339)
+		group.Members = append(group.Members, member)
+	}
+	return group, rows.Err()
+}
+
+// setMemberRole changes a member's role, refusing to demote the last owner.
+func setMemberRole(ctx context.Context, db *sql.DB, groupID string, userID string, role string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE group_members SET role = $1 WHERE group_id = $2 AND user_id = $3",
+		role, groupID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+	if err := ensureOwner(ctx, tx, groupID); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+// removeMember removes a member, refusing to remove the last owner.
+func removeMember(ctx context.Context, db *sql.DB, groupID string, userID string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"DELETE FROM group_members WHERE group_id = $1 AND user_id = $2", groupID, userID)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+	if err := ensureOwner(ctx, tx, groupID); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+func ensureOwner(ctx context.Context, tx *sql.Tx, groupID string) error {
+	var owners int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM group_members WHERE group_id = $1 AND role = $2", groupID, roleOwner,
+	).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return newAPIError(http.StatusConflict, codeConflict, "a group must keep at least one owner")
+	}
+	return nil
+}
+
+func createInvitation(ctx context.Context, db *sql.DB, groupID string, createdBy string, input InvitationInput) (GroupInvitation, error) {
+	if _, ok := roleRanks[input.Role]; !ok {
+		return GroupInvitation{}, fieldError("role", "role must be owner, editor or viewer")
+	}
+	email := strings.ToLower(strings.TrimSpace(input.Email))
+	if email != "" && !strings.Contains(email, "@") {
+		return GroupInvitation{}, fieldError("email", "valid email is required")
+	}
+	if input.ExpiresInHours < 0 {
+		return GroupInvitation{}, fieldError("expires_in_hours", "expires_in_hours cannot be negative")
+	}
+
+	now := time.Now().UTC()
+	var expires sql.NullTime
+	if input.ExpiresInHours > 0 {
+		expires = sql.NullTime{Time: now.Add(time.Duration(input.ExpiresInHours) * time.Hour), Valid: true}
+	}
+	id := newID()
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO group_invitations (id, group_id, email, token, role, created_by, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		id, groupID, nullString(email), newToken(), input.Role, createdBy, now, expires,
+	); err != nil {
+		return GroupInvitation{}, err
+	}
+
+	invitations, err := queryInvitations(ctx, db, "i.id = $1", id)
+	if err != nil {
+		return GroupInvitation{}, err
+	}
+	if len(invitations) == 0 {
+		return GroupInvitation{}, errors.New("created invitation " + id + " not found")
+	}
+	return invitations[0], nil
+}
+
+func listGroupInvitations(ctx context.Context, db *sql.DB, groupID string) ([]GroupInvitation, error) {
+	return queryInvitations(ctx, db, "i.group_id = $1 AND i.accepted_at IS NULL", groupID)
+}
+
+func listMyInvitations(ctx context.Context, db *sql.DB, userID string) ([]GroupInvitation, error) {
+	return queryInvitations(ctx, db,
+		`i.email = (SELECT email FROM users WHERE id = $1)
+		 AND i.accepted_at IS NULL
+		 AND (i.expires_at IS NULL OR i.expires_at > now())
+		 AND NOT EXISTS (SELECT 1 FROM group_members m WHERE m.group_id = i.group_id AND m.user_id = $1)`,
+		userID,
+	)
+}
+
+func queryInvitations(ctx context.Context, db *sql.DB, where string, arg string) ([]GroupInvitation, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT i.id, i.group_id, g.name, COALESCE(i.email, ''), i.role, i.token, i.created_at, i.expires_at
+		 FROM group_invitations i
+		 JOIN groups g ON g.id = i.group_id
+		 WHERE `+where+`
+		 ORDER BY i.created_at DESC`,
+		arg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []GroupInvitation{}
+	for rows.Next() {
+		var inv GroupInvitation
+		var created time.Time
+		var expires sql.NullTime
+		if err := rows.Scan(&inv.ID, &inv.GroupID, &inv.GroupName, &inv.Email, &inv.Role, &inv.Token, &created, &expires); err != nil {
+			return nil, err
+		}
+		inv.AcceptURL = apiV1Prefix + "/invitations/" + inv.Token + "/accept"
+		inv.CreatedAt = created.UTC().Format(time.RFC3339)
+		if expires.Valid {
+			inv.ExpiresAt = expires.Time.UTC().Format(time.RFC3339)
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// acceptInvitation joins the user to the invitation's group. Email
+// invitations are single use and bound to that address; link invitations
+// stay valid for anyone until they expire or are revoked.
+func acceptInvitation(ctx context.Context, db *sql.DB, userID string, token string) (Group, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Group{}, err
+	}
+	defer tx.Rollback()
+
+	var id, groupID, role string
+	var email sql.NullString
+	var expires, accepted sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, group_id, email, role, expires_at, accepted_at
+		 FROM group_invitations WHERE token = $1 FOR UPDATE`,
+		token,
+	).Scan(&id, &groupID, &email, &role, &expires, &accepted)
+	if err == sql.ErrNoRows {
+		return Group{}, newAPIError(http.StatusNotFound, codeNotFound, "invitation not found")
+	}
+	if err != nil {
+		return Group{}, err
+	}
+	if expires.Valid && time.Now().After(expires.Time) {
+		return Group{}, newAPIError(http.StatusConflict, codeConflict, "invitation has expired")
+	}
+	if email.Valid {
+		if accepted.Valid {
+			return Group{}, newAPIError(http.StatusConflict, codeConflict, "invitation has already been used")
+		}
+		var userEmail string
+		if err := tx.QueryRowContext(ctx, "SELECT email FROM users WHERE id = $1", userID).Scan(&userEmail); err != nil {
+			return Group{}, err
+		}
+		if userEmail != email.String {
+			return Group{}, newAPIError(http.StatusForbidden, codeForbidden, "invitation was sent to a different email")
+		}
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO group_members (group_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (group_id, user_id) DO NOTHING`,
+		groupID, userID, role, now,
+	); err != nil {
+		return Group{}, err
+	}
+	if email.Valid {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE group_invitations SET accepted_by = $1, accepted_at = $2 WHERE id = $3",
+			userID, now, id,
+		); err != nil {
+			return Group{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Group{}, err
+	}
+
+	memberRole, err := groupRole(ctx, db, groupID, userID)
+	if err != nil {
+		return Group{}, err
+	}
+	return getGroup(ctx, db, groupID, memberRole)
+}
+
+// listBeans returns the beans on every shelf the user belongs to, or on
+// one shelf when groupID is set.
+func listBeans(ctx context.Context, db *sql.DB, userID string, groupID string) ([]Bean, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT b.`+strings.ReplaceAll(beanColumns, ", ", ", b.")+`
+		 FROM beans b
+		 JOIN group_members m ON m.group_id = b.group_id AND m.user_id = $1
+		 WHERE $2 = '' OR b.group_id = $2
+		 ORDER BY b.name`,
+		userID, groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	beans := []Bean{}
+	for rows.Next() {
+		bean, err := scanBean(rows)
+		if err != nil {
+			return nil, err
+		}
+		beans = append(beans, bean)
+	}
+	return beans, rows.Err()
+}
+
+// getBean loads a bean the user can see, along with their role in its group.
+func getBean(ctx context.Context, q querier, userID string, id string) (Bean, string, bool, error) {
+	var role string
+	err := q.QueryRowContext(ctx,
+		`SELECT m.role FROM beans b
+		 JOIN group_members m ON m.group_id = b.group_id AND m.user_id = $1
+		 WHERE b.id = $2`,
+		userID, id,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return Bean{}, "", false, nil
+	}
+	if err != nil {
+		return Bean{}, "", false, err
+	}
+	bean, err := scanBean(q.QueryRowContext(ctx, `SELECT `+beanColumns+` FROM beans WHERE id = $1`, id))
+	if err != nil {
+		return Bean{}, "", false, err
+	}
+	return bean, role, true, nil
+}
+
+func createBean(ctx context.Context, db *sql.DB, userID string, input BeanInput) (Bean, error) {
+	id, err := normalizeID(input.ID)
+	if err != nil {
+		return Bean{}, err
+	}
+	if id == "" {
+		id = newID()
+	}
+	now := time.Now().UTC()
+	row := db.QueryRowContext(ctx,
+		`INSERT INTO beans (id, group_id, name, roaster, origin, roasted_on, weight_grams, remaining_grams, notes, created_by, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $11)
+		 RETURNING `+beanColumns,
+		id, input.GroupID, strings.TrimSpace(input.Name), strings.TrimSpace(input.Roaster), strings.TrimSpace(input.Origin),
+		nullString(input.RoastedOn), input.WeightGrams, input.RemainingGrams, input.Notes, userID, now,
+	)
+	return scanBean(row)
+}
+
+func updateBean(ctx context.Context, db *sql.DB, id string, input BeanInput) (Bean, error) {
+	row := db.QueryRowContext(ctx,
+		`UPDATE beans
+		 SET name = $1, roaster = $2, origin = $3, roasted_on = $4, weight_grams = $5, remaining_grams = $6,
+		     notes = $7, updated_at = $8
+		 WHERE id = $9
+		 RETURNING `+beanColumns,
+		strings.TrimSpace(input.Name), strings.TrimSpace(input.Roaster), strings.TrimSpace(input.Origin),
+		nullString(input.RoastedOn), input.WeightGrams, input.RemainingGrams, input.Notes, time.Now().UTC(), id,
+	)
+	return scanBean(row)
+}
+
+// listBeanEntries returns every current member's entries for a shared bean.
+// The viewer's membership is part of the join, so nothing is returned for
+// beans on shelves they don't belong to.
+func listBeanEntries(ctx context.Context, db *sql.DB, userID string, beanID string) ([]SharedEntry, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+entryColumns+`, u.id, u.email
+		 FROM entries
+		 JOIN beans b ON b.id = entries.bean_id
+		 JOIN group_members viewer ON viewer.group_id = b.group_id AND viewer.user_id = $1
+		 JOIN group_members author ON author.group_id = b.group_id AND author.user_id = entries.user_id
+		 JOIN users u ON u.id = entries.user_id
+		 WHERE b.id = $2
+		 ORDER BY entries.brewed_at DESC`,
+		userID, beanID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []SharedEntry{}
+	for rows.Next() {
+		var shared SharedEntry
+		entry, err := scanEntry(sharedEntryScanner{rows, &shared})
+		if err != nil {
+			return nil, err
+		}
+		shared.Entry = entry
+		entries = append(entries, shared)
+	}
+	return entries, rows.Err()
+}
+
+// sharedEntryScanner appends the author columns to the destinations
+// scanEntry passes, so the entry scanning logic stays in one place.
+type sharedEntryScanner struct {
+	rows   *sql.Rows
+	shared *SharedEntry
+}
+
+func (s sharedEntryScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, &s.shared.AuthorID, &s.shared.AuthorEmail)...)
+}
+
+func scanBean(row rowScanner) (Bean, error) {
+	var bean Bean
+	var roasted sql.NullTime
+	var created, updated time.Time
+	if err := row.Scan(
+		&bean.ID,
+		&bean.GroupID,
+		&bean.Name,
+		&bean.Roaster,
+		&bean.Origin,
+		&roasted,
+		&bean.WeightGrams,
+		&bean.RemainingGrams,
+		&bean.Notes,
+		&created,
+		&updated,
+	); err != nil {
+		return Bean{}, err
+	}
+	if roasted.Valid {
+		bean.RoastedOn = roasted.Time.Format(time.DateOnly)
+	}
+	bean.CreatedAt = created.UTC().Format(time.RFC3339)
+	bean.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	return bean, nil
+}
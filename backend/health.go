@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// healthState is flipped to draining when shutdown starts, so load
+// balancers stop routing here before the listener closes.
+type healthState struct {
+	draining atomic.Bool
+}
+
+type HealthStatus struct {
+	Status  string            `json:"status"`
+	Checks  map[string]string `json:"checks,omitempty"`
+	Pending []string          `json:"pending_migrations,omitempty"`
+}
+
+// handleLiveness answers as long as the process can serve HTTP at all.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// handleReadiness reports whether this instance should receive traffic:
+// not shutting down, database reachable and every migration applied.
+func handleReadiness(w http.ResponseWriter, r *http.Request, db *sql.DB, health *healthState, migrations fs.FS) {
+	if health.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, HealthStatus{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	status := HealthStatus{Status: "ready", Checks: map[string]string{"database": "ok", "migrations": "ok"}}
+	if err := db.PingContext(ctx); err != nil {
+		status.Status = "unavailable"
+		status.Checks["database"] = "unreachable"
+		status.Checks["migrations"] = "unknown"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	pending, err := pendingMigrations(ctx, db, migrations)
+	if err != nil {
+		status.Status = "unavailable"
+		status.Checks["migrations"] = "unknown"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	if len(pending) > 0 {
+		status.Status = "unavailable"
+		status.Checks["migrations"] = "pending"
+		status.Pending = pending
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// pendingMigrations lists migration files not yet recorded in
+// schema_migrations.
+func pendingMigrations(ctx context.Context, db *sql.DB, migrations fs.FS) ([]string, error) {
+	files, err := migrationFiles(migrations)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT filename FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+	for _, name := range files {
+		if !applied[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
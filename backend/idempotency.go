@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader marks a response that was replayed from an
+	// earlier request with the same key rather than produced afresh.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLen     = 255
+	// idempotencyLease is how long a running request holds its key. A
+	// repeat after that runs again, on the assumption that the first
+	// request died before it could complete or release the key.
+	idempotencyLease = time.Minute
+)
+
+// idempotencyRecord is what is kept for an Idempotency-Key. Status is zero
+// while the request that claimed the key is still running.
+type idempotencyRecord struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// withIdempotency lets a client retry a non-idempotent request safely. A
+// request carrying an Idempotency-Key runs once; its response is kept for
+// window and replayed for any repeat of the same key with the same body.
+// Reusing the key with a different body is rejected, as is a repeat that
+// arrives while the first request is still running. Keys belong to the
+// signed-in user. Server errors and panics are not kept, so a retry after
+// one runs again, as does one arriving after idempotencyLease when the
+// first request never finished. A zero window turns the header off.
+func withIdempotency(store Store, window time.Duration, next func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, userID string) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || window <= 0 {
+			next(w, r, userID)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeError(w, r, http.StatusBadRequest,
+				idempotencyKeyHeader+" must be 1 to "+strconv.Itoa(idempotencyKeyMaxLen)+" printable ASCII characters")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeInvalid(w, r, decodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		now := time.Now()
+		record, claimed, err := store.ClaimIdempotencyKey(r.Context(), userID, key, hash, now.Add(idempotencyLease), now.Add(window))
+		if err != nil {
+			writeServerError(w, r, "failed to check idempotency key", err)
+			return
+		}
+		if !claimed {
+			switch {
+			case record.RequestHash != hash:
+				writeAPIError(w, r, newAPIError(http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+					idempotencyKeyHeader+" was already used for a different request"))
+			case record.Status == 0:
+				w.Header().Set("Retry-After", "1")
+				writeAPIError(w, r, newAPIError(http.StatusConflict, codeIdempotencyKeyInUse,
+					"a request with this "+idempotencyKeyHeader+" is still in progress"))
+			default:
+				if record.ContentType != "" {
+					w.Header().Set("Content-Type", record.ContentType)
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(record.Status)
+				_, _ = w.Write(record.Body)
+			}
+			return
+		}
+
+		// The key outlives the request, so its bookkeeping must not be cut
+		// short by a client that has hung up.
+		ctx := context.WithoutCancel(r.Context())
+		defer func() {
+			if p := recover(); p != nil {
+				if err := store.ReleaseIdempotencyKey(ctx, userID, key); err != nil {
+					logger(ctx).Error("failed to release idempotency key", "err", err, "method", r.Method, "path", r.URL.Path)
+				}
+				panic(p)
+			}
+		}()
+		rec := &responseBuffer{header: w.Header(), status: http.StatusOK}
+		next(rec, r, userID)
+		if rec.status >= 500 {
+			err = store.ReleaseIdempotencyKey(ctx, userID, key)
+		} else {
+			err = store.CompleteIdempotencyKey(ctx, userID, key, rec.status, rec.header.Get("Content-Type"), rec.body.Bytes())
+		}
+		if err != nil {
+			logger(ctx).Error("failed to record idempotency key", "err", err, "method", r.Method, "path", r.URL.Path)
+		}
+		w.WriteHeader(rec.status)
+		_, _ = w.Write(rec.body.Bytes())
+	}
+}
+
+// validIdempotencyKey accepts up to idempotencyKeyMaxLen visible ASCII
+// characters, which covers UUIDs and the other formats clients generate.
+func validIdempotencyKey(key string) bool {
+	if len(key) > idempotencyKeyMaxLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// responseBuffer holds a response back so it can be stored before it is
+// sent. Headers go straight to the real writer's map.
+type responseBuffer struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+// ClaimIdempotencyKey first forgets every expired key, so an expired one
+// can be claimed afresh.
+func (s *sqlStore) ClaimIdempotencyKey(ctx context.Context, userID string, key string, requestHash string, lockedUntil time.Time, expires time.Time) (idempotencyRecord, bool, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", now); err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, created_at, expires_at, locked_until)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (user_id, idempotency_key) DO NOTHING`,
+		userID, key, requestHash, now, expires.UTC(), lockedUntil.UTC(),
+	)
+	if err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		return idempotencyRecord{}, true, nil
+	}
+	// Only a repeat of the same request may take over, so a reused key is
+	// still reported as such.
+	res, err = s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET created_at = $1, expires_at = $2, locked_until = $3
+		 WHERE user_id = $4 AND idempotency_key = $5 AND request_hash = $6
+		   AND status IS NULL AND (locked_until IS NULL OR locked_until <= $1)`,
+		now, expires.UTC(), lockedUntil.UTC(), userID, key, requestHash,
+	)
+	if err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		return idempotencyRecord{}, true, nil
+	}
+
+	var record idempotencyRecord
+	var status sql.NullInt64
+	var contentType, body sql.NullString
+	err = s.db.QueryRowContext(ctx,
+		`SELECT request_hash, status, content_type, body FROM idempotency_keys
+		 WHERE user_id = $1 AND idempotency_key = $2`,
+		userID, key,
+	).Scan(&record.RequestHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// Released since the insert lost; report it as in progress so the
+		// client retries.
+		return idempotencyRecord{RequestHash: requestHash}, false, nil
+	}
+	if err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	record.Status = int(status.Int64)
+	record.ContentType = contentType.String
+	record.Body = []byte(body.String)
+	return record, false, nil
+}
+
+func (s *sqlStore) CompleteIdempotencyKey(ctx context.Context, userID string, key string, status int, contentType string, body []byte) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET status = $1, content_type = $2, body = $3, locked_until = NULL
+		 WHERE user_id = $4 AND idempotency_key = $5`,
+		status, contentType, string(body), userID, key,
+	)
+	return err
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(ctx context.Context, userID string, key string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2",
+		userID, key,
+	)
+	return err
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusSucceeded = "succeeded"
+	jobStatusDead      = "dead"
+)
+
+const (
+	defaultJobWorkers     = 2
+	defaultJobMaxAttempts = 5
+	jobPollInterval       = 2 * time.Second
+	jobTimeout            = 5 * time.Minute
+	jobBaseBackoff        = 15 * time.Second
+	jobMaxBackoff         = time.Hour
+)
+
+// Job is a row of the jobs table as shown to admins.
+type Job struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       string          `json:"run_at"`
+	LockedBy    string          `json:"locked_by,omitempty"`
+	LockedUntil string          `json:"locked_until,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	DedupeKey   string          `json:"dedupe_key,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+	FinishedAt  string          `json:"finished_at,omitempty"`
+}
+
+type JobCount struct {
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Count  int    `json:"count"`
+}
+
+// JobOptions tweak how a job is enqueued. The zero value runs the job as
+// soon as possible with the default number of attempts.
+type JobOptions struct {
+	RunAt       time.Time
+	MaxAttempts int
+	// DedupeKey makes enqueueing idempotent: a second job with the same key
+	// is silently dropped.
+	DedupeKey string
+}
+
+type jobHandlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+type cronJob struct {
+	name    string
+	spec    cronSpec
+	kind    string
+	payload interface{}
+}
+
+// jobQueue runs registered handlers for jobs stored in Postgres. Any
+// number of replicas can run one; they coordinate through row locks.
+type jobQueue struct {
+	db       *sql.DB
+	workers  int
+	workerID string
+	handlers map[string]jobHandlerFunc
+	crons    []cronJob
+
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+}
+
+func newJobQueue(db *sql.DB, workers int) *jobQueue {
+	host, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobQueue{
+		db:         db,
+		workers:    workers,
+		workerID:   fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID()[:6]),
+		handlers:   map[string]jobHandlerFunc{},
+		stop:       make(chan struct{}),
+		jobCtx:     ctx,
+		cancelJobs: cancel,
+	}
+}
+
+// registerJob adds a handler whose payload is decoded into T before it is
+// called. Register everything before start.
+func registerJob[T any](q *jobQueue, kind string, fn func(ctx context.Context, payload T) error) {
+	q.handlers[kind] = func(ctx context.Context, raw json.RawMessage) error {
+		var payload T
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return fmt.Errorf("decode %s payload: %w", kind, err)
+		}
+		return fn(ctx, payload)
+	}
+}
+
+// scheduleJob enqueues kind on a five-field cron schedule (evaluated in
+// UTC). Each run is deduplicated by minute, so every replica can run the
+// scheduler safely.
+func (q *jobQueue) scheduleJob(name string, spec string, kind string, payload interface{}) error {
+	parsed, err := parseCron(spec)
+	if err != nil {
+		return fmt.Errorf("schedule %s: %w", name, err)
+	}
+	q.crons = append(q.crons, cronJob{name: name, spec: parsed, kind: kind, payload: payload})
+	return nil
+}
+
+// enqueueJob adds a job. exec may be a transaction, in which case the job
+// only becomes visible if it commits. It returns "" when DedupeKey matched
+// an existing job.
+func enqueueJob(ctx context.Context, exec execer, kind string, payload interface{}, opts JobOptions) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	if opts.RunAt.IsZero() {
+		opts.RunAt = now
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultJobMaxAttempts
+	}
+	id := newID()
+	res, err := exec.ExecContext(ctx,
+		`INSERT INTO jobs (id, kind, payload, max_attempts, run_at, dedupe_key, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		 ON CONFLICT (dedupe_key) DO NOTHING`,
+		id, kind, string(body), opts.MaxAttempts, opts.RunAt.UTC(), nullString(opts.DedupeKey), now,
+	)
+	if err != nil {
+		return "", err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return "", nil
+	}
+	return id, nil
+}
+
+func (q *jobQueue) start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	if len(q.crons) > 0 {
+		q.wg.Add(1)
+		go q.runCron()
+	}
+}
+
+// shutdown stops claiming new jobs and waits for running ones to finish.
+// If ctx expires first, their contexts are cancelled and the jobs are put
+// back in the queue without using up an attempt.
+func (q *jobQueue) shutdown(ctx context.Context) error {
+	close(q.stop)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancelJobs()
+		return nil
+	case <-ctx.Done():
+		q.cancelJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *jobQueue) stopped() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+	for !q.stopped() {
+		job, found, err := q.claim()
+		if err != nil {
+			slog.Error("failed to claim job", "err", err)
+		}
+		if found {
+			q.execute(job)
+			continue
+		}
+		select {
+		case <-q.stop:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+type claimedJob struct {
+	id          string
+	kind        string
+	payload     []byte
+	attempts    int
+	maxAttempts int
+}
+
+// claim takes the next due job. Running jobs whose lease ran out belong to
+// a worker that died and are picked up again.
+func (q *jobQueue) claim() (claimedJob, bool, error) {
+	kinds := make([]string, 0, len(q.handlers))
+	for kind := range q.handlers {
+		kinds = append(kinds, kind)
+	}
+	now := time.Now().UTC()
+	var job claimedJob
+	err := q.db.QueryRow(
+		`UPDATE jobs
+		 SET status = 'running', attempts = attempts + 1, locked_by = $1, locked_until = $2, updated_at = $3
+		 WHERE id = (
+		   SELECT id FROM jobs
+		   WHERE ((status = 'queued' AND run_at <= $3) OR (status = 'running' AND locked_until < $3))
+		     AND kind = ANY($4)
+		   ORDER BY run_at
+		   LIMIT 1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, kind, payload, attempts, max_attempts`,
+		q.workerID, now.Add(jobTimeout+time.Minute), now, kinds,
+	).Scan(&job.id, &job.kind, &job.payload, &job.attempts, &job.maxAttempts)
+	if err == sql.ErrNoRows {
+		return claimedJob{}, false, nil
+	}
+	if err != nil {
+		return claimedJob{}, false, err
+	}
+	return job, true, nil
+}
+
+func (q *jobQueue) execute(job claimedJob) {
+	ctx, cancel := context.WithTimeout(q.jobCtx, jobTimeout)
+	ctx, span := tracer.Start(ctx, "job "+job.kind, trace.WithAttributes(
+		attribute.String("job.id", job.id),
+		attribute.String("job.kind", job.kind),
+		attribute.Int("job.attempt", job.attempts),
+	))
+	err := q.call(ctx, job)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	cancel()
+
+	now := time.Now().UTC()
+	var res sql.Result
+	var dbErr error
+	switch {
+	case err == nil:
+		res, dbErr = q.db.Exec(
+			`UPDATE jobs SET status = 'succeeded', locked_by = NULL, locked_until = NULL, updated_at = $1, finished_at = $1
+			 WHERE id = $2 AND locked_by = $3`,
+			now, job.id, q.workerID,
+		)
+	case q.jobCtx.Err() != nil:
+		// Interrupted by shutdown: hand it back untouched.
+		res, dbErr = q.db.Exec(
+			`UPDATE jobs SET status = 'queued', attempts = attempts - 1, locked_by = NULL, locked_until = NULL, updated_at = $1
+			 WHERE id = $2 AND locked_by = $3`,
+			now, job.id, q.workerID,
+		)
+	case job.attempts >= job.maxAttempts:
+		slog.Error("job failed permanently", "job_id", job.id, "kind", job.kind, "attempts", job.attempts, "err", err)
+		res, dbErr = q.db.Exec(
+			`UPDATE jobs SET status = 'dead', last_error = $1, locked_by = NULL, locked_until = NULL, updated_at = $2, finished_at = $2
+			 WHERE id = $3 AND locked_by = $4`,
+			err.Error(), now, job.id, q.workerID,
+		)
+	default:
+		res, dbErr = q.db.Exec(
+			`UPDATE jobs SET status = 'queued', last_error = $1, run_at = $2, locked_by = NULL, locked_until = NULL, updated_at = $3
+			 WHERE id = $4 AND locked_by = $5`,
+			err.Error(), now.Add(jobBackoff(job.attempts)), now, job.id, q.workerID,
+		)
+	}
+	if dbErr != nil {
+		slog.Error("failed to record job result", "job_id", job.id, "err", dbErr)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		slog.Warn("lost job lease before it finished", "job_id", job.id, "kind", job.kind)
+	}
+}
+
+// call runs the handler, turning a panic into an ordinary failure.
+func (q *jobQueue) call(ctx context.Context, job claimedJob) (err error) {
+	handler, ok := q.handlers[job.kind]
+	if !ok {
+		return fmt.Errorf("no handler registered for %q", job.kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(ctx, job.payload)
+}
+
+func jobBackoff(attempts int) time.Duration {
+	delay := jobMaxBackoff
+	if attempts < 20 {
+		delay = min(jobBaseBackoff<<(attempts-1), jobMaxBackoff)
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+func (q *jobQueue) runCron() {
+	defer q.wg.Done()
+	for {
+		next := time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(time.Until(next)):
+		}
+		for _, cron := range q.crons {
+			if !cron.spec.matches(next) {
+				continue
+			}
+			if _, err := enqueueJob(context.Background(), q.db, cron.kind, cron.payload, JobOptions{
+				RunAt:     next,
+				DedupeKey: "cron:" + cron.name + ":" + next.Format(time.RFC3339),
+			}); err != nil {
+				slog.Error("failed to enqueue scheduled job", "schedule", cron.name, "err", err)
+			}
+		}
+	}
+}
+
+// cronSpec is a parsed five-field cron expression. Each field is a bitset
+// of allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron understands the usual "minute hour day-of-month month
+// day-of-week" syntax with *, lists, ranges and steps, plus @hourly,
+// @daily, @weekly and @monthly. Day of week runs 0-6 from Sunday (7 is
+// also Sunday).
+func parseCron(spec string) (cronSpec, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(spec)]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSpec{}, errors.New("cron spec needs five fields")
+	}
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cronSpec{}, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cronSpec{}, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cronSpec{}, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cronSpec{}, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cronSpec{}, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, lo int, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+			step = n
+		}
+		start, end := lo, hi
+		if rangePart != "*" {
+			a, b, isRange := strings.Cut(rangePart, "-")
+			n, err := strconv.Atoi(a)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+			start, end = n, n
+			if isRange {
+				if end, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", field)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", field, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matches follows cron's rule that when both day fields are restricted a
+// time matches if either does.
+func (c cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowMatch
+	case c.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// registerJobs wires up every job kind the backend knows about and the
+// housekeeping schedules. Push notifications are not jobs: the only ones
+// sent are the test endpoint's and push send's, and both exist to tell the
+// caller straight away whether delivery to the user's devices works.
+func registerJobs(q *jobQueue, store Store, blobs BlobStore, cfg Config) error {
+	db := store.DB()
+	webhooks := newWebhookClient()
+	registerJob(q, jobWebhookDeliver, func(ctx context.Context, job WebhookDeliveryJob) error {
+		return deliverWebhook(ctx, db, webhooks, job)
+	})
+	registerJob(q, jobExportUser, func(ctx context.Context, job ExportJob) error {
+		return writeExport(ctx, store, blobs, job)
+	})
+	registerJob(q, jobExportDelete, func(ctx context.Context, job ExportJob) error {
+		return blobs.Delete(ctx, exportKey(job.UserID, job.ExportID))
+	})
+	registerJob(q, "events.prune", func(ctx context.Context, _ struct{}) error {
+		_, err := db.ExecContext(ctx,
+			"DELETE FROM entry_events WHERE created_at < $1", time.Now().UTC().Add(-eventsRetention))
+		return err
+	})
+	registerJob(q, "jobs.prune", func(ctx context.Context, _ struct{}) error {
+		now := time.Now().UTC()
+		_, err := db.ExecContext(ctx,
+			`DELETE FROM jobs
+			 WHERE (status = 'succeeded' AND finished_at < $1) OR (status = 'dead' AND finished_at < $2)`,
+			now.Add(-7*24*time.Hour), now.Add(-30*24*time.Hour),
+		)
+		return err
+	})
+	registerJob(q, "webhooks.prune", func(ctx context.Context, _ struct{}) error {
+		_, err := db.ExecContext(ctx,
+			"DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1",
+			time.Now().UTC().Add(-30*24*time.Hour),
+		)
+		return err
+	})
+
+	registerJob(q, "backup.create", func(ctx context.Context, _ struct{}) error {
+		_, err := createBackup(ctx, store, blobs, cfg.BackupDir, cfg.BackupRetain)
+		return err
+	})
+
+	for _, s := range []struct{ name, spec, kind string }{
+		{"events-prune", "7 * * * *", "events.prune"},
+		{"jobs-prune", "17 3 * * *", "jobs.prune"},
+		{"webhooks-prune", "27 3 * * *", "webhooks.prune"},
+	} {
+		if err := q.scheduleJob(s.name, s.spec, s.kind, struct{}{}); err != nil {
+			return err
+		}
+	}
+	if cfg.BackupSchedule != "" {
+		return q.scheduleJob("backup", cfg.BackupSchedule, "backup.create", struct{}{})
+	}
+	return nil
+}
+
+// handleListJobs lists jobs, newest first, filtered by ?status= and
+// ?kind= and capped by ?limit=.
+func handleListJobs(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 500 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	jobs, err := listJobs(r.Context(), db, r.URL.Query().Get("status"), r.URL.Query().Get("kind"), limit)
+	if err != nil {
+		writeServerError(w, r, "failed to load jobs", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func handleJobStats(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	counts, err := jobCounts(r.Context(), db)
+	if err != nil {
+		writeServerError(w, r, "failed to load job stats", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	job, found, err := getJob(r.Context(), db, r.PathValue("id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load job", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func handleDeleteJob(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM jobs WHERE id = $1 AND status <> 'running'", r.PathValue("id"))
+	if err != nil {
+		writeServerError(w, r, "failed to delete job", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusConflict, "job not found or still running")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleRetryJob(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// Dead jobs get a fresh set of attempts; queued ones just run now.
+	now := time.Now().UTC()
+	row := db.QueryRowContext(r.Context(),
+		`UPDATE jobs
+		 SET status = 'queued', attempts = CASE WHEN status = 'dead' THEN 0 ELSE attempts END,
+		     run_at = $1, updated_at = $1, finished_at = NULL
+		 WHERE id = $2 AND status IN ('queued', 'dead')
+		 RETURNING `+jobColumns,
+		now, r.PathValue("id"),
+	)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusConflict, "only queued or dead jobs can be retried")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, "failed to retry job", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, locked_by, locked_until, last_error, dedupe_key, created_at, updated_at, finished_at`
+
+func listJobs(ctx context.Context, db *sql.DB, status string, kind string, limit int) ([]Job, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+jobColumns+`
+		 FROM jobs
+		 WHERE ($1 = '' OR status = $1) AND ($2 = '' OR kind = $2)
+		 ORDER BY created_at DESC
+		 LIMIT $3`,
+		status, kind, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func getJob(ctx context.Context, db *sql.DB, id string) (Job, bool, error) {
+	job, err := scanJob(db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func jobCounts(ctx context.Context, db *sql.DB) ([]JobCount, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT kind, status, COUNT(*) FROM jobs GROUP BY kind, status ORDER BY kind, status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []JobCount{}
+	for rows.Next() {
+		var count JobCount
+		if err := rows.Scan(&count.Kind, &count.Status, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var payload []byte
+	var lockedBy, lastError, dedupeKey sql.NullString
+	var runAt, created, updated time.Time
+	var lockedUntil, finished sql.NullTime
+	if err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&runAt,
+		&lockedBy,
+		&lockedUntil,
+		&lastError,
+		&dedupeKey,
+		&created,
+		&updated,
+		&finished,
+	); err != nil {
+		return Job{}, err
+	}
+	job.Payload = payload
+	job.RunAt = runAt.UTC().Format(time.RFC3339)
+	job.LockedBy = lockedBy.String
+	if lockedUntil.Valid {
+		job.LockedUntil = lockedUntil.Time.UTC().Format(time.RFC3339)
+	}
+	job.LastError = lastError.String
+	job.DedupeKey = dedupeKey.String
+	job.CreatedAt = created.UTC().Format(time.RFC3339)
+	job.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	if finished.Valid {
+		job.FinishedAt = finished.Time.UTC().Format(time.RFC3339)
+	}
+	return job, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const requestInfoKey contextKey = "request_info"
+
+// requestInfo travels in the request context as a pointer so handlers
+// deeper in the chain (withAuth) can fill in details the access log needs.
+type requestInfo struct {
+	id     string
+	userID string
+}
+
+// setupLogger installs a JSON slog logger writing to out as the default.
+// The standard log package is routed through it too, so nothing prints
+// unstructured. LOG_LEVEL may be debug, info, warn or error.
+func setupLogger(out io.Writer) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs at error level and exits; the slog counterpart of log.Fatalf.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logger returns the default logger annotated with the request's ID (and
+// user, once authenticated).
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		l = l.With("request_id", info.id)
+		if info.userID != "" {
+			l = l.With("user_id", info.userID)
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return l
+}
+
+func requestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// setRequestUser records the authenticated user for the access log.
+func setRequestUser(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+// writeServerError logs the real cause of a 500 and sends the client only
+// the generic message. An APIError is a problem meant for the client and
+// is sent as it is instead.
+func writeServerError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		writeAPIError(w, r, apiErr)
+		return
+	}
+	logger(r.Context()).Error(message, "err", err, "method", r.Method, "path", r.URL.Path)
+	writeError(w, r, http.StatusInternalServerError, message)
+}
+
+// withRequestLogging assigns every request an ID (reusing a well-formed
+// incoming X-Request-ID), echoes it back, and writes one access log line
+// per request.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newID()
+		}
+		info := &requestInfo{id: id}
+		w.Header().Set(requestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if info.userID != "" {
+			attrs = append(attrs, slog.String("user_id", info.userID))
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// validRequestID accepts short IDs made of characters that are safe to
+// echo into headers and logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder captures the status and size of a response. Unwrap lets
+// http.ResponseController reach the underlying writer for flushing and
+// deadlines.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -6,25 +6,32 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"sort"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode"
 
 	"github.com/SherClockHolmes/webpush-go"
 	"github.com/golang-jwt/jwt/v5"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	defaultPort      = "8080"
-	jwtIssuerDefault = "coffee-log"
+	defaultPort       = "8080"
+	jwtIssuerDefault  = "coffee-log"
+	defaultUploadsDir = "./uploads"
+	defaultS3Region   = "us-east-1"
 )
 
 type Config struct {
@@ -35,6 +42,45 @@ type Config struct {
 	VapidPublicKey string
 	VapidPrivate   string
 	VapidSubject   string
+	UploadsDir     string
+	PhotoMaxBytes  int64
+	BlobBackend    string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	// PublicURL is the externally visible origin (e.g. https://coffee.example.com),
+	// used for absolute links in share pages. Without it those links are
+	// root-relative.
+	PublicURL  string
+	JobWorkers int
+	// HTTP server timeouts. ShutdownDrain is how long the server keeps
+	// serving after SIGTERM while readiness fails; ShutdownTimeout bounds
+	// the wait for in-flight requests and jobs after that.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownDrain     time.Duration
+	ShutdownTimeout   time.Duration
+	// IdempotencyWindow is how long the response to a request sent with
+	// an Idempotency-Key is kept for replay; zero ignores the header.
+	IdempotencyWindow time.Duration
+	// MetricsAddr serves /metrics on its own listener (e.g. ":9090").
+	// Without it, /metrics is only served on the main port when
+	// MetricsToken is set, and then requires it as a bearer token.
+	MetricsAddr  string
+	MetricsToken string
+	// FrontendDir serves a built frontend (dist/) from disk, overriding one
+	// embedded with the embedfrontend build tag.
+	FrontendDir string
+	// BackupDir receives the backup archives, BackupSchedule (cron syntax,
+	// empty when disabled) says when to take them and BackupRetain how many
+	// to keep.
+	BackupDir      string
+	BackupSchedule string
+	BackupRetain   int
 }
 
 type User struct {
@@ -63,6 +109,18 @@ type Entry struct {
 	BrewedAt   string `json:"brewed_at"`
 	CreatedAt  string `json:"created_at"`
 	UpdatedAt  string `json:"updated_at"`
+	// RecipeID and RecipeVersion are set when the entry was brewed from a recipe.
+	RecipeID      string `json:"recipe_id,omitempty"`
+	RecipeVersion int    `json:"recipe_version,omitempty"`
+	GrinderID     string `json:"grinder_id,omitempty"`
+	BrewerID      string `json:"brewer_id,omitempty"`
+	// BeanID points at a bag on one of the user's shared shelves.
+	BeanID string `json:"bean_id,omitempty"`
+	// Descriptors are flavor wheel ids; Tags are the user's own labels.
+	Descriptors []string `json:"descriptors"`
+	Tags        []string `json:"tags"`
+	// Cupping is present when the entry was scored on the SCA cupping form.
+	Cupping *CuppingScore `json:"cupping,omitempty"`
 }
 
 type EntryInput struct {
@@ -72,6 +130,21 @@ type EntryInput struct {
 	Notes      string `json:"notes"`
 	Rating     int    `json:"rating"`
 	BrewedAt   string `json:"brewed_at"`
+	GrinderID  string `json:"grinder_id,omitempty"`
+	BrewerID   string `json:"brewer_id,omitempty"`
+	BeanID     string `json:"bean_id,omitempty"`
+	// Descriptors and Tags replace the entry's current set when present;
+	// omitting them keeps whatever the entry already has.
+	Descriptors []string `json:"descriptors,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Cupping is the entry's cupping score; like the other fields it is
+	// replaced outright, so leaving it out removes the score. Its total is
+	// recalculated from the attributes.
+	Cupping *CuppingScore `json:"cupping,omitempty"`
+	// recipeID and recipeVersion are filled in by the brew endpoint only;
+	// clients cannot set them directly.
+	recipeID      string
+	recipeVersion int
 }
 
 type PushKeys struct {
@@ -101,217 +174,195 @@ type contextKey string
 const userIDKey contextKey = "user_id"
 
 func main() {
-	cfg := loadConfig()
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "serve" {
+		setupLogger(os.Stdout)
+		serve(loadConfig())
+		return
+	}
+	// Commands keep stdout for their own output.
+	setupLogger(os.Stderr)
+	if err := runCommand(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
 
-	db, err := sql.Open("pgx", cfg.DatabaseURL)
+// serve runs the API server until SIGINT or SIGTERM.
+func serve(cfg Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+		fatal("failed to set up tracing", "err", err)
 	}
+
+	store, err := openStore(cfg.DatabaseURL)
+	if err != nil {
+		fatal("failed to connect to database", "err", err)
+	}
+	db := store.DB()
 	defer db.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 	if err := db.PingContext(ctx); err != nil {
-		log.Fatalf("failed to reach database: %v", err)
+		fatal("failed to reach database", "err", err)
 	}
 
-	if err := applyMigrations(db, "./migrations"); err != nil {
-		log.Fatalf("failed to apply migrations: %v", err)
+	migrations := migrationsFor(store.Dialect())
+	if err := applyMigrations(context.Background(), db, store.Dialect(), migrations); err != nil {
+		fatal("failed to apply migrations", "err", err)
 	}
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/api/auth/register", withCors(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
+	blobs, err := newBlobStore(cfg)
+	if err != nil {
+		fatal("failed to set up blob storage", "err", err)
+	}
 
-		var req AuthRequest
-		if err := readJSON(w, r, &req); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			return
-		}
+	// workers is cancelled during shutdown to stop the background loops.
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	var background sync.WaitGroup
+	health := &healthState{}
 
-		user, token, err := registerUser(r.Context(), db, cfg, req)
-		if err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			return
-		}
+	mux := http.NewServeMux()
 
-		writeJSON(w, http.StatusCreated, AuthResponse{Token: token, User: user})
-	}))
+	mux.HandleFunc("/healthz", handleLiveness)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadiness(w, r, db, health, migrations)
+	})
+	if cfg.MetricsAddr == "" && cfg.MetricsToken != "" {
+		mux.HandleFunc("/metrics", withMetricsToken(cfg, func(w http.ResponseWriter, r *http.Request) {
+			handleMetrics(w, r, store)
+		}))
+	}
 
-	mux.HandleFunc("/api/auth/login", withCors(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
+	// Entry events, webhook deliveries and jobs live in Postgres; the
+	// SQLite store neither records nor consumes them.
+	postgres := store.Dialect() == dialectPostgres
+
+	hub := newEventHub(db)
+	if postgres {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			hub.run(workers)
+		}()
+	}
 
-		var req AuthRequest
-		if err := readJSON(w, r, &req); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			return
-		}
+	api := newAPIRouter()
+	registerAPIRoutes(api, cfg, store, blobs, hub)
+	mux.Handle("/api/", api)
 
-		user, token, err := loginUser(r.Context(), db, cfg, req)
+	assets, err := frontendAssets(cfg.FrontendDir)
+	if err != nil {
+		fatal("failed to load frontend assets", "err", err)
+	}
+	if assets != nil {
+		frontend, err := newFrontendHandler(assets)
 		if err != nil {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
-			return
-		}
-
-		writeJSON(w, http.StatusOK, AuthResponse{Token: token, User: user})
-	}))
-
-	mux.HandleFunc("/api/entries", withCors(withAuth(cfg, func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Context().Value(userIDKey).(string)
-
-		switch r.Method {
-		case http.MethodGet:
-			entries, err := listEntries(r.Context(), db, userID)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load entries"})
-				return
-			}
-			writeJSON(w, http.StatusOK, entries)
-		case http.MethodPost:
-			var input EntryInput
-			if err := readJSON(w, r, &input); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-				return
-			}
-			if err := validateEntry(input); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-				return
-			}
-			entry, err := upsertEntry(r.Context(), db, userID, input)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save entry"})
-				return
-			}
-			writeJSON(w, http.StatusCreated, entry)
-		default:
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-		}
-	})))
-
-	mux.HandleFunc("/api/entries/", withCors(withAuth(cfg, func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Context().Value(userIDKey).(string)
-		id := strings.TrimPrefix(r.URL.Path, "/api/entries/")
-		if id == "" {
-			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
-			return
+			fatal("failed to load frontend assets", "err", err)
 		}
+		mux.Handle("/", frontend)
+	}
 
-		switch r.Method {
-		case http.MethodPut:
-			var input EntryInput
-			if err := readJSON(w, r, &input); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-				return
-			}
-			if err := validateEntry(input); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-				return
-			}
-			entry, found, err := updateEntry(r.Context(), db, userID, id, input)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update entry"})
-				return
-			}
-			if !found {
-				writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
-				return
-			}
-			writeJSON(w, http.StatusOK, entry)
-		case http.MethodDelete:
-			found, err := deleteEntry(r.Context(), db, userID, id)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete entry"})
-				return
-			}
-			if !found {
-				writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
-				return
-			}
-			writeJSON(w, http.StatusNoContent, nil)
-		default:
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-		}
-	})))
-
-	mux.HandleFunc("/api/push/config", withCors(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
-		if cfg.VapidPublicKey == "" {
-			writeJSON(w, http.StatusOK, PushConfig{})
-			return
-		}
-		writeJSON(w, http.StatusOK, PushConfig{PublicKey: cfg.VapidPublicKey, Subject: cfg.VapidSubject})
-	}))
-
-	mux.HandleFunc("/api/push/subscribe", withCors(withAuth(cfg, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
-		userID := r.Context().Value(userIDKey).(string)
-
-		var sub PushSubscription
-		if err := readJSON(w, r, &sub); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			return
-		}
-		if err := upsertSubscription(r.Context(), db, userID, sub); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save subscription"})
-			return
+	jobs := newJobQueue(db, cfg.JobWorkers)
+	if postgres {
+		if err := registerJobs(jobs, store, blobs, cfg); err != nil {
+			fatal("failed to register jobs", "err", err)
 		}
-		writeJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
-	})))
+		jobs.start()
+	} else if cfg.BackupSchedule != "" {
+		spec, _ := parseCron(cfg.BackupSchedule)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runBackupSchedule(workers, spec, func(ctx context.Context) error {
+				_, err := createBackup(ctx, store, blobs, cfg.BackupDir, cfg.BackupRetain)
+				return err
+			})
+		}()
+	}
 
-	mux.HandleFunc("/api/push/unsubscribe", withCors(withAuth(cfg, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
-		userID := r.Context().Value(userIDKey).(string)
-		var body struct {
-			Endpoint string `json:"endpoint"`
-		}
-		if err := readJSON(w, r, &body); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			return
-		}
-		if body.Endpoint == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "endpoint is required"})
-			return
-		}
-		if err := deleteSubscription(r.Context(), db, userID, body.Endpoint); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete subscription"})
-			return
-		}
-		writeJSON(w, http.StatusNoContent, nil)
-	})))
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           withTracing(withRequestLogging(withMetrics(withSpanRoute(mux)))),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	// Event streams never go idle on their own, so end them explicitly or
+	// Shutdown would wait out its whole timeout.
+	server.RegisterOnShutdown(hub.dropAll)
+
+	serverErr := make(chan error, 2)
+	go func() {
+		slog.Info("backend running", "port", cfg.Port)
+		serverErr <- server.ListenAndServe()
+	}()
+	metricsServer := newMetricsServer(cfg, store)
+	if metricsServer != nil {
+		go func() {
+			slog.Info("metrics listening", "addr", cfg.MetricsAddr)
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
 
-	mux.HandleFunc("/api/push/test", withCors(withAuth(cfg, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
-			return
-		}
-		userID := r.Context().Value(userIDKey).(string)
-		if err := sendTestPush(r.Context(), db, cfg, userID); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-			return
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		fatal("http server failed", "err", err)
+	case <-signals.Done():
+	}
+	// A second signal kills the process straight away.
+	stopSignals()
+
+	// Keep serving while readiness reports draining, giving the proxy time
+	// to notice before the listener goes away.
+	slog.Info("shutting down", "drain", cfg.ShutdownDrain.String())
+	health.draining.Store(true)
+	time.Sleep(cfg.ShutdownDrain)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http server did not shut down cleanly", "err", err)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("metrics server did not shut down cleanly", "err", err)
 		}
-		writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
-	})))
+	}
+	stopWorkers()
+	if err := jobs.shutdown(shutdownCtx); err != nil {
+		slog.Error("jobs did not finish before the shutdown timeout", "err", err)
+	}
+	background.Wait()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
 
-	log.Printf("Backend running on :%s", cfg.Port)
-	if err := http.ListenAndServe(":"+cfg.Port, mux); err != nil {
-		log.Fatal(err)
+// openDatabase opens the Postgres pool with query tracing attached.
+func openDatabase(databaseURL string) (*sql.DB, error) {
+	connConfig, err := pgx.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, err
 	}
+	connConfig.Tracer = queryTracer{}
+	return stdlib.OpenDB(*connConfig), nil
+}
+
+// isUniqueViolation reports whether err is Postgres refusing a duplicate
+// key (SQLSTATE 23505).
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
 }
 
 func loadConfig() Config {
@@ -323,13 +374,26 @@ func loadConfig() Config {
 		VapidPublicKey: strings.TrimSpace(os.Getenv("VAPID_PUBLIC_KEY")),
 		VapidPrivate:   strings.TrimSpace(os.Getenv("VAPID_PRIVATE_KEY")),
 		VapidSubject:   strings.TrimSpace(os.Getenv("VAPID_SUBJECT")),
+		UploadsDir:     strings.TrimSpace(os.Getenv("UPLOADS_DIR")),
+		BlobBackend:    strings.TrimSpace(os.Getenv("BLOB_STORAGE")),
+		S3Endpoint:     strings.TrimSpace(os.Getenv("S3_ENDPOINT")),
+		S3Region:       strings.TrimSpace(os.Getenv("S3_REGION")),
+		S3Bucket:       strings.TrimSpace(os.Getenv("S3_BUCKET")),
+		S3AccessKey:    strings.TrimSpace(os.Getenv("S3_ACCESS_KEY")),
+		S3SecretKey:    strings.TrimSpace(os.Getenv("S3_SECRET_KEY")),
+		PublicURL:      strings.TrimRight(strings.TrimSpace(os.Getenv("PUBLIC_URL")), "/"),
+		MetricsAddr:    strings.TrimSpace(os.Getenv("METRICS_ADDR")),
+		MetricsToken:   strings.TrimSpace(os.Getenv("METRICS_TOKEN")),
+		FrontendDir:    strings.TrimSpace(os.Getenv("FRONTEND_DIR")),
+		BackupDir:      strings.TrimSpace(os.Getenv("BACKUP_DIR")),
+		BackupSchedule: strings.TrimSpace(os.Getenv("BACKUP_SCHEDULE")),
 	}
 
 	if cfg.DatabaseURL == "" {
-		log.Fatal("DATABASE_URL is required")
+		fatal("DATABASE_URL is required")
 	}
 	if cfg.JWTSecret == "" {
-		log.Fatal("JWT_SECRET is required")
+		fatal("JWT_SECRET is required")
 	}
 	if cfg.JWTIssuer == "" {
 		cfg.JWTIssuer = jwtIssuerDefault
@@ -337,83 +401,173 @@ func loadConfig() Config {
 	if cfg.Port == "" {
 		cfg.Port = defaultPort
 	}
+	if cfg.UploadsDir == "" {
+		cfg.UploadsDir = defaultUploadsDir
+	}
+	if cfg.S3Region == "" {
+		cfg.S3Region = defaultS3Region
+	}
+	cfg.JobWorkers = defaultJobWorkers
+	if raw := strings.TrimSpace(os.Getenv("JOB_WORKERS")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			fatal("JOB_WORKERS must be a non-negative integer")
+		}
+		cfg.JobWorkers = n
+	}
+	cfg.ReadTimeout = durationFromEnv("HTTP_READ_TIMEOUT", 60*time.Second)
+	cfg.ReadHeaderTimeout = durationFromEnv("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	cfg.WriteTimeout = durationFromEnv("HTTP_WRITE_TIMEOUT", 60*time.Second)
+	cfg.IdleTimeout = durationFromEnv("HTTP_IDLE_TIMEOUT", 120*time.Second)
+	cfg.ShutdownDrain = durationFromEnv("SHUTDOWN_DRAIN", 5*time.Second)
+	cfg.ShutdownTimeout = durationFromEnv("SHUTDOWN_TIMEOUT", 25*time.Second)
+	cfg.IdempotencyWindow = durationFromEnv("IDEMPOTENCY_WINDOW", 24*time.Hour)
+	if cfg.BackupDir == "" {
+		cfg.BackupDir = defaultBackupDir
+	}
+	switch cfg.BackupSchedule {
+	case "":
+		cfg.BackupSchedule = defaultBackupSchedule
+	case "off":
+		cfg.BackupSchedule = ""
+	}
+	if cfg.BackupSchedule != "" {
+		if _, err := parseCron(cfg.BackupSchedule); err != nil {
+			fatal("BACKUP_SCHEDULE must be a cron expression or off", "err", err)
+		}
+	}
+	cfg.BackupRetain = defaultBackupRetain
+	if raw := strings.TrimSpace(os.Getenv("BACKUP_RETAIN")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			fatal("BACKUP_RETAIN must be a positive integer")
+		}
+		cfg.BackupRetain = n
+	}
+	cfg.PhotoMaxBytes = defaultPhotoMaxBytes
+	if raw := strings.TrimSpace(os.Getenv("PHOTO_MAX_BYTES")); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			fatal("PHOTO_MAX_BYTES must be a positive integer")
+		}
+		cfg.PhotoMaxBytes = n
+	}
 	return cfg
 }
 
-func registerUser(ctx context.Context, db *sql.DB, cfg Config, req AuthRequest) (User, string, error) {
-	email := strings.ToLower(strings.TrimSpace(req.Email))
-	if !strings.Contains(email, "@") {
-		return User{}, "", errors.New("valid email is required")
+// durationFromEnv parses a Go duration such as "30s", falling back to def
+// when the variable is unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
 	}
-	if len(req.Password) < 8 {
-		return User{}, "", errors.New("password must be at least 8 characters")
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		fatal(name + " must be a duration such as 30s")
 	}
+	return d
+}
 
-	var exists string
-	if err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = $1", email).Scan(&exists); err == nil {
-		return User{}, "", errors.New("email already registered")
-	} else if err != sql.ErrNoRows {
-		return User{}, "", errors.New("failed to check email")
+func registerUser(ctx context.Context, store Store, cfg Config, req AuthRequest) (User, string, error) {
+	user, err := createUser(ctx, store, req.Email, req.Password)
+	if err != nil {
+		return User{}, "", err
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	token, err := issueToken(cfg, user)
 	if err != nil {
-		return User{}, "", errors.New("failed to hash password")
+		return User{}, "", err
+	}
+
+	return user, token, nil
+}
+
+// createUser validates and stores a new account. Problems with the input
+// are APIErrors.
+func createUser(ctx context.Context, store Store, email string, password string) (User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	fields := fieldErrors{}
+	if !strings.Contains(email, "@") {
+		fields.add("email", "valid email is required")
+	}
+	fields.merge(validatePassword(password))
+	if err := fields.err(); err != nil {
+		return User{}, err
 	}
 
-	now := time.Now().UTC()
-	user := User{
-		ID:        newID(),
-		Email:     email,
-		CreatedAt: now.Format(time.RFC3339),
-		UpdatedAt: now.Format(time.RFC3339),
+	if _, found, err := store.UserByEmail(ctx, email); err != nil {
+		return User{}, fmt.Errorf("check email: %w", err)
+	} else if found {
+		return User{}, newAPIError(http.StatusConflict, codeEmailTaken, "email already registered")
 	}
 
-	_, err = db.ExecContext(ctx,
-		`INSERT INTO users (id, email, password_hash, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5)`,
-		user.ID, user.Email, string(hash), now, now)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return User{}, "", errors.New("failed to create user")
+		return User{}, fmt.Errorf("hash password: %w", err)
 	}
 
-	token, err := issueToken(cfg, user)
+	user, err := store.CreateUser(ctx, email, string(hash))
 	if err != nil {
-		return User{}, "", err
+		return User{}, fmt.Errorf("create user: %w", err)
 	}
+	return user, nil
+}
 
-	return user, token, nil
+func validatePassword(password string) error {
+	if len(password) < 8 {
+		return fieldError("password", "password must be at least 8 characters")
+	}
+	return nil
 }
 
-func loginUser(ctx context.Context, db *sql.DB, cfg Config, req AuthRequest) (User, string, error) {
+func setUserPassword(ctx context.Context, store Store, userID string, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return store.SetUserPassword(ctx, userID, string(hash))
+}
+
+// errInvalidCredentials does not say which of the two was wrong.
+var errInvalidCredentials = newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "invalid email or password")
+
+func loginUser(ctx context.Context, store Store, cfg Config, req AuthRequest) (User, string, error) {
 	email := strings.ToLower(strings.TrimSpace(req.Email))
-	if email == "" || req.Password == "" {
-		return User{}, "", errors.New("email and password are required")
+	fields := fieldErrors{}
+	if email == "" {
+		fields.add("email", "email is required")
+	}
+	if req.Password == "" {
+		fields.add("password", "password is required")
+	}
+	if err := fields.err(); err != nil {
+		return User{}, "", err
 	}
 
-	var user User
-	var hash string
-	var created time.Time
-	var updated time.Time
-	row := db.QueryRowContext(ctx,
-		"SELECT id, email, password_hash, created_at, updated_at FROM users WHERE email = $1",
-		email,
-	)
-	if err := row.Scan(&user.ID, &user.Email, &hash, &created, &updated); err != nil {
-		return User{}, "", errors.New("invalid email or password")
+	record, found, err := store.UserByEmail(ctx, email)
+	if err != nil {
+		return User{}, "", fmt.Errorf("look up user: %w", err)
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-		return User{}, "", errors.New("invalid email or password")
+	if !found {
+		return User{}, "", errInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(record.passwordHash), []byte(req.Password)); err != nil {
+		return User{}, "", errInvalidCredentials
+	}
+	if record.disabled {
+		return User{}, "", newAPIError(http.StatusUnauthorized, codeAccountDisabled, "account is disabled")
 	}
-	user.CreatedAt = created.UTC().Format(time.RFC3339)
-	user.UpdatedAt = updated.UTC().Format(time.RFC3339)
 
-	token, err := issueToken(cfg, user)
+	token, err := issueToken(cfg, record.User)
 	if err != nil {
 		return User{}, "", err
 	}
 
-	return user, token, nil
+	return record.User, token, nil
 }
 
 func issueToken(cfg Config, user User) (string, error) {
@@ -428,12 +582,44 @@ func issueToken(cfg Config, user User) (string, error) {
 	return jwtToken.SignedString([]byte(cfg.JWTSecret))
 }
 
-func withAuth(cfg Config, next http.HandlerFunc) http.HandlerFunc {
+func handleRegister(w http.ResponseWriter, r *http.Request, store Store, cfg Config) {
+	var req AuthRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+
+	user, token, err := registerUser(r.Context(), store, cfg, req)
+	if err != nil {
+		writeServerError(w, r, "failed to register", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, AuthResponse{Token: token, User: user})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request, store Store, cfg Config) {
+	var req AuthRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+
+	user, token, err := loginUser(r.Context(), store, cfg, req)
+	if err != nil {
+		writeServerError(w, r, "failed to sign in", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AuthResponse{Token: token, User: user})
+}
+
+func withAuth(cfg Config, store Store, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authorization := r.Header.Get("Authorization")
 		parts := strings.SplitN(authorization, " ", 2)
 		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing bearer token"})
+			writeError(w, r, http.StatusUnauthorized, "missing bearer token")
 			return
 		}
 
@@ -444,34 +630,233 @@ func withAuth(cfg Config, next http.HandlerFunc) http.HandlerFunc {
 			return []byte(cfg.JWTSecret), nil
 		})
 		if err != nil || !token.Valid {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			writeError(w, r, http.StatusUnauthorized, "invalid token")
 			return
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			writeError(w, r, http.StatusUnauthorized, "invalid token")
 			return
 		}
 
 		sub, ok := claims["sub"].(string)
 		if !ok || sub == "" {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			writeError(w, r, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		active, err := store.UserActive(r.Context(), sub)
+		if err != nil {
+			writeServerError(w, r, "failed to check account", err)
+			return
+		}
+		if !active {
+			writeError(w, r, http.StatusUnauthorized, "invalid token")
 			return
 		}
 
+		setRequestUser(r.Context(), sub)
 		ctx := context.WithValue(r.Context(), userIDKey, sub)
 		next(w, r.WithContext(ctx))
 	}
 }
 
-func listEntries(ctx context.Context, db *sql.DB, userID string) ([]Entry, error) {
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// entryColumns is the column list shared by every query that returns
+// entries; keep it in sync with scanEntry. Columns are qualified so it can
+// be used in queries that join other tables.
+const entryColumns = `entries.id, entries.beans, entries.brew_method, entries.notes, entries.rating, entries.brewed_at, ` +
+	`entries.created_at, entries.updated_at, entries.recipe_id, entries.recipe_version, entries.grinder_id, entries.brewer_id, ` +
+	`entries.bean_id, entries.cupping, ` +
+	entryDescriptorsColumn + `, ` + entryTagsColumn
+
+// entryDescriptorsColumn and entryTagsColumn aggregate an entry's join rows
+// into JSON arrays; they expect the entries table to be unaliased.
+const entryDescriptorsColumn = `(SELECT COALESCE(json_agg(d.descriptor_id ORDER BY d.descriptor_id), '[]')
+	 FROM entry_descriptors d
+	 WHERE d.user_id = entries.user_id AND d.entry_id = entries.id)`
+
+const entryTagsColumn = `(SELECT COALESCE(json_agg(t.name ORDER BY lower(t.name)), '[]')
+	 FROM entry_tags et
+	 JOIN tags t ON t.user_id = et.user_id AND t.id = et.tag_id
+	 WHERE et.user_id = entries.user_id AND et.entry_id = entries.id)`
+
+func handleListEntries(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	entries, err := store.ListEntries(r.Context(), userID, entryFilterFromQuery(r))
+	if err != nil {
+		writeServerError(w, r, "failed to load entries", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func handleCreateEntry(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	var input EntryInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateEntry(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := store.ValidateEntryRefs(r.Context(), userID, input); err != nil {
+		writeServerError(w, r, "failed to check entry references", err)
+		return
+	}
+	entry, err := store.UpsertEntry(r.Context(), userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save entry", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+func handleUpdateEntry(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	id := r.PathValue("id")
+	var input EntryInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateEntry(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := store.ValidateEntryRefs(r.Context(), userID, input); err != nil {
+		writeServerError(w, r, "failed to check entry references", err)
+		return
+	}
+	entry, found, err := store.UpdateEntry(r.Context(), userID, id, input)
+	if err != nil {
+		writeServerError(w, r, "failed to update entry", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "entry not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// handleDeleteEntry removes the entry and then its photos' blobs, which
+// only the Postgres store has.
+func handleDeleteEntry(w http.ResponseWriter, r *http.Request, store Store, blobs BlobStore, userID string) {
+	id := r.PathValue("id")
+	var photoKeys []string
+	if store.Dialect() == dialectPostgres {
+		var err error
+		photoKeys, err = entryPhotoKeys(r.Context(), store.DB(), userID, id)
+		if err != nil {
+			writeServerError(w, r, "failed to delete entry", err)
+			return
+		}
+	}
+	found, err := store.DeleteEntry(r.Context(), userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to delete entry", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "entry not found")
+		return
+	}
+	removeBlobs(r.Context(), blobs, photoKeys)
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func scanEntry(row rowScanner) (Entry, error) {
+	var entry Entry
+	var brewed time.Time
+	var created time.Time
+	var updated time.Time
+	var recipeID sql.NullString
+	var recipeVersion sql.NullInt64
+	var grinderID sql.NullString
+	var brewerID sql.NullString
+	var beanID sql.NullString
+	var cupping []byte
+	var descriptors []byte
+	var tags []byte
+	if err := row.Scan(
+		&entry.ID,
+		&entry.Beans,
+		&entry.BrewMethod,
+		&entry.Notes,
+		&entry.Rating,
+		&brewed,
+		&created,
+		&updated,
+		&recipeID,
+		&recipeVersion,
+		&grinderID,
+		&brewerID,
+		&beanID,
+		&cupping,
+		&descriptors,
+		&tags,
+	); err != nil {
+		return Entry{}, err
+	}
+	entry.BrewedAt = brewed.UTC().Format(time.RFC3339)
+	entry.CreatedAt = created.UTC().Format(time.RFC3339)
+	entry.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	if recipeID.Valid {
+		entry.RecipeID = recipeID.String
+		entry.RecipeVersion = int(recipeVersion.Int64)
+	}
+	entry.GrinderID = grinderID.String
+	entry.BrewerID = brewerID.String
+	entry.BeanID = beanID.String
+	if cupping != nil {
+		if err := json.Unmarshal(cupping, &entry.Cupping); err != nil {
+			return Entry{}, err
+		}
+	}
+	if err := json.Unmarshal(descriptors, &entry.Descriptors); err != nil {
+		return Entry{}, err
+	}
+	if err := json.Unmarshal(tags, &entry.Tags); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+func listEntries(ctx context.Context, db *sql.DB, userID string, filter EntryFilter) ([]Entry, error) {
+	return queryEntries(ctx, db, entryColumns, userID, filter)
+}
+
+// queryEntries lists a user's entries newest first, selecting columns
+// (entryColumns or its SQLite counterpart). The filters are portable SQL.
+func queryEntries(ctx context.Context, db *sql.DB, columns string, userID string, filter EntryFilter) ([]Entry, error) {
+	where := "user_id = $1"
+	args := []interface{}{userID}
+	for _, tag := range filter.Tags {
+		args = append(args, tag)
+		where += fmt.Sprintf(` AND EXISTS (
+			SELECT 1 FROM entry_tags et
+			JOIN tags t ON t.user_id = et.user_id AND t.id = et.tag_id
+			WHERE et.user_id = entries.user_id AND et.entry_id = entries.id AND lower(t.name) = lower($%d))`, len(args))
+	}
+	for _, descriptor := range filter.Descriptors {
+		args = append(args, descriptor)
+		where += fmt.Sprintf(` AND EXISTS (
+			SELECT 1 FROM entry_descriptors d
+			WHERE d.user_id = entries.user_id AND d.entry_id = entries.id
+			  AND (d.descriptor_id = $%[1]d OR d.descriptor_id LIKE $%[1]d || '.%%'))`, len(args))
+	}
+
 	rows, err := db.QueryContext(ctx,
-		`SELECT id, beans, brew_method, notes, rating, brewed_at, created_at, updated_at
+		`SELECT `+columns+`
 		 FROM entries
-		 WHERE user_id = $1
+		 WHERE `+where+`
 		 ORDER BY brewed_at DESC`,
-		userID,
+		args...,
 	)
 	if err != nil {
 		return nil, err
@@ -480,30 +865,28 @@ func listEntries(ctx context.Context, db *sql.DB, userID string) ([]Entry, error
 
 	entries := []Entry{}
 	for rows.Next() {
-		var entry Entry
-		var brewed time.Time
-		var created time.Time
-		var updated time.Time
-		if err := rows.Scan(
-			&entry.ID,
-			&entry.Beans,
-			&entry.BrewMethod,
-			&entry.Notes,
-			&entry.Rating,
-			&brewed,
-			&created,
-			&updated,
-		); err != nil {
+		entry, err := scanEntry(rows)
+		if err != nil {
 			return nil, err
 		}
-		entry.BrewedAt = brewed.UTC().Format(time.RFC3339)
-		entry.CreatedAt = created.UTC().Format(time.RFC3339)
-		entry.UpdatedAt = updated.UTC().Format(time.RFC3339)
 		entries = append(entries, entry)
 	}
 	return entries, rows.Err()
 }
 
+func getEntry(ctx context.Context, q querier, userID string, id string) (Entry, bool, error) {
+	row := q.QueryRowContext(ctx,
+		`SELECT `+entryColumns+` FROM entries WHERE user_id = $1 AND id = $2`, userID, id)
+	entry, err := scanEntry(row)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
 func upsertEntry(ctx context.Context, db *sql.DB, userID string, input EntryInput) (Entry, error) {
 	id, err := normalizeID(input.ID)
 	if err != nil {
@@ -516,35 +899,67 @@ func upsertEntry(ctx context.Context, db *sql.DB, userID string, input EntryInpu
 	brewed, _ := time.Parse(time.RFC3339, input.BrewedAt)
 	updated := time.Now().UTC()
 
-	row := db.QueryRowContext(ctx,
-		`INSERT INTO entries (id, user_id, beans, brew_method, notes, rating, brewed_at, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	var recipeID sql.NullString
+	var recipeVersion sql.NullInt64
+	if input.recipeID != "" {
+		recipeID = sql.NullString{String: input.recipeID, Valid: true}
+		recipeVersion = sql.NullInt64{Int64: int64(input.recipeVersion), Valid: true}
+	}
+
+	cupping, cuppingTotal, err := cuppingColumns(input.Cupping)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer tx.Rollback()
+
+	brewMethod, err := entryBrewMethod(ctx, tx, userID, input.BrewMethod)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	// xmax is zero only for freshly inserted rows, which tells a create
+	// apart from an overwrite for the webhook event.
+	var inserted bool
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO entries (id, user_id, beans, brew_method, notes, rating, brewed_at, created_at, updated_at, recipe_id, recipe_version, grinder_id, brewer_id, bean_id, cupping, cupping_total)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		 ON CONFLICT (user_id, id)
-		 DO UPDATE SET beans = $3, brew_method = $4, notes = $5, rating = $6, brewed_at = $7, updated_at = $9
-		 RETURNING id, beans, brew_method, notes, rating, brewed_at, created_at, updated_at`,
-		id, userID, input.Beans, input.BrewMethod, input.Notes, input.Rating, brewed, updated, updated,
-	)
+		 DO UPDATE SET beans = $3, brew_method = $4, notes = $5, rating = $6, brewed_at = $7, updated_at = $9,
+		   grinder_id = $12, brewer_id = $13, bean_id = $14,
+		   cupping = $15, cupping_total = $16
+		 RETURNING (xmax = 0)`,
+		id, userID, input.Beans, brewMethod, input.Notes, input.Rating, brewed, updated, updated,
+		recipeID, recipeVersion, nullString(input.GrinderID), nullString(input.BrewerID), nullString(input.BeanID), cupping, cuppingTotal,
+	).Scan(&inserted)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := setEntryTags(ctx, tx, userID, id, input.Tags); err != nil {
+		return Entry{}, err
+	}
+	if err := setEntryDescriptors(ctx, tx, userID, id, input.Descriptors); err != nil {
+		return Entry{}, err
+	}
 
-	var entry Entry
-	var brewedAt time.Time
-	var createdAt time.Time
-	var updatedAt time.Time
-	if err := row.Scan(
-		&entry.ID,
-		&entry.Beans,
-		&entry.BrewMethod,
-		&entry.Notes,
-		&entry.Rating,
-		&brewedAt,
-		&createdAt,
-		&updatedAt,
-	); err != nil {
+	row := tx.QueryRowContext(ctx,
+		`SELECT `+entryColumns+` FROM entries WHERE user_id = $1 AND id = $2`, userID, id)
+	entry, err := scanEntry(row)
+	if err != nil {
 		return Entry{}, err
 	}
-	entry.BrewedAt = brewedAt.UTC().Format(time.RFC3339)
-	entry.CreatedAt = createdAt.UTC().Format(time.RFC3339)
-	entry.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
-	return entry, nil
+	event := eventEntryUpdated
+	if inserted {
+		event = eventEntryCreated
+	}
+	if err := emitEntryEvent(ctx, tx, userID, event, entry); err != nil {
+		return Entry{}, err
+	}
+	return entry, tx.Commit()
 }
 
 func updateEntry(ctx context.Context, db *sql.DB, userID string, id string, input EntryInput) (Entry, bool, error) {
@@ -554,12 +969,30 @@ func updateEntry(ctx context.Context, db *sql.DB, userID string, id string, inpu
 	}
 	brewed, _ := time.Parse(time.RFC3339, input.BrewedAt)
 	updated := time.Now().UTC()
+	cupping, cuppingTotal, err := cuppingColumns(input.Cupping)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer tx.Rollback()
+
+	brewMethod, err := entryBrewMethod(ctx, tx, userID, input.BrewMethod)
+	if err != nil {
+		return Entry{}, false, err
+	}
 
-	res, err := db.ExecContext(ctx,
+	res, err := tx.ExecContext(ctx,
 		`UPDATE entries
-		 SET beans = $1, brew_method = $2, notes = $3, rating = $4, brewed_at = $5, updated_at = $6
-		 WHERE user_id = $7 AND id = $8`,
-		input.Beans, input.BrewMethod, input.Notes, input.Rating, brewed, updated, userID, id,
+		 SET beans = $1, brew_method = $2, notes = $3, rating = $4, brewed_at = $5, updated_at = $6,
+		     grinder_id = $7, brewer_id = $8, bean_id = $9,
+		     cupping = $10, cupping_total = $11
+		 WHERE user_id = $12 AND id = $13`,
+		input.Beans, brewMethod, input.Notes, input.Rating, brewed, updated,
+		nullString(input.GrinderID), nullString(input.BrewerID), nullString(input.BeanID), cupping, cuppingTotal, userID, id,
 	)
 	if err != nil {
 		return Entry{}, false, err
@@ -568,24 +1001,61 @@ func updateEntry(ctx context.Context, db *sql.DB, userID string, id string, inpu
 	if affected == 0 {
 		return Entry{}, false, nil
 	}
+	if err := setEntryTags(ctx, tx, userID, id, input.Tags); err != nil {
+		return Entry{}, false, err
+	}
+	if err := setEntryDescriptors(ctx, tx, userID, id, input.Descriptors); err != nil {
+		return Entry{}, false, err
+	}
 
-	row := db.QueryRowContext(ctx,
-		`SELECT created_at FROM entries WHERE user_id = $1 AND id = $2`, userID, id)
+	row := tx.QueryRowContext(ctx,
+		`SELECT created_at, recipe_id, recipe_version, cupping, `+entryDescriptorsColumn+`, `+entryTagsColumn+`
+		 FROM entries WHERE user_id = $1 AND id = $2`, userID, id)
 	var created time.Time
-	if err := row.Scan(&created); err != nil {
-		created = updated
+	var recipeID sql.NullString
+	var recipeVersion sql.NullInt64
+	var storedCupping []byte
+	var descriptors []byte
+	var tags []byte
+	if err := row.Scan(&created, &recipeID, &recipeVersion, &storedCupping, &descriptors, &tags); err != nil {
+		return Entry{}, false, err
 	}
 
-	return Entry{
+	entry := Entry{
 		ID:         id,
 		Beans:      input.Beans,
-		BrewMethod: input.BrewMethod,
+		BrewMethod: brewMethod,
 		Notes:      input.Notes,
 		Rating:     input.Rating,
 		BrewedAt:   brewed.UTC().Format(time.RFC3339),
 		CreatedAt:  created.UTC().Format(time.RFC3339),
 		UpdatedAt:  updated.UTC().Format(time.RFC3339),
-	}, true, nil
+		GrinderID:  strings.TrimSpace(input.GrinderID),
+		BrewerID:   strings.TrimSpace(input.BrewerID),
+		BeanID:     strings.TrimSpace(input.BeanID),
+	}
+	if recipeID.Valid {
+		entry.RecipeID = recipeID.String
+		entry.RecipeVersion = int(recipeVersion.Int64)
+	}
+	if storedCupping != nil {
+		if err := json.Unmarshal(storedCupping, &entry.Cupping); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	if err := json.Unmarshal(descriptors, &entry.Descriptors); err != nil {
+		return Entry{}, false, err
+	}
+	if err := json.Unmarshal(tags, &entry.Tags); err != nil {
+		return Entry{}, false, err
+	}
+	if err := emitEntryEvent(ctx, tx, userID, eventEntryUpdated, entry); err != nil {
+		return Entry{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
 }
 
 func deleteEntry(ctx context.Context, db *sql.DB, userID string, id string) (bool, error) {
@@ -593,103 +1063,166 @@ func deleteEntry(ctx context.Context, db *sql.DB, userID string, id string) (boo
 	if err != nil {
 		return false, err
 	}
-	res, err := db.ExecContext(ctx, "DELETE FROM entries WHERE user_id = $1 AND id = $2", userID, id)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM entries WHERE user_id = $1 AND id = $2", userID, id)
 	if err != nil {
 		return false, err
 	}
 	affected, _ := res.RowsAffected()
-	return affected > 0, nil
+	if affected == 0 {
+		return false, nil
+	}
+	if err := emitEntryEvent(ctx, tx, userID, eventEntryDeleted, map[string]string{"id": id}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-func upsertSubscription(ctx context.Context, db *sql.DB, userID string, sub PushSubscription) error {
-	if sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
-		return errors.New("invalid subscription")
+func handlePushConfig(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if cfg.VapidPublicKey == "" {
+		writeJSON(w, http.StatusOK, PushConfig{})
+		return
 	}
-	_, err := db.ExecContext(ctx,
-		`INSERT INTO push_subscriptions (id, user_id, endpoint, p256dh, auth, created_at)
-		 VALUES ($1, $2, $3, $4, $5, $6)
-		 ON CONFLICT (endpoint)
-		 DO UPDATE SET p256dh = $4, auth = $5`,
-		newID(), userID, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, time.Now().UTC(),
-	)
-	return err
+	writeJSON(w, http.StatusOK, PushConfig{PublicKey: cfg.VapidPublicKey, Subject: cfg.VapidSubject})
 }
 
-func deleteSubscription(ctx context.Context, db *sql.DB, userID string, endpoint string) error {
-	_, err := db.ExecContext(ctx,
-		"DELETE FROM push_subscriptions WHERE user_id = $1 AND endpoint = $2",
-		userID, endpoint,
-	)
-	return err
+func handleSubscribe(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	var sub PushSubscription
+	if err := readJSON(w, r, &sub); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := store.UpsertSubscription(r.Context(), userID, sub); err != nil {
+		writeServerError(w, r, "failed to save subscription", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
 }
 
-func sendTestPush(ctx context.Context, db *sql.DB, cfg Config, userID string) error {
-	if cfg.VapidPrivate == "" || cfg.VapidPublicKey == "" {
-		return errors.New("VAPID keys are not configured")
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	var body struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if body.Endpoint == "" {
+		writeError(w, r, http.StatusBadRequest, "endpoint is required")
+		return
 	}
+	if err := store.DeleteSubscription(r.Context(), userID, body.Endpoint); err != nil {
+		writeServerError(w, r, "failed to delete subscription", err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
 
-	rows, err := db.QueryContext(ctx,
-		"SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1",
-		userID,
-	)
-	if err != nil {
-		return err
+func handleTestPush(w http.ResponseWriter, r *http.Request, store Store, cfg Config, userID string) {
+	if err := sendTestPush(r.Context(), store, cfg, userID); err != nil {
+		writeServerError(w, r, "failed to send test push", err)
+		return
 	}
-	defer rows.Close()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
 
-	payload := PushPayload{
+func sendTestPush(ctx context.Context, store Store, cfg Config, userID string) error {
+	return sendPush(ctx, store, cfg, userID, PushPayload{
 		Title: "Coffee Log",
 		Body:  "Notifications are enabled.",
 		URL:   "/",
+	})
+}
+
+// sendPush delivers payload to every push subscription the user has.
+func sendPush(ctx context.Context, store Store, cfg Config, userID string, payload PushPayload) error {
+	if cfg.VapidPrivate == "" || cfg.VapidPublicKey == "" {
+		return newAPIError(http.StatusNotImplemented, codeNotImplemented, "VAPID keys are not configured")
+	}
+
+	subs, err := store.ListSubscriptions(ctx, userID)
+	if err != nil {
+		return err
 	}
+
 	body, _ := json.Marshal(payload)
 
-	for rows.Next() {
-		var endpoint, p256dh, auth string
-		if err := rows.Scan(&endpoint, &p256dh, &auth); err != nil {
-			return err
-		}
+	for _, s := range subs {
 		sub := &webpush.Subscription{
-			Endpoint: endpoint,
+			Endpoint: s.Endpoint,
 			Keys: webpush.Keys{
-				P256dh: p256dh,
-				Auth:   auth,
+				P256dh: s.Keys.P256dh,
+				Auth:   s.Keys.Auth,
 			},
 		}
-		_, err := webpush.SendNotification(body, sub, &webpush.Options{
+		resp, err := webpush.SendNotificationWithContext(ctx, body, sub, &webpush.Options{
+			HTTPClient:      pushHTTPClient,
 			Subscriber:      cfg.VapidSubject,
 			VAPIDPublicKey:  cfg.VapidPublicKey,
 			VAPIDPrivateKey: cfg.VapidPrivate,
 			TTL:             30,
 		})
 		if err != nil {
+			pushDeliveriesTotal.inc("failure")
 			return err
 		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			pushDeliveriesTotal.inc("failure")
+		} else {
+			pushDeliveriesTotal.inc("success")
+		}
 	}
-
-	return rows.Err()
+	return nil
 }
 
 func validateEntry(input EntryInput) error {
-	if _, err := normalizeID(input.ID); err != nil {
-		return err
-	}
+	fields := fieldErrors{}
+	fields.id("id", input.ID)
 	if strings.TrimSpace(input.Beans) == "" {
-		return errors.New("beans is required")
+		fields.add("beans", "beans is required")
 	}
 	if strings.TrimSpace(input.BrewMethod) == "" {
-		return errors.New("brew_method is required")
+		fields.add("brew_method", "brew_method is required")
 	}
 	if strings.TrimSpace(input.BrewedAt) == "" {
-		return errors.New("brewed_at is required")
-	}
-	if _, err := time.Parse(time.RFC3339, input.BrewedAt); err != nil {
-		return errors.New("brewed_at must be RFC3339 (e.g. 2024-05-01T08:30:00Z)")
+		fields.add("brewed_at", "brewed_at is required")
+	} else if _, err := time.Parse(time.RFC3339, input.BrewedAt); err != nil {
+		fields.add("brewed_at", "brewed_at must be RFC3339 (e.g. 2024-05-01T08:30:00Z)")
 	}
 	if input.Rating < 0 || input.Rating > 5 {
-		return errors.New("rating must be between 0 and 5")
+		fields.add("rating", "rating must be between 0 and 5")
 	}
-	return nil
+	fields.id("grinder_id", input.GrinderID)
+	fields.id("brewer_id", input.BrewerID)
+	fields.id("bean_id", input.BeanID)
+	if input.Cupping != nil {
+		fields.merge(validateCupping(*input.Cupping))
+	}
+	fields.merge(validateEntryTags(input))
+	return fields.err()
+}
+
+// validateEntryRefs checks the parts of an entry that point at other rows:
+// its equipment, bean and flavor descriptors. Every bad reference is
+// reported; other errors come from the database.
+func validateEntryRefs(ctx context.Context, q querier, userID string, input EntryInput) error {
+	fields := fieldErrors{}
+	for _, check := range []func() error{
+		func() error { return validateEntryEquipment(ctx, q, userID, input) },
+		func() error { return validateEntryBean(ctx, q, userID, input) },
+		func() error { return validateEntryDescriptors(ctx, q, input) },
+	} {
+		if err := fields.merge(check()); err != nil {
+			return err
+		}
+	}
+	return fields.err()
 }
 
 func normalizeID(raw string) (string, error) {
@@ -706,6 +1239,12 @@ func normalizeID(raw string) (string, error) {
 	return id, nil
 }
 
+// nullString maps an empty (or blank) string to SQL NULL.
+func nullString(s string) sql.NullString {
+	s = strings.TrimSpace(s)
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 func newID() string {
 	buf := make([]byte, 12)
 	if _, err := rand.Read(buf); err != nil {
@@ -714,6 +1253,12 @@ func newID() string {
 	return fmt.Sprintf("%x", buf)
 }
 
+// newToken returns an unguessable URL-safe token for links handed out to
+// people outside the API (invitations and the like).
+func newToken() string {
+	return rand.Text()
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -722,93 +1267,23 @@ func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	}
 }
 
+// readJSON decodes the request body into dst. Errors are APIErrors.
 func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(dst); err != nil {
-		return err
+		return decodeError(err)
 	}
 	if dec.More() {
-		return errors.New("multiple JSON values in body")
+		return newAPIError(http.StatusBadRequest, codeInvalidJSON, "request body must be a single JSON value")
 	}
 	return nil
 }
 
 func enableCors(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-}
-
-func withCors(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		enableCors(w)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		next(w, r)
-	}
-}
-
-func applyMigrations(db *sql.DB, dir string) error {
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return err
-	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (filename text PRIMARY KEY, applied_at timestamptz NOT NULL)`); err != nil {
-		return err
-	}
-
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return err
-	}
-
-	files := []string{}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		name := entry.Name()
-		if strings.HasSuffix(name, ".sql") {
-			files = append(files, name)
-		}
-	}
-	sort.Strings(files)
-
-	for _, name := range files {
-		applied, err := migrationApplied(db, name)
-		if err != nil {
-			return err
-		}
-		if applied {
-			continue
-		}
-		content, err := fs.ReadFile(os.DirFS(dir), name)
-		if err != nil {
-			return err
-		}
-		if _, err := db.Exec(string(content)); err != nil {
-			return fmt.Errorf("migration %s failed: %w", name, err)
-		}
-		if _, err := db.Exec(`INSERT INTO schema_migrations (filename, applied_at) VALUES ($1, $2)`, name, time.Now().UTC()); err != nil {
-			return err
-		}
-		log.Printf("applied migration %s", name)
-	}
-
-	return nil
-}
-
-func migrationApplied(db *sql.DB, name string) (bool, error) {
-	var filename string
-	err := db.QueryRow(`SELECT filename FROM schema_migrations WHERE filename = $1`, name).Scan(&filename)
-	if err == sql.ErrNoRows {
-		return false, nil
-	}
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Request-ID, Idempotency-Key")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Deprecation, Link, Idempotent-Replayed")
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsQueryTimeout = 5 * time.Second
+
+// httpDurationBuckets are upper bounds in seconds for request latency.
+var httpDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequestsTotal = newCounterVec("coffee_http_requests_total",
+		"HTTP requests by method, route pattern and status code.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("coffee_http_request_duration_seconds",
+		"HTTP request latency by method and route pattern.", httpDurationBuckets, "method", "route")
+	pushDeliveriesTotal = newCounterVec("coffee_push_deliveries_total",
+		"Web push notifications sent, by result.", "result")
+)
+
+// counterVec is a monotonically increasing value per label combination.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+// histogramVec counts observations into fixed buckets per label combination.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts[i] is the number of observations in bucket i alone; the
+	// cumulative form Prometheus expects is built when writing.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			values := append(append([]string{}, s.labelValues...), formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), cumulative)
+		}
+		values := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+// metricMethod keeps the method label to a fixed set so junk requests
+// cannot create unbounded series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// withMetrics records request counts and latency. The mux fills in
+// r.Pattern on the request it is handed, and the pattern (not the raw
+// path) is what keeps the route label bounded, so nothing between this and
+// the mux may replace the request.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := metricMethod(r.Method)
+		httpRequestsTotal.inc(method, route, strconv.Itoa(rec.status))
+		httpRequestDuration.observe(time.Since(start).Seconds(), method, route)
+	})
+}
+
+// handleMetrics serves every metric in the Prometheus text exposition
+// format. In-process counters are always written; values read from the
+// database are skipped (and logged) if their query fails, so a struggling
+// database still leaves the scrape usable.
+func handleMetrics(w http.ResponseWriter, r *http.Request, store Store) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	httpRequestsTotal.write(w)
+	httpRequestDuration.write(w)
+	pushDeliveriesTotal.write(w)
+	writeDBStats(w, store.DB().Stats())
+
+	ctx, cancel := context.WithTimeout(r.Context(), metricsQueryTimeout)
+	defer cancel()
+	if err := writeDatabaseMetrics(ctx, w, store.DB(), store.Dialect()); err != nil {
+		logger(r.Context()).Error("failed to collect database metrics", "err", err)
+	}
+}
+
+func writeDBStats(w io.Writer, stats sql.DBStats) {
+	writeGauge(w, "coffee_db_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections))
+	writeGauge(w, "coffee_db_open_connections", "Established connections, both in use and idle.", float64(stats.OpenConnections))
+	writeGauge(w, "coffee_db_in_use_connections", "Connections currently in use.", float64(stats.InUse))
+	writeGauge(w, "coffee_db_idle_connections", "Idle connections.", float64(stats.Idle))
+	writeCounter(w, "coffee_db_wait_count_total", "Connections waited for.", float64(stats.WaitCount))
+	writeCounter(w, "coffee_db_wait_duration_seconds_total", "Time spent waiting for a connection.", stats.WaitDuration.Seconds())
+	writeCounter(w, "coffee_db_max_idle_closed_total", "Connections closed due to SetMaxIdleConns.", float64(stats.MaxIdleClosed))
+	writeCounter(w, "coffee_db_max_idle_time_closed_total", "Connections closed due to SetConnMaxIdleTime.", float64(stats.MaxIdleTimeClosed))
+	writeCounter(w, "coffee_db_max_lifetime_closed_total", "Connections closed due to SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed))
+}
+
+// writeDatabaseMetrics writes the schema version and business gauges. Each
+// metric is only written once its query has succeeded, so a failure part
+// way through never leaves a half-written metric family.
+func writeDatabaseMetrics(ctx context.Context, w io.Writer, db *sql.DB, dialect string) error {
+	var latest sql.NullString
+	var applied int
+	if err := db.QueryRowContext(ctx,
+		"SELECT MAX(filename), COUNT(*) FROM schema_migrations",
+	).Scan(&latest, &applied); err != nil {
+		return err
+	}
+	writeGauge(w, "coffee_schema_version", "Numeric prefix of the newest applied migration.", float64(migrationVersion(latest.String)))
+	writeGauge(w, "coffee_schema_migrations_applied", "Number of applied migrations.", float64(applied))
+
+	var users, entries, entriesLastHour int64
+	if err := db.QueryRowContext(ctx,
+		`SELECT (SELECT COUNT(*) FROM users),
+		        (SELECT COUNT(*) FROM entries),
+		        (SELECT COUNT(*) FROM entries WHERE created_at > $1)`,
+		time.Now().UTC().Add(-time.Hour),
+	).Scan(&users, &entries, &entriesLastHour); err != nil {
+		return err
+	}
+	writeGauge(w, "coffee_users", "Registered users.", float64(users))
+	writeGauge(w, "coffee_entries", "Logged entries across all users.", float64(entries))
+	writeGauge(w, "coffee_entries_created_last_hour", "Entries created in the past hour.", float64(entriesLastHour))
+	if dialect != dialectPostgres {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT status, COUNT(*) FROM jobs GROUP BY status")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	jobs := map[string]int64{"queued": 0, "running": 0, "succeeded": 0, "dead": 0}
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return err
+		}
+		jobs[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# HELP coffee_jobs Background jobs by status.\n# TYPE coffee_jobs gauge\n")
+	for _, status := range sortedKeys(jobs) {
+		fmt.Fprintf(w, "coffee_jobs%s %d\n", formatLabels([]string{"status"}, []string{status}), jobs[status])
+	}
+	return nil
+}
+
+// migrationVersion extracts 13 from "013_jobs.sql"; 0 when nothing applies.
+func migrationVersion(filename string) int {
+	digits := filename
+	if i := strings.IndexFunc(filename, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = filename[:i]
+	}
+	n, _ := strconv.Atoi(digits)
+	return n
+}
+
+// withMetricsToken requires METRICS_TOKEN as a bearer token when one is
+// configured.
+func withMetricsToken(cfg Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MetricsToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				writeError(w, r, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// newMetricsServer returns the listener for METRICS_ADDR, kept apart from
+// the public port so it can be firewalled off. Nil when no address is set.
+func newMetricsServer(cfg Config, store Store) *http.Server {
+	if cfg.MetricsAddr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", withMetricsToken(cfg, func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, store)
+	}))
+	return &http.Server{
+		Addr:              cfg.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migrationLockKey identifies the Postgres advisory lock held while
+// migrating ("coffee" in ASCII), so replicas starting together take turns
+// instead of racing through the same files.
+const migrationLockKey int64 = 0x636f66666565
+
+const downMigrationSuffix = ".down.sql"
+
+// The migrations are compiled into the binary, so it never depends on the
+// working directory it is started from. Each dialect has its own
+// directory; the SQLite schema covers only what the SQLite store supports.
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var embeddedMigrations embed.FS
+
+// migrationsFor returns the migration files for dialect at the root of an
+// fs.FS.
+func migrationsFor(dialect string) fs.FS {
+	sub, err := fs.Sub(embeddedMigrations, "migrations/"+dialect)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// migration is one NNN_name.sql file and its optional NNN_name.down.sql
+// counterpart.
+type migration struct {
+	name     string
+	up       string
+	down     string
+	hasDown  bool
+	checksum string
+}
+
+type MigrationState struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	AppliedAt  string `json:"applied_at,omitempty"`
+	Reversible bool   `json:"reversible"`
+}
+
+// Statuses reported by migrationStatus.
+const (
+	migrationApplied  = "applied"
+	migrationPending  = "pending"
+	migrationModified = "modified"
+	migrationMissing  = "missing"
+)
+
+type appliedMigration struct {
+	appliedAt time.Time
+	checksum  sql.NullString
+}
+
+// migrationFiles lists the up migrations in fsys in the order they apply.
+func migrationFiles(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if strings.HasSuffix(name, ".sql") && !strings.HasSuffix(name, downMigrationSuffix) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := migrationFiles(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no migrations found")
+	}
+	migrations := make([]migration, 0, len(files))
+	for _, name := range files {
+		up, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(up)
+		m := migration{name: name, up: string(up), checksum: hex.EncodeToString(sum[:])}
+		down, err := fs.ReadFile(fsys, strings.TrimSuffix(name, ".sql")+downMigrationSuffix)
+		switch {
+		case err == nil:
+			m.down, m.hasDown = string(down), true
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// applyMigrations runs every pending migration in order, each in its own
+// transaction together with its schema_migrations row, so a failure leaves
+// the schema as it was before that file. Migrations already applied are
+// checked against their recorded checksum first; an edited file stops the
+// run rather than leaving the schema out of step with the code.
+func applyMigrations(ctx context.Context, db *sql.DB, dialect string, fsys fs.FS) error {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, dialect, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := verifyChecksums(ctx, conn, migrations, applied); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.name]; ok {
+				continue
+			}
+			err := inMigrationTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx,
+					`INSERT INTO schema_migrations (filename, applied_at, checksum) VALUES ($1, $2, $3)`,
+					m.name, time.Now().UTC(), m.checksum,
+				)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %s failed: %w", m.name, err)
+			}
+			slog.Info("applied migration", "name", m.name)
+		}
+		return nil
+	})
+}
+
+// rollbackMigrations reverts the most recently applied steps migrations
+// using their .down.sql files, newest first. Every one of them must have a
+// down file and an unmodified up file before anything is touched.
+func rollbackMigrations(ctx context.Context, db *sql.DB, dialect string, fsys fs.FS, steps int) error {
+	if steps < 1 {
+		return errors.New("steps must be at least 1")
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	byName := map[string]migration{}
+	for _, m := range migrations {
+		byName[m.name] = m
+	}
+
+	return withMigrationLock(ctx, db, dialect, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(applied))
+		for name := range applied {
+			names = append(names, name)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		if len(names) > steps {
+			names = names[:steps]
+		}
+
+		targets := []migration{}
+		for _, name := range names {
+			m, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("migration %s is applied but its file is missing", name)
+			}
+			if sum := applied[name].checksum; sum.Valid && sum.String != m.checksum {
+				return fmt.Errorf("migration %s has been modified since it was applied", name)
+			}
+			if !m.hasDown {
+				return fmt.Errorf("migration %s has no %s file", name, downMigrationSuffix)
+			}
+			targets = append(targets, m)
+		}
+
+		for _, m := range targets {
+			err := inMigrationTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE filename = $1`, m.name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("rollback of %s failed: %w", m.name, err)
+			}
+			slog.Info("rolled back migration", "name", m.name)
+		}
+		return nil
+	})
+}
+
+// migrationStatus reports every migration file alongside anything recorded
+// as applied whose file no longer exists.
+func migrationStatus(ctx context.Context, db *sql.DB, dialect string, fsys fs.FS) ([]MigrationState, error) {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	err = withMigrationLock(ctx, db, dialect, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		for _, m := range migrations {
+			seen[m.name] = true
+			state := MigrationState{Name: m.name, Status: migrationPending, Reversible: m.hasDown}
+			if a, ok := applied[m.name]; ok {
+				state.Status = migrationApplied
+				state.AppliedAt = a.appliedAt.UTC().Format(time.RFC3339)
+				if a.checksum.Valid && a.checksum.String != m.checksum {
+					state.Status = migrationModified
+				}
+			}
+			states = append(states, state)
+		}
+		for name, a := range applied {
+			if !seen[name] {
+				states = append(states, MigrationState{
+					Name:      name,
+					Status:    migrationMissing,
+					AppliedAt: a.appliedAt.UTC().Format(time.RFC3339),
+				})
+			}
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+		return nil
+	})
+	return states, err
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the
+// migration advisory lock. The lock is session-scoped, so everything fn
+// does must go through conn. SQLite has no advisory locks; its store only
+// ever opens one connection, which serialises migrations just the same.
+func withMigrationLock(ctx context.Context, db *sql.DB, dialect string, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if dialect == dialectSQLite {
+		if _, err := conn.ExecContext(ctx,
+			`CREATE TABLE IF NOT EXISTS schema_migrations (filename TEXT PRIMARY KEY, applied_at DATETIME NOT NULL, checksum TEXT)`,
+		); err != nil {
+			return err
+		}
+		return fn(conn)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		slog.Info("waiting for another instance to finish migrating")
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		// Unlock even if ctx is done; closing the connection would release
+		// it too, but it goes back to the pool instead.
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			slog.Warn("failed to release migration lock", "err", err)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (filename text PRIMARY KEY, applied_at timestamptz NOT NULL)`,
+	); err != nil {
+		return err
+	}
+	// Rows written before checksums were recorded have none; they are
+	// filled in on the next run.
+	if _, err := conn.ExecContext(ctx, `ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum text`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func inMigrationTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[string]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT filename, applied_at, checksum FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[string]appliedMigration{}
+	for rows.Next() {
+		var name string
+		var a appliedMigration
+		if err := rows.Scan(&name, &a.appliedAt, &a.checksum); err != nil {
+			return nil, err
+		}
+		applied[name] = a
+	}
+	return applied, rows.Err()
+}
+
+// verifyChecksums fails if an applied migration's file has changed, and
+// records checksums for rows that predate them.
+func verifyChecksums(ctx context.Context, conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error {
+	for _, m := range migrations {
+		a, ok := applied[m.name]
+		if !ok {
+			continue
+		}
+		if !a.checksum.Valid {
+			if _, err := conn.ExecContext(ctx,
+				"UPDATE schema_migrations SET checksum = $1 WHERE filename = $2", m.checksum, m.name,
+			); err != nil {
+				return err
+			}
+			continue
+		}
+		if a.checksum.String != m.checksum {
+			return fmt.Errorf("migration %s has been modified since it was applied; add a new migration instead of editing it", m.name)
+		}
+	}
+	return nil
+}
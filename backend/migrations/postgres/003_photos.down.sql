@@ -0,0 +1,2 @@
+-- Stored photo files are left behind in blob storage.
+DROP TABLE IF EXISTS photos;
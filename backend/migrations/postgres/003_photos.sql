@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS photos (
+  id text PRIMARY KEY,
+  user_id text NOT NULL,
+  entry_id text NOT NULL,
+  content_type text NOT NULL,
+  width integer NOT NULL,
+  height integer NOT NULL,
+  size_bytes bigint NOT NULL,
+  original_key text NOT NULL,
+  thumb_key text NOT NULL,
+  created_at timestamptz NOT NULL,
+  FOREIGN KEY (user_id, entry_id) REFERENCES entries(user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS photos_entry_idx ON photos (user_id, entry_id);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS entries_recipe_idx;
+ALTER TABLE entries DROP CONSTRAINT IF EXISTS entries_recipe_fk;
+ALTER TABLE entries DROP COLUMN IF EXISTS recipe_version;
+ALTER TABLE entries DROP COLUMN IF EXISTS recipe_id;
+
+DROP TABLE IF EXISTS recipe_versions;
+DROP TABLE IF EXISTS recipes;
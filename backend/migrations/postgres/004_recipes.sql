@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS recipes (
+  id text NOT NULL,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name text NOT NULL,
+  method text NOT NULL,
+  dose double precision NOT NULL,
+  water double precision NOT NULL,
+  grind text NOT NULL,
+  temperature double precision NOT NULL,
+  steps jsonb NOT NULL DEFAULT '[]',
+  notes text NOT NULL,
+  version integer NOT NULL DEFAULT 1,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+  PRIMARY KEY (user_id, id)
+);
+
+-- Snapshot of the brew parameters for every recipe version, so entries
+-- brewed from an older version can still be compared against newer ones.
+CREATE TABLE IF NOT EXISTS recipe_versions (
+  user_id text NOT NULL,
+  recipe_id text NOT NULL,
+  version integer NOT NULL,
+  method text NOT NULL,
+  dose double precision NOT NULL,
+  water double precision NOT NULL,
+  grind text NOT NULL,
+  temperature double precision NOT NULL,
+  steps jsonb NOT NULL DEFAULT '[]',
+  created_at timestamptz NOT NULL,
+  PRIMARY KEY (user_id, recipe_id, version),
+  FOREIGN KEY (user_id, recipe_id) REFERENCES recipes(user_id, id) ON DELETE CASCADE
+);
+
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS recipe_id text;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS recipe_version integer;
+ALTER TABLE entries ADD CONSTRAINT entries_recipe_fk
+  FOREIGN KEY (user_id, recipe_id) REFERENCES recipes(user_id, id) ON DELETE SET NULL (recipe_id);
+
+CREATE INDEX IF NOT EXISTS entries_recipe_idx ON entries (user_id, recipe_id, recipe_version);
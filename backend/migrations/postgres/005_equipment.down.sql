@@ -0,0 +1,9 @@
+-- Brew methods stay normalized; the original spellings are not kept.
+DROP INDEX IF EXISTS entries_brewer_idx;
+DROP INDEX IF EXISTS entries_grinder_idx;
+ALTER TABLE entries DROP CONSTRAINT IF EXISTS entries_brewer_fk;
+ALTER TABLE entries DROP CONSTRAINT IF EXISTS entries_grinder_fk;
+ALTER TABLE entries DROP COLUMN IF EXISTS brewer_id;
+ALTER TABLE entries DROP COLUMN IF EXISTS grinder_id;
+
+DROP TABLE IF EXISTS equipment;
@@ -0,0 +1,83 @@
+CREATE TABLE IF NOT EXISTS equipment (
+  id text NOT NULL,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  type text NOT NULL CHECK (type IN ('grinder', 'brewer', 'kettle', 'filter')),
+  make text NOT NULL,
+  model text NOT NULL,
+  notes text NOT NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+  PRIMARY KEY (user_id, id)
+);
+
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS grinder_id text;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS brewer_id text;
+ALTER TABLE entries ADD CONSTRAINT entries_grinder_fk
+  FOREIGN KEY (user_id, grinder_id) REFERENCES equipment(user_id, id) ON DELETE SET NULL (grinder_id);
+ALTER TABLE entries ADD CONSTRAINT entries_brewer_fk
+  FOREIGN KEY (user_id, brewer_id) REFERENCES equipment(user_id, id) ON DELETE SET NULL (brewer_id);
+
+CREATE INDEX IF NOT EXISTS entries_grinder_idx ON entries (user_id, grinder_id);
+CREATE INDEX IF NOT EXISTS entries_brewer_idx ON entries (user_id, brewer_id);
+
+-- Normalize free-text brew methods. Keep this list in sync with
+-- brewMethodAliases in equipment.go.
+CREATE FUNCTION pg_temp.normalize_brew_method(raw text) RETURNS text AS $$
+  SELECT CASE lower(cleaned)
+    WHEN 'v60' THEN 'V60'
+    WHEN 'hario v60' THEN 'V60'
+    WHEN 'chemex' THEN 'Chemex'
+    WHEN 'aeropress' THEN 'AeroPress'
+    WHEN 'aero press' THEN 'AeroPress'
+    WHEN 'french press' THEN 'French Press'
+    WHEN 'frenchpress' THEN 'French Press'
+    WHEN 'cafetiere' THEN 'French Press'
+    WHEN 'espresso' THEN 'Espresso'
+    WHEN 'moka' THEN 'Moka Pot'
+    WHEN 'moka pot' THEN 'Moka Pot'
+    WHEN 'bialetti' THEN 'Moka Pot'
+    WHEN 'kalita' THEN 'Kalita Wave'
+    WHEN 'kalita wave' THEN 'Kalita Wave'
+    WHEN 'clever' THEN 'Clever Dripper'
+    WHEN 'clever dripper' THEN 'Clever Dripper'
+    WHEN 'cold brew' THEN 'Cold Brew'
+    WHEN 'coldbrew' THEN 'Cold Brew'
+    WHEN 'siphon' THEN 'Siphon'
+    WHEN 'syphon' THEN 'Siphon'
+    WHEN 'pour over' THEN 'Pour Over'
+    WHEN 'pourover' THEN 'Pour Over'
+    WHEN 'pour-over' THEN 'Pour Over'
+    WHEN 'origami' THEN 'Origami'
+    ELSE cleaned
+  END
+  FROM (SELECT regexp_replace(btrim(raw), '\s+', ' ', 'g') AS cleaned) AS c
+$$ LANGUAGE sql IMMUTABLE;
+
+UPDATE entries SET brew_method = pg_temp.normalize_brew_method(brew_method)
+  WHERE brew_method IS DISTINCT FROM pg_temp.normalize_brew_method(brew_method);
+UPDATE recipes SET method = pg_temp.normalize_brew_method(method)
+  WHERE method IS DISTINCT FROM pg_temp.normalize_brew_method(method);
+UPDATE recipe_versions SET method = pg_temp.normalize_brew_method(method)
+  WHERE method IS DISTINCT FROM pg_temp.normalize_brew_method(method);
+
+-- Collapse the remaining case-only variants ("Switch" / "switch") to each
+-- user's most frequently used spelling.
+WITH ranked AS (
+  SELECT user_id,
+         brew_method,
+         row_number() OVER (
+           PARTITION BY user_id, lower(brew_method)
+           ORDER BY count(*) DESC, brew_method
+         ) AS rank
+  FROM entries
+  GROUP BY user_id, brew_method
+)
+UPDATE entries e
+SET brew_method = r.brew_method
+FROM ranked r
+WHERE r.rank = 1
+  AND e.user_id = r.user_id
+  AND lower(e.brew_method) = lower(r.brew_method)
+  AND e.brew_method <> r.brew_method;
+
+DROP FUNCTION pg_temp.normalize_brew_method(text);
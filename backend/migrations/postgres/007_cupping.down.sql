@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS entries_cupping_idx;
+ALTER TABLE entries DROP COLUMN IF EXISTS cupping_total;
+ALTER TABLE entries DROP COLUMN IF EXISTS cupping;
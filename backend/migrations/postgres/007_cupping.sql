@@ -0,0 +1,4 @@
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS cupping jsonb;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS cupping_total double precision;
+
+CREATE INDEX IF NOT EXISTS entries_cupping_idx ON entries (user_id, beans) WHERE cupping_total IS NOT NULL;
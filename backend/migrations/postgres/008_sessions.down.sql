@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS session_scores;
+DROP TABLE IF EXISTS session_participants;
+DROP TABLE IF EXISTS session_samples;
+DROP TABLE IF EXISTS tasting_sessions;
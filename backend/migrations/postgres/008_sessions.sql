@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS tasting_sessions (
+  id text PRIMARY KEY,
+  host_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name text NOT NULL,
+  status text NOT NULL CHECK (status IN ('open', 'closed')),
+  created_at timestamptz NOT NULL,
+  closed_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS tasting_sessions_host_idx ON tasting_sessions (host_id);
+
+-- Samples are stored in their shuffled serving order; label is the blind
+-- code shown to tasters until the session closes.
+CREATE TABLE IF NOT EXISTS session_samples (
+  session_id text NOT NULL REFERENCES tasting_sessions(id) ON DELETE CASCADE,
+  id text NOT NULL,
+  label text NOT NULL,
+  position integer NOT NULL,
+  beans text NOT NULL,
+  notes text NOT NULL,
+  PRIMARY KEY (session_id, id),
+  UNIQUE (session_id, label)
+);
+
+CREATE TABLE IF NOT EXISTS session_participants (
+  session_id text NOT NULL REFERENCES tasting_sessions(id) ON DELETE CASCADE,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  invited_at timestamptz NOT NULL,
+  PRIMARY KEY (session_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS session_participants_user_idx ON session_participants (user_id);
+
+CREATE TABLE IF NOT EXISTS session_scores (
+  session_id text NOT NULL,
+  sample_id text NOT NULL,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  score jsonb NOT NULL,
+  total double precision NOT NULL,
+  submitted_at timestamptz NOT NULL,
+  PRIMARY KEY (session_id, sample_id, user_id),
+  FOREIGN KEY (session_id, sample_id) REFERENCES session_samples(session_id, id) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS entries_bean_idx;
+ALTER TABLE entries DROP COLUMN IF EXISTS bean_id;
+
+DROP TABLE IF EXISTS beans;
+DROP TABLE IF EXISTS group_invitations;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
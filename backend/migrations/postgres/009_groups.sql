@@ -0,0 +1,56 @@
+CREATE TABLE IF NOT EXISTS groups (
+  id text PRIMARY KEY,
+  name text NOT NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+  group_id text NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role text NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+  joined_at timestamptz NOT NULL,
+  PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS group_members_user_idx ON group_members (user_id);
+
+-- An invitation with an email can only be accepted by that user; one
+-- without is a shareable link that anyone signed in can accept.
+CREATE TABLE IF NOT EXISTS group_invitations (
+  id text PRIMARY KEY,
+  group_id text NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+  email text,
+  token text UNIQUE NOT NULL,
+  role text NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+  created_by text REFERENCES users(id) ON DELETE SET NULL,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz,
+  accepted_by text REFERENCES users(id) ON DELETE SET NULL,
+  accepted_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS group_invitations_email_idx ON group_invitations (email) WHERE accepted_at IS NULL;
+
+-- Shared bean inventory. Beans belong to a group rather than a user so
+-- every member sees the same shelf.
+CREATE TABLE IF NOT EXISTS beans (
+  id text PRIMARY KEY,
+  group_id text NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+  name text NOT NULL,
+  roaster text NOT NULL,
+  origin text NOT NULL,
+  roasted_on date,
+  weight_grams double precision NOT NULL,
+  remaining_grams double precision NOT NULL,
+  notes text NOT NULL,
+  created_by text REFERENCES users(id) ON DELETE SET NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS beans_group_idx ON beans (group_id);
+
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS bean_id text REFERENCES beans(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS entries_bean_idx ON entries (bean_id);
@@ -0,0 +1,19 @@
+-- Public share links. Exactly one of entry_id / recipe_id is set; revoked
+-- links are kept (rather than deleted) so their view counts survive.
+CREATE TABLE IF NOT EXISTS shares (
+  id text PRIMARY KEY,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  slug text UNIQUE NOT NULL,
+  entry_id text,
+  recipe_id text,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz,
+  revoked_at timestamptz,
+  view_count bigint NOT NULL DEFAULT 0,
+  last_viewed_at timestamptz,
+  CHECK ((entry_id IS NULL) <> (recipe_id IS NULL)),
+  FOREIGN KEY (user_id, entry_id) REFERENCES entries(user_id, id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id, recipe_id) REFERENCES recipes(user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS shares_user_idx ON shares (user_id, created_at DESC);
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id text NOT NULL,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  url text NOT NULL,
+  secret text NOT NULL,
+  events jsonb NOT NULL,
+  -- consecutive_failures counts failed attempts since the last success;
+  -- the worker disables the hook once it crosses the limit.
+  consecutive_failures integer NOT NULL DEFAULT 0,
+  disabled_at timestamptz,
+  disabled_reason text,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+  PRIMARY KEY (user_id, id)
+);
+
+-- Deliveries double as the durable queue: rows are written in the same
+-- transaction as the entry change and picked up by the delivery worker.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id text PRIMARY KEY,
+  user_id text NOT NULL,
+  webhook_id text NOT NULL,
+  event text NOT NULL,
+  payload jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamptz NOT NULL,
+  last_attempt_at timestamptz,
+  response_status integer,
+  response_body text,
+  error text,
+  redelivery_of text,
+  created_at timestamptz NOT NULL,
+  FOREIGN KEY (user_id, webhook_id) REFERENCES webhooks(user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (user_id, webhook_id, created_at DESC);
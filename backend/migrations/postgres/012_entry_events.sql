@@ -0,0 +1,13 @@
+-- Short-lived log of entry changes backing /api/events. seq doubles as the
+-- SSE event id so clients can resume with Last-Event-ID; rows older than a
+-- day are pruned by the events.prune job.
+CREATE TABLE IF NOT EXISTS entry_events (
+  seq bigserial PRIMARY KEY,
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  event text NOT NULL,
+  payload jsonb NOT NULL,
+  created_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS entry_events_user_idx ON entry_events (user_id, seq);
+CREATE INDEX IF NOT EXISTS entry_events_created_idx ON entry_events (created_at);
@@ -0,0 +1,24 @@
+-- Background jobs. Workers claim queued rows with FOR UPDATE SKIP LOCKED;
+-- a running job whose lease has expired is treated as abandoned and
+-- claimed again. dedupe_key stops replicas enqueueing the same cron run
+-- twice.
+CREATE TABLE IF NOT EXISTS jobs (
+  id text PRIMARY KEY,
+  kind text NOT NULL,
+  payload jsonb NOT NULL DEFAULT '{}',
+  status text NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'dead')),
+  attempts integer NOT NULL DEFAULT 0,
+  max_attempts integer NOT NULL,
+  run_at timestamptz NOT NULL,
+  locked_by text,
+  locked_until timestamptz,
+  last_error text,
+  dedupe_key text UNIQUE,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+  finished_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS jobs_due_idx ON jobs (run_at) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS jobs_running_idx ON jobs (locked_until) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, kind, created_at DESC);
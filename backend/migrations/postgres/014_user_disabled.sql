@@ -0,0 +1,2 @@
+-- Disabled accounts cannot sign in, and their existing tokens stop working.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at timestamptz;
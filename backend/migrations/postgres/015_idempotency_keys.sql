@@ -0,0 +1,16 @@
+-- Responses to POST /api/entries, kept for IDEMPOTENCY_WINDOW so a retry
+-- with the same Idempotency-Key replays them instead of creating a second
+-- entry. status stays NULL while the first request is still running.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  idempotency_key text NOT NULL,
+  request_hash text NOT NULL,
+  status integer,
+  content_type text,
+  body text,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz NOT NULL,
+  PRIMARY KEY (user_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
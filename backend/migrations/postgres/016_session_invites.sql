@@ -0,0 +1,11 @@
+-- Tasters are invited by email and only join a session once they next
+-- sign in and look at their sessions, so an invitation never reveals
+-- whether an address has an account.
+CREATE TABLE IF NOT EXISTS session_invites (
+  session_id text NOT NULL REFERENCES tasting_sessions(id) ON DELETE CASCADE,
+  email text NOT NULL,
+  invited_at timestamptz NOT NULL,
+  PRIMARY KEY (session_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS session_invites_email_idx ON session_invites (email);
@@ -0,0 +1,3 @@
+-- Response bodies from webhook endpoints are no longer kept: they were
+-- shown back to the hook's owner, which let a hook read internal services.
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS response_body;
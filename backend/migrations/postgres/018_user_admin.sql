@@ -0,0 +1,3 @@
+-- Admins are marked explicitly with `user promote`; matching ADMIN_EMAILS
+-- against unverified sign-up emails let anyone claim an admin address.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin boolean NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+-- A claimed key is only held until locked_until, so a request that died
+-- without completing or releasing it cannot block retries for the whole
+-- window. Keys claimed before this migration have no lease and can be
+-- taken over straight away.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until timestamptz;
@@ -0,0 +1 @@
+DELETE FROM jobs WHERE kind = 'webhook.deliver' AND status = 'queued';
@@ -0,0 +1,7 @@
+-- Webhook deliveries now run as jobs. Queue one for every delivery still
+-- pending from the dedicated worker they used to have.
+INSERT INTO jobs (id, kind, payload, max_attempts, run_at, created_at, updated_at)
+SELECT substr(md5(random()::text || id), 1, 24), 'webhook.deliver', jsonb_build_object('delivery_id', id),
+       5, next_attempt_at, now(), now()
+FROM webhook_deliveries
+WHERE status = 'pending';
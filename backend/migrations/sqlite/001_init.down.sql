@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS push_subscriptions;
+DROP TABLE IF EXISTS entry_descriptors;
+DROP TABLE IF EXISTS entry_tags;
+DROP TABLE IF EXISTS tags;
+DROP TABLE IF EXISTS flavor_descriptors;
+DROP TABLE IF EXISTS entries;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,195 @@
+-- SQLite schema for single-user installs: accounts, entries with their
+-- tags and flavor descriptors, and push subscriptions. The columns match
+-- the Postgres tables so the same queries and scanners work on both; the
+-- recipe, equipment and bean references stay empty here.
+CREATE TABLE IF NOT EXISTS users (
+  id TEXT PRIMARY KEY,
+  email TEXT UNIQUE NOT NULL,
+  password_hash TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  disabled_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS entries (
+  id TEXT NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  beans TEXT NOT NULL,
+  brew_method TEXT NOT NULL,
+  notes TEXT NOT NULL,
+  rating INTEGER NOT NULL,
+  brewed_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  recipe_id TEXT,
+  recipe_version INTEGER,
+  grinder_id TEXT,
+  brewer_id TEXT,
+  bean_id TEXT,
+  cupping TEXT,
+  cupping_total REAL,
+  PRIMARY KEY (user_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS entries_brewed_idx ON entries (user_id, brewed_at);
+
+CREATE TABLE IF NOT EXISTS flavor_descriptors (
+  id TEXT PRIMARY KEY,
+  parent_id TEXT REFERENCES flavor_descriptors(id),
+  name TEXT NOT NULL,
+  depth INTEGER NOT NULL,
+  position INTEGER NOT NULL
+);
+
+INSERT INTO flavor_descriptors (id, parent_id, name, depth, position) VALUES
+  ('floral', NULL, 'Floral', 1, 1),
+  ('floral.black-tea', 'floral', 'Black Tea', 2, 2),
+  ('floral.floral', 'floral', 'Floral', 2, 3),
+  ('floral.floral.chamomile', 'floral.floral', 'Chamomile', 3, 4),
+  ('floral.floral.rose', 'floral.floral', 'Rose', 3, 5),
+  ('floral.floral.jasmine', 'floral.floral', 'Jasmine', 3, 6),
+  ('fruity', NULL, 'Fruity', 1, 7),
+  ('fruity.berry', 'fruity', 'Berry', 2, 8),
+  ('fruity.berry.blackberry', 'fruity.berry', 'Blackberry', 3, 9),
+  ('fruity.berry.raspberry', 'fruity.berry', 'Raspberry', 3, 10),
+  ('fruity.berry.blueberry', 'fruity.berry', 'Blueberry', 3, 11),
+  ('fruity.berry.strawberry', 'fruity.berry', 'Strawberry', 3, 12),
+  ('fruity.dried-fruit', 'fruity', 'Dried Fruit', 2, 13),
+  ('fruity.dried-fruit.raisin', 'fruity.dried-fruit', 'Raisin', 3, 14),
+  ('fruity.dried-fruit.prune', 'fruity.dried-fruit', 'Prune', 3, 15),
+  ('fruity.other-fruit', 'fruity', 'Other Fruit', 2, 16),
+  ('fruity.other-fruit.coconut', 'fruity.other-fruit', 'Coconut', 3, 17),
+  ('fruity.other-fruit.cherry', 'fruity.other-fruit', 'Cherry', 3, 18),
+  ('fruity.other-fruit.pomegranate', 'fruity.other-fruit', 'Pomegranate', 3, 19),
+  ('fruity.other-fruit.pineapple', 'fruity.other-fruit', 'Pineapple', 3, 20),
+  ('fruity.other-fruit.grape', 'fruity.other-fruit', 'Grape', 3, 21),
+  ('fruity.other-fruit.apple', 'fruity.other-fruit', 'Apple', 3, 22),
+  ('fruity.other-fruit.peach', 'fruity.other-fruit', 'Peach', 3, 23),
+  ('fruity.other-fruit.pear', 'fruity.other-fruit', 'Pear', 3, 24),
+  ('fruity.citrus-fruit', 'fruity', 'Citrus Fruit', 2, 25),
+  ('fruity.citrus-fruit.grapefruit', 'fruity.citrus-fruit', 'Grapefruit', 3, 26),
+  ('fruity.citrus-fruit.orange', 'fruity.citrus-fruit', 'Orange', 3, 27),
+  ('fruity.citrus-fruit.lemon', 'fruity.citrus-fruit', 'Lemon', 3, 28),
+  ('fruity.citrus-fruit.lime', 'fruity.citrus-fruit', 'Lime', 3, 29),
+  ('sour-fermented', NULL, 'Sour/Fermented', 1, 30),
+  ('sour-fermented.sour', 'sour-fermented', 'Sour', 2, 31),
+  ('sour-fermented.sour.sour-aromatics', 'sour-fermented.sour', 'Sour Aromatics', 3, 32),
+  ('sour-fermented.sour.acetic-acid', 'sour-fermented.sour', 'Acetic Acid', 3, 33),
+  ('sour-fermented.sour.butyric-acid', 'sour-fermented.sour', 'Butyric Acid', 3, 34),
+  ('sour-fermented.sour.isovaleric-acid', 'sour-fermented.sour', 'Isovaleric Acid', 3, 35),
+  ('sour-fermented.sour.citric-acid', 'sour-fermented.sour', 'Citric Acid', 3, 36),
+  ('sour-fermented.sour.malic-acid', 'sour-fermented.sour', 'Malic Acid', 3, 37),
+  ('sour-fermented.alcohol-fermented', 'sour-fermented', 'Alcohol/Fermented', 2, 38),
+  ('sour-fermented.alcohol-fermented.winey', 'sour-fermented.alcohol-fermented', 'Winey', 3, 39),
+  ('sour-fermented.alcohol-fermented.whiskey', 'sour-fermented.alcohol-fermented', 'Whiskey', 3, 40),
+  ('sour-fermented.alcohol-fermented.fermented', 'sour-fermented.alcohol-fermented', 'Fermented', 3, 41),
+  ('sour-fermented.alcohol-fermented.overripe', 'sour-fermented.alcohol-fermented', 'Overripe', 3, 42),
+  ('green-vegetative', NULL, 'Green/Vegetative', 1, 43),
+  ('green-vegetative.olive-oil', 'green-vegetative', 'Olive Oil', 2, 44),
+  ('green-vegetative.raw', 'green-vegetative', 'Raw', 2, 45),
+  ('green-vegetative.green-vegetative', 'green-vegetative', 'Green/Vegetative', 2, 46),
+  ('green-vegetative.green-vegetative.under-ripe', 'green-vegetative.green-vegetative', 'Under-ripe', 3, 47),
+  ('green-vegetative.green-vegetative.peapod', 'green-vegetative.green-vegetative', 'Peapod', 3, 48),
+  ('green-vegetative.green-vegetative.fresh', 'green-vegetative.green-vegetative', 'Fresh', 3, 49),
+  ('green-vegetative.green-vegetative.dark-green', 'green-vegetative.green-vegetative', 'Dark Green', 3, 50),
+  ('green-vegetative.green-vegetative.vegetative', 'green-vegetative.green-vegetative', 'Vegetative', 3, 51),
+  ('green-vegetative.green-vegetative.hay-like', 'green-vegetative.green-vegetative', 'Hay-like', 3, 52),
+  ('green-vegetative.green-vegetative.herb-like', 'green-vegetative.green-vegetative', 'Herb-like', 3, 53),
+  ('green-vegetative.beany', 'green-vegetative', 'Beany', 2, 54),
+  ('other', NULL, 'Other', 1, 55),
+  ('other.papery-musty', 'other', 'Papery/Musty', 2, 56),
+  ('other.papery-musty.stale', 'other.papery-musty', 'Stale', 3, 57),
+  ('other.papery-musty.cardboard', 'other.papery-musty', 'Cardboard', 3, 58),
+  ('other.papery-musty.papery', 'other.papery-musty', 'Papery', 3, 59),
+  ('other.papery-musty.woody', 'other.papery-musty', 'Woody', 3, 60),
+  ('other.papery-musty.moldy-damp', 'other.papery-musty', 'Moldy/Damp', 3, 61),
+  ('other.papery-musty.musty-dusty', 'other.papery-musty', 'Musty/Dusty', 3, 62),
+  ('other.papery-musty.musty-earthy', 'other.papery-musty', 'Musty/Earthy', 3, 63),
+  ('other.papery-musty.animalic', 'other.papery-musty', 'Animalic', 3, 64),
+  ('other.papery-musty.meaty-brothy', 'other.papery-musty', 'Meaty Brothy', 3, 65),
+  ('other.papery-musty.phenolic', 'other.papery-musty', 'Phenolic', 3, 66),
+  ('other.chemical', 'other', 'Chemical', 2, 67),
+  ('other.chemical.bitter', 'other.chemical', 'Bitter', 3, 68),
+  ('other.chemical.salty', 'other.chemical', 'Salty', 3, 69),
+  ('other.chemical.medicinal', 'other.chemical', 'Medicinal', 3, 70),
+  ('other.chemical.petroleum', 'other.chemical', 'Petroleum', 3, 71),
+  ('other.chemical.skunky', 'other.chemical', 'Skunky', 3, 72),
+  ('other.chemical.rubber', 'other.chemical', 'Rubber', 3, 73),
+  ('roasted', NULL, 'Roasted', 1, 74),
+  ('roasted.pipe-tobacco', 'roasted', 'Pipe Tobacco', 2, 75),
+  ('roasted.tobacco', 'roasted', 'Tobacco', 2, 76),
+  ('roasted.burnt', 'roasted', 'Burnt', 2, 77),
+  ('roasted.burnt.acrid', 'roasted.burnt', 'Acrid', 3, 78),
+  ('roasted.burnt.ashy', 'roasted.burnt', 'Ashy', 3, 79),
+  ('roasted.burnt.smoky', 'roasted.burnt', 'Smoky', 3, 80),
+  ('roasted.burnt.brown-roast', 'roasted.burnt', 'Brown, Roast', 3, 81),
+  ('roasted.cereal', 'roasted', 'Cereal', 2, 82),
+  ('roasted.cereal.grain', 'roasted.cereal', 'Grain', 3, 83),
+  ('roasted.cereal.malt', 'roasted.cereal', 'Malt', 3, 84),
+  ('spices', NULL, 'Spices', 1, 85),
+  ('spices.pungent', 'spices', 'Pungent', 2, 86),
+  ('spices.pepper', 'spices', 'Pepper', 2, 87),
+  ('spices.brown-spice', 'spices', 'Brown Spice', 2, 88),
+  ('spices.brown-spice.anise', 'spices.brown-spice', 'Anise', 3, 89),
+  ('spices.brown-spice.nutmeg', 'spices.brown-spice', 'Nutmeg', 3, 90),
+  ('spices.brown-spice.cinnamon', 'spices.brown-spice', 'Cinnamon', 3, 91),
+  ('spices.brown-spice.clove', 'spices.brown-spice', 'Clove', 3, 92),
+  ('nutty-cocoa', NULL, 'Nutty/Cocoa', 1, 93),
+  ('nutty-cocoa.nutty', 'nutty-cocoa', 'Nutty', 2, 94),
+  ('nutty-cocoa.nutty.peanuts', 'nutty-cocoa.nutty', 'Peanuts', 3, 95),
+  ('nutty-cocoa.nutty.hazelnut', 'nutty-cocoa.nutty', 'Hazelnut', 3, 96),
+  ('nutty-cocoa.nutty.almond', 'nutty-cocoa.nutty', 'Almond', 3, 97),
+  ('nutty-cocoa.cocoa', 'nutty-cocoa', 'Cocoa', 2, 98),
+  ('nutty-cocoa.cocoa.chocolate', 'nutty-cocoa.cocoa', 'Chocolate', 3, 99),
+  ('nutty-cocoa.cocoa.dark-chocolate', 'nutty-cocoa.cocoa', 'Dark Chocolate', 3, 100),
+  ('sweet', NULL, 'Sweet', 1, 101),
+  ('sweet.brown-sugar', 'sweet', 'Brown Sugar', 2, 102),
+  ('sweet.brown-sugar.molasses', 'sweet.brown-sugar', 'Molasses', 3, 103),
+  ('sweet.brown-sugar.maple-syrup', 'sweet.brown-sugar', 'Maple Syrup', 3, 104),
+  ('sweet.brown-sugar.caramelized', 'sweet.brown-sugar', 'Caramelized', 3, 105),
+  ('sweet.brown-sugar.honey', 'sweet.brown-sugar', 'Honey', 3, 106),
+  ('sweet.vanilla', 'sweet', 'Vanilla', 2, 107),
+  ('sweet.vanillin', 'sweet', 'Vanillin', 2, 108),
+  ('sweet.overall-sweet', 'sweet', 'Overall Sweet', 2, 109),
+  ('sweet.sweet-aromatics', 'sweet', 'Sweet Aromatics', 2, 110)
+ON CONFLICT (id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS tags (
+  id TEXT NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (user_id, id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tags_name_idx ON tags (user_id, lower(name));
+
+CREATE TABLE IF NOT EXISTS entry_tags (
+  user_id TEXT NOT NULL,
+  entry_id TEXT NOT NULL,
+  tag_id TEXT NOT NULL,
+  PRIMARY KEY (user_id, entry_id, tag_id),
+  FOREIGN KEY (user_id, entry_id) REFERENCES entries(user_id, id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id, tag_id) REFERENCES tags(user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS entry_tags_tag_idx ON entry_tags (user_id, tag_id);
+
+CREATE TABLE IF NOT EXISTS entry_descriptors (
+  user_id TEXT NOT NULL,
+  entry_id TEXT NOT NULL,
+  descriptor_id TEXT NOT NULL REFERENCES flavor_descriptors(id),
+  PRIMARY KEY (user_id, entry_id, descriptor_id),
+  FOREIGN KEY (user_id, entry_id) REFERENCES entries(user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS entry_descriptors_descriptor_idx ON entry_descriptors (user_id, descriptor_id);
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  endpoint TEXT UNIQUE NOT NULL,
+  p256dh TEXT NOT NULL,
+  auth TEXT NOT NULL,
+  created_at DATETIME NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Admin flag set by `user promote`; see the Postgres migration of the same
+-- name.
+ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;
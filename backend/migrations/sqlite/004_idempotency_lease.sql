@@ -0,0 +1,2 @@
+-- Lease on an in-progress key; see the Postgres migration of the same name.
+ALTER TABLE idempotency_keys ADD COLUMN locked_until DATETIME;
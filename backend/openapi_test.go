@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIDoc is the parsed spec. Only the parts the contract check needs
+// are typed; schemas stay generic JSON.
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]interface{} `json:"schemas"`
+		Responses map[string]interface{} `json:"responses"`
+	} `json:"components"`
+}
+
+func parseOpenAPI() (*openAPIDoc, error) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, fmt.Errorf("openapi.json: %w", err)
+	}
+	return &doc, nil
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema interface{} `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]interface{} `json:"responses"`
+}
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "patch"}
+
+func (d *openAPIDoc) operation(method string, path string) (*openAPIOperation, bool) {
+	raw, ok := d.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return nil, false
+	}
+	var op openAPIOperation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil, false
+	}
+	return &op, true
+}
+
+// responseSchema finds the documented response for status (falling back to
+// "default"). hasBody reports whether the response carries JSON at all.
+func (d *openAPIDoc) responseSchema(op *openAPIOperation, status int) (schema interface{}, hasBody bool, err error) {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		if response, ok = op.Responses["default"]; !ok {
+			return nil, false, fmt.Errorf("status %d is not documented", status)
+		}
+	}
+	object, _ := response.(map[string]interface{})
+	if ref, ok := object["$ref"].(string); ok {
+		name, found := strings.CutPrefix(ref, "#/components/responses/")
+		if !found || d.Components.Responses[name] == nil {
+			return nil, false, fmt.Errorf("unresolvable response %s", ref)
+		}
+		object, _ = d.Components.Responses[name].(map[string]interface{})
+	}
+	content, _ := object["content"].(map[string]interface{})
+	if content == nil {
+		return nil, false, nil
+	}
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("status %d has no application/json content", status)
+	}
+	return media["schema"], true, nil
+}
+
+// validate checks value (decoded into generic JSON) against schema. It
+// knows the subset of JSON Schema openapi.json uses and refuses anything
+// else, so a keyword is never silently left unchecked.
+func (d *openAPIDoc) validate(schema interface{}, value interface{}, at string) error {
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: schema is not an object", at)
+	}
+	if ref, ok := object["$ref"].(string); ok {
+		name, found := strings.CutPrefix(ref, "#/components/schemas/")
+		if !found || d.Components.Schemas[name] == nil {
+			return fmt.Errorf("%s: unresolvable schema %s", at, ref)
+		}
+		return d.validate(d.Components.Schemas[name], value, at)
+	}
+
+	for keyword := range object {
+		switch keyword {
+		case "type", "properties", "required", "additionalProperties", "items", "enum",
+			"minimum", "maximum", "multipleOf", "minLength", "maxItems", "format", "description":
+		default:
+			return fmt.Errorf("%s: unsupported schema keyword %q", at, keyword)
+		}
+	}
+
+	if types, ok := object["type"]; ok {
+		allowed := []interface{}{types}
+		if list, ok := types.([]interface{}); ok {
+			allowed = list
+		}
+		matched := false
+		for _, t := range allowed {
+			if jsonHasType(value, t.(string)) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %v, got %s", at, types, jsonValueType(value))
+		}
+	}
+	if enum, ok := object["enum"].([]interface{}); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if min, ok := object["minimum"].(float64); ok && v < min {
+			return fmt.Errorf("%s: %v is below %v", at, v, min)
+		}
+		if max, ok := object["maximum"].(float64); ok && v > max {
+			return fmt.Errorf("%s: %v is above %v", at, v, max)
+		}
+		if step, ok := object["multipleOf"].(float64); ok && !isMultiple(v, step) {
+			return fmt.Errorf("%s: %v is not a multiple of %v", at, v, step)
+		}
+	case string:
+		if min, ok := object["minLength"].(float64); ok && float64(len([]rune(v))) < min {
+			return fmt.Errorf("%s: shorter than %v", at, min)
+		}
+		if object["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", at, v)
+			}
+		}
+	case []interface{}:
+		if max, ok := object["maxItems"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s: more than %v items", at, max)
+		}
+		if items, ok := object["items"]; ok {
+			for i, item := range v {
+				if err := d.validate(items, item, at+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := object["properties"].(map[string]interface{})
+		if required, ok := object["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", at, name)
+				}
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			field := at + "." + name
+			if property, ok := properties[name]; ok {
+				if err := d.validate(property, v[name], field); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := object["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: property is not in the spec", field)
+				}
+			case map[string]interface{}:
+				if err := d.validate(extra, v[name], field); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonHasType(value interface{}, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return jsonValueType(value) == t
+}
+
+func jsonValueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// contractCheck sends requests through the API router as a client would
+// and validates each request and response against the spec.
+type contractCheck struct {
+	doc   *openAPIDoc
+	api   http.Handler
+	token string
+	// seen holds every "METHOD /path" operation a request has reached.
+	seen map[string]bool
+}
+
+// run runs one operation's requests as a subtest named after it. Later
+// operations build on what earlier ones created, so a failure stops the
+// whole check.
+func (c *contractCheck) run(t *testing.T, operation string, fn func(t *testing.T)) {
+	t.Helper()
+	if !t.Run(operation, fn) {
+		t.FailNow()
+	}
+}
+
+// call sends body to method path (relative to /api/v1), expects want and
+// returns the decoded response. Bodies of successful requests must match
+// the documented request schema too; the deliberately broken ones are only
+// checked for their response.
+func (c *contractCheck) call(t *testing.T, method string, path string, body interface{}, want int) interface{} {
+	t.Helper()
+	name := method + " " + path
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contentType := "application/json"
+	if method == http.MethodPatch {
+		contentType = mergePatchType
+	}
+	r := httptest.NewRequest(method, apiV1Prefix+path, bytes.NewReader(payload))
+	if body != nil {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	w := httptest.NewRecorder()
+	c.api.ServeHTTP(w, r)
+
+	route, found := strings.CutPrefix(strings.TrimPrefix(r.Pattern, method+" "), apiV1Prefix)
+	if r.Pattern == "" || !found {
+		t.Fatalf("%s: no route matched", name)
+	}
+	op, ok := c.doc.operation(method, route)
+	if !ok {
+		t.Fatalf("%s: %s %s is not in the spec", name, method, route)
+	}
+	c.seen[method+" "+route] = true
+
+	if w.Code != want {
+		t.Fatalf("%s: status %d, want %d: %s", name, w.Code, want, strings.TrimSpace(w.Body.String()))
+	}
+	if body != nil && want < 300 {
+		if op.RequestBody == nil {
+			t.Fatalf("%s: request body is not in the spec", name)
+		}
+		var decoded interface{}
+		json.Unmarshal(payload, &decoded)
+		if err := c.doc.validate(op.RequestBody.Content[contentType].Schema, decoded, "request"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	schema, hasBody, err := c.doc.responseSchema(op, w.Code)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if !hasBody {
+		if w.Body.Len() != 0 {
+			t.Fatalf("%s: status %d should have no body", name, w.Code)
+		}
+		return nil
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("%s: Content-Type %q", name, ct)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("%s: response is not JSON: %v", name, err)
+	}
+	if err := c.doc.validate(schema, decoded, "response"); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return decoded
+}
+
+// TestOpenAPI exercises every documented operation through the real
+// handlers with a throwaway account, then fails if any operation in the
+// spec was never reached.
+func TestOpenAPI(t *testing.T) {
+	forEachStore(t, testOpenAPI)
+}
+
+func testOpenAPI(t *testing.T, store Store) {
+	t.Helper()
+	doc, err := parseOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		JWTSecret:     newToken(),
+		JWTIssuer:     jwtIssuerDefault,
+		UploadsDir:    t.TempDir(),
+		PhotoMaxBytes: defaultPhotoMaxBytes,
+	}
+	blobs, err := newBlobStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newAPIRouter()
+	registerAPIRoutes(api, cfg, store, blobs, newEventHub(store.DB()))
+	c := &contractCheck{doc: doc, api: api, seen: map[string]bool{}}
+
+	email := "openapi-check-" + newID() + "@example.invalid"
+	credentials := AuthRequest{Email: email, Password: "openapi-check"}
+	var userID string
+	t.Cleanup(func() {
+		if userID == "" {
+			return
+		}
+		if deleted, err := store.DeleteUser(context.Background(), userID); err != nil || !deleted {
+			t.Errorf("delete user: deleted=%v err=%v", deleted, err)
+		}
+	})
+	c.run(t, "POST /auth/register", func(t *testing.T) {
+		c.call(t, "POST", "/auth/register", AuthRequest{Email: email, Password: "short"}, http.StatusBadRequest)
+		registered := c.call(t, "POST", "/auth/register", credentials, http.StatusCreated).(map[string]interface{})
+		userID = registered["user"].(map[string]interface{})["id"].(string)
+		c.call(t, "POST", "/auth/register", credentials, http.StatusConflict)
+	})
+	c.run(t, "POST /auth/login", func(t *testing.T) {
+		c.call(t, "POST", "/auth/login", AuthRequest{Email: email, Password: "wrong-password"}, http.StatusUnauthorized)
+		loggedIn := c.call(t, "POST", "/auth/login", credentials, http.StatusOK).(map[string]interface{})
+		c.token = loggedIn["token"].(string)
+	})
+
+	input := map[string]interface{}{
+		"beans":       "Contract Check",
+		"brew_method": "v60",
+		"notes":       "checked against openapi.json",
+		"rating":      4,
+		"brewed_at":   time.Now().UTC().Format(time.RFC3339),
+		"cupping": CuppingScore{
+			Fragrance: 7.5, Flavor: 7.75, Aftertaste: 7.25, Acidity: 7.5, Body: 7.5,
+			Balance: 7.5, Uniformity: 10, CleanCup: 10, Sweetness: 10, Overall: 7.5,
+		},
+	}
+	var entryID string
+	c.run(t, "POST /entries", func(t *testing.T) {
+		c.call(t, "POST", "/entries", map[string]interface{}{"rating": 9}, http.StatusBadRequest)
+		created := c.call(t, "POST", "/entries", input, http.StatusCreated).(map[string]interface{})
+		entryID = created["id"].(string)
+	})
+	c.run(t, "GET /entries", func(t *testing.T) {
+		c.call(t, "GET", "/entries", nil, http.StatusOK)
+		token := c.token
+		c.token = ""
+		c.call(t, "GET", "/entries", nil, http.StatusUnauthorized)
+		c.token = token
+	})
+	c.run(t, "PUT /entries/{id}", func(t *testing.T) {
+		input["notes"] = "updated"
+		c.call(t, "PUT", "/entries/"+entryID, input, http.StatusOK)
+		c.call(t, "PUT", "/entries/"+newID(), input, http.StatusNotFound)
+	})
+	c.run(t, "PATCH /entries/{id}", func(t *testing.T) {
+		patch := map[string]interface{}{"rating": 5, "notes": nil, "cupping": map[string]interface{}{"overall": 8}}
+		c.call(t, "PATCH", "/entries/"+entryID, patch, http.StatusOK)
+		c.call(t, "PATCH", "/entries/"+entryID, map[string]interface{}{"beans": nil}, http.StatusBadRequest)
+		c.call(t, "PATCH", "/entries/"+newID(), patch, http.StatusNotFound)
+	})
+	c.run(t, "DELETE /entries/{id}", func(t *testing.T) {
+		c.call(t, "DELETE", "/entries/"+entryID, nil, http.StatusNoContent)
+		c.call(t, "DELETE", "/entries/"+entryID, nil, http.StatusNotFound)
+	})
+
+	subscription := PushSubscription{
+		Endpoint: "https://push.example.invalid/" + newID(),
+		Keys:     PushKeys{P256dh: "openapi-check", Auth: "openapi-check"},
+	}
+	c.run(t, "GET /push/config", func(t *testing.T) {
+		c.call(t, "GET", "/push/config", nil, http.StatusOK)
+	})
+	c.run(t, "POST /push/subscribe", func(t *testing.T) {
+		c.call(t, "POST", "/push/subscribe", subscription, http.StatusCreated)
+	})
+	c.run(t, "POST /push/test", func(t *testing.T) {
+		c.call(t, "POST", "/push/test", nil, http.StatusNotImplemented)
+	})
+	c.run(t, "DELETE /push/unsubscribe", func(t *testing.T) {
+		c.call(t, "DELETE", "/push/unsubscribe", map[string]string{"endpoint": ""}, http.StatusBadRequest)
+		c.call(t, "DELETE", "/push/unsubscribe", map[string]string{"endpoint": subscription.Endpoint}, http.StatusNoContent)
+	})
+
+	var missed []string
+	for _, path := range sortedKeys(doc.Paths) {
+		for _, method := range openAPIMethods {
+			if _, ok := doc.Paths[path][method]; ok && !c.seen[strings.ToUpper(method)+" "+path] {
+				missed = append(missed, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	if len(missed) > 0 {
+		t.Errorf("never exercised: %s", strings.Join(missed, ", "))
+	}
+}
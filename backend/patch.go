@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// entryPatchFields are the EntryInput fields a merge patch may set. id is
+// left out: it names the entry rather than describing it.
+var entryPatchFields = []string{
+	"beans", "brew_method", "notes", "rating", "brewed_at",
+	"grinder_id", "brewer_id", "bean_id", "descriptors", "tags", "cupping",
+}
+
+// handlePatchEntry applies an RFC 7396 JSON Merge Patch to an entry: the
+// patch is merged into the entry as it is stored, the result is validated
+// as a whole, and only the fields the patch names are written.
+func handlePatchEntry(w http.ResponseWriter, r *http.Request, store Store, userID string) {
+	patch, err := readMergePatch(w, r)
+	if err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	entry, found, err := store.PatchEntry(r.Context(), userID, r.PathValue("id"), patch)
+	if err != nil {
+		writeServerError(w, r, "failed to update entry", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "entry not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// readMergePatch reads a merge patch body. Plain application/json is
+// accepted too, since a patch document is JSON either way.
+func readMergePatch(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != mergePatchType && mediaType != "application/json") {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		return nil, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type must be "+mergePatchType)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	var patch interface{}
+	if err := dec.Decode(&patch); err != nil {
+		return nil, decodeError(err)
+	}
+	if dec.More() {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidJSON, "request body must be a single JSON value")
+	}
+	object, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidJSON, "merge patch must be a JSON object")
+	}
+	return object, nil
+}
+
+// mergeEntryPatch merges patch into entry and returns the result along
+// with the fields the patch touched.
+func mergeEntryPatch(entry Entry, patch map[string]interface{}) (EntryInput, []string, error) {
+	if id, ok := patch["id"]; ok {
+		if id != entry.ID {
+			return EntryInput{}, nil, fieldError("id", "id cannot be changed")
+		}
+		delete(patch, "id")
+	}
+
+	data, err := json.Marshal(EntryInput{
+		Beans:       entry.Beans,
+		BrewMethod:  entry.BrewMethod,
+		Notes:       entry.Notes,
+		Rating:      entry.Rating,
+		BrewedAt:    entry.BrewedAt,
+		GrinderID:   entry.GrinderID,
+		BrewerID:    entry.BrewerID,
+		BeanID:      entry.BeanID,
+		Descriptors: entry.Descriptors,
+		Tags:        entry.Tags,
+		Cupping:     entry.Cupping,
+	})
+	if err != nil {
+		return EntryInput{}, nil, err
+	}
+	var target interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&target); err != nil {
+		return EntryInput{}, nil, err
+	}
+	if data, err = json.Marshal(mergePatch(target, patch)); err != nil {
+		return EntryInput{}, nil, err
+	}
+
+	var input EntryInput
+	dec = json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return EntryInput{}, nil, decodeError(err)
+	}
+	input.ID = entry.ID
+	fields := []string{}
+	for _, field := range entryPatchFields {
+		if _, ok := patch[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	return input, fields, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch to target: objects merge
+// member by member, null removes a member and anything else replaces the
+// target outright.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// entryRefsValidator checks an entry's references on the querier it is
+// given, so a patch can validate them inside its transaction.
+type entryRefsValidator func(ctx context.Context, q querier, userID string, input EntryInput) error
+
+// patchEntry merges patch into the stored entry, validates the result and
+// writes only the fields the patch names, reading the row back through
+// RETURNING with the dialect's select list. lock is appended to the read
+// so that no other write lands between it and the update; the merge is
+// never based on a stale row. Tags and descriptors live in join tables,
+// so they are replaced first for the RETURNING aggregates to see them.
+func patchEntry(ctx context.Context, tx *sql.Tx, columns string, lock string, validateRefs entryRefsValidator, userID string, id string, patch map[string]interface{}) (Entry, bool, error) {
+	id, err := normalizeID(id)
+	if err != nil {
+		return Entry{}, false, nil
+	}
+	current, err := scanEntry(tx.QueryRowContext(ctx,
+		`SELECT `+columns+` FROM entries WHERE user_id = $1 AND id = $2`+lock, userID, id))
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	input, fields, err := mergeEntryPatch(current, patch)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if err := validateEntry(input); err != nil {
+		return Entry{}, false, err
+	}
+	if err := validateRefs(ctx, tx, userID, input); err != nil {
+		return Entry{}, false, err
+	}
+
+	args := []interface{}{time.Now().UTC()}
+	sets := []string{"updated_at = $1"}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+	for _, field := range fields {
+		switch field {
+		case "beans":
+			set("beans", input.Beans)
+		case "brew_method":
+			brewMethod, err := entryBrewMethod(ctx, tx, userID, input.BrewMethod)
+			if err != nil {
+				return Entry{}, false, err
+			}
+			set("brew_method", brewMethod)
+		case "notes":
+			set("notes", input.Notes)
+		case "rating":
+			set("rating", input.Rating)
+		case "brewed_at":
+			brewed, _ := time.Parse(time.RFC3339, input.BrewedAt)
+			set("brewed_at", brewed.UTC())
+		case "grinder_id":
+			set("grinder_id", nullString(input.GrinderID))
+		case "brewer_id":
+			set("brewer_id", nullString(input.BrewerID))
+		case "bean_id":
+			set("bean_id", nullString(input.BeanID))
+		case "cupping":
+			cupping, total, err := cuppingColumns(input.Cupping)
+			if err != nil {
+				return Entry{}, false, err
+			}
+			set("cupping", cupping)
+			set("cupping_total", total)
+		case "tags":
+			if err := setEntryTags(ctx, tx, userID, id, append([]string{}, input.Tags...)); err != nil {
+				return Entry{}, false, err
+			}
+		case "descriptors":
+			if err := setEntryDescriptors(ctx, tx, userID, id, append([]string{}, input.Descriptors...)); err != nil {
+				return Entry{}, false, err
+			}
+		}
+	}
+
+	args = append(args, userID, id)
+	row := tx.QueryRowContext(ctx,
+		`UPDATE entries SET `+strings.Join(sets, ", ")+`
+		 WHERE user_id = $`+strconv.Itoa(len(args)-1)+` AND id = $`+strconv.Itoa(len(args))+`
+		 RETURNING `+columns,
+		args...,
+	)
+	entry, err := scanEntry(row)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	defaultPhotoMaxBytes = 10 << 20
+	maxPhotoPixels       = 50_000_000
+	thumbSize            = 400
+)
+
+var allowedPhotoTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+var errPhotoTooLarge = errors.New("photo is too large")
+
+type Photo struct {
+	ID           string `json:"id"`
+	EntryID      string `json:"entry_id"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	SizeBytes    int64  `json:"size_bytes"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	CreatedAt    string `json:"created_at"`
+	originalKey  string
+	thumbKey     string
+}
+
+func handleListPhotos(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	entryID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	photos, err := listPhotos(r.Context(), db, userID, entryID)
+	if err != nil {
+		writeServerError(w, r, "failed to load photos", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, photos)
+}
+
+func handleUploadPhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, blobs BlobStore, cfg Config, userID string) {
+	entryID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	exists, err := entryExists(r.Context(), db, userID, entryID)
+	if err != nil {
+		writeServerError(w, r, "failed to load entry", err)
+		return
+	}
+	if !exists {
+		writeError(w, r, http.StatusNotFound, "entry not found")
+		return
+	}
+	data, err := readPhotoUpload(w, r, cfg.PhotoMaxBytes)
+	if errors.Is(err, errPhotoTooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	photo, err := createPhoto(r.Context(), db, blobs, userID, entryID, data)
+	if err != nil {
+		writeServerError(w, r, "failed to save photo", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, photo)
+}
+
+// pathPhoto reads the {id} and {photo_id} wildcards of a photo route.
+func pathPhoto(w http.ResponseWriter, r *http.Request) (entryID string, photoID string, ok bool) {
+	entryID, ok = pathID(w, r)
+	if !ok {
+		return "", "", false
+	}
+	photoID, err := normalizeID(r.PathValue("photo_id"))
+	if err != nil {
+		writeInvalid(w, r, err)
+		return "", "", false
+	}
+	return entryID, photoID, true
+}
+
+func handleGetPhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, blobs BlobStore, userID string) {
+	entryID, photoID, ok := pathPhoto(w, r)
+	if !ok {
+		return
+	}
+	photo, found, err := getPhoto(r.Context(), db, userID, entryID, photoID)
+	if err != nil {
+		writeServerError(w, r, "failed to load photo", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "photo not found")
+		return
+	}
+	servePhoto(w, r, blobs, photo, r.URL.Query().Get("size") == "thumb")
+}
+
+func handleDeletePhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, blobs BlobStore, userID string) {
+	entryID, photoID, ok := pathPhoto(w, r)
+	if !ok {
+		return
+	}
+	photo, found, err := deletePhoto(r.Context(), db, userID, entryID, photoID)
+	if err != nil {
+		writeServerError(w, r, "failed to delete photo", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "photo not found")
+		return
+	}
+	removeBlobs(r.Context(), blobs, []string{photo.originalKey, photo.thumbKey})
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// readPhotoUpload streams the "photo" field of a multipart body, enforcing
+// maxBytes on the file itself rather than buffering the whole form.
+func readPhotoUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "expected multipart/form-data body")
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fieldError("photo", "photo field is required")
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, errPhotoTooLarge
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "malformed multipart body")
+		}
+		if part.FormName() != "photo" {
+			part.Close()
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		part.Close()
+		if errors.As(err, &maxErr) {
+			return nil, errPhotoTooLarge
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "photo upload could not be read")
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, errPhotoTooLarge
+		}
+		if len(data) == 0 {
+			return nil, fieldError("photo", "photo is empty")
+		}
+		return data, nil
+	}
+}
+
+func createPhoto(ctx context.Context, db *sql.DB, blobs BlobStore, userID string, entryID string, data []byte) (Photo, error) {
+	contentType := http.DetectContentType(data)
+	if !allowedPhotoTypes[contentType] {
+		return Photo{}, fieldError("photo", "photo must be a JPEG, PNG or WebP image")
+	}
+
+	full, thumb, outType, width, height, err := processPhoto(data)
+	if err != nil {
+		return Photo{}, err
+	}
+
+	now := time.Now().UTC()
+	photo := Photo{
+		ID:          newID(),
+		EntryID:     entryID,
+		ContentType: outType,
+		Width:       width,
+		Height:      height,
+		SizeBytes:   int64(len(full)),
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+	ext := ".jpg"
+	if outType == "image/png" {
+		ext = ".png"
+	}
+	photo.originalKey = userID + "/" + photo.ID + ext
+	photo.thumbKey = userID + "/" + photo.ID + "_thumb.jpg"
+	photo.URL, photo.ThumbnailURL = photoURLs(entryID, photo.ID)
+
+	if err := blobs.Put(ctx, photo.originalKey, outType, full); err != nil {
+		return Photo{}, fmt.Errorf("store photo %s: %w", photo.originalKey, err)
+	}
+	if err := blobs.Put(ctx, photo.thumbKey, "image/jpeg", thumb); err != nil {
+		removeBlobs(ctx, blobs, []string{photo.originalKey})
+		return Photo{}, fmt.Errorf("store thumbnail %s: %w", photo.thumbKey, err)
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO photos (id, user_id, entry_id, content_type, width, height, size_bytes, original_key, thumb_key, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		photo.ID, userID, entryID, photo.ContentType, photo.Width, photo.Height, photo.SizeBytes,
+		photo.originalKey, photo.thumbKey, now,
+	)
+	if err != nil {
+		removeBlobs(ctx, blobs, []string{photo.originalKey, photo.thumbKey})
+		return Photo{}, err
+	}
+	return photo, nil
+}
+
+// processPhoto decodes the upload and re-encodes it from raw pixels, which
+// drops EXIF (including GPS), XMP and any other embedded metadata. The EXIF
+// orientation is applied first so phone photos keep their rotation.
+func processPhoto(data []byte) ([]byte, []byte, string, int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", 0, 0, fieldError("photo", "photo could not be decoded")
+	}
+	if cfg.Width*cfg.Height > maxPhotoPixels {
+		return nil, nil, "", 0, 0, fieldError("photo", "photo dimensions are too large")
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", 0, 0, fieldError("photo", "photo could not be decoded")
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	var full bytes.Buffer
+	outType := "image/jpeg"
+	if format == "png" {
+		outType = "image/png"
+		err = png.Encode(&full, img)
+	} else {
+		err = jpeg.Encode(&full, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, nil, "", 0, 0, fmt.Errorf("encode photo: %w", err)
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(img, thumbSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, nil, "", 0, 0, fmt.Errorf("encode thumbnail: %w", err)
+	}
+
+	bounds := img.Bounds()
+	return full.Bytes(), thumb.Bytes(), outType, bounds.Dx(), bounds.Dy(), nil
+}
+
+// thumbnail scales img to fit within a size x size box on a white background.
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			h = max(1, h*size/w)
+			w = size
+		} else {
+			w = max(1, w*size/h)
+			h = size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation tag (1-8) of a JPEG, or 1
+// when it is absent or unreadable.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for k := 0; k < count; k++ {
+		entry := offset + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func servePhoto(w http.ResponseWriter, r *http.Request, blobs BlobStore, photo Photo, thumb bool) {
+	key, contentType, etag := photo.originalKey, photo.ContentType, `"`+photo.ID+`"`
+	if thumb {
+		key, contentType, etag = photo.thumbKey, "image/jpeg", `"`+photo.ID+`-thumb"`
+	}
+
+	// Photos are immutable once stored, so the ID doubles as a validator.
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Authorization")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := blobs.Get(r.Context(), key)
+	if errors.Is(err, errBlobNotFound) {
+		writeError(w, r, http.StatusNotFound, "photo not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, "failed to load photo", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, body)
+}
+
+func photoURLs(entryID string, photoID string) (string, string) {
+	url := fmt.Sprintf(apiV1Prefix+"/entries/%s/photos/%s", entryID, photoID)
+	return url, url + "?size=thumb"
+}
+
+func entryExists(ctx context.Context, db *sql.DB, userID string, entryID string) (bool, error) {
+	var id string
+	err := db.QueryRowContext(ctx, "SELECT id FROM entries WHERE user_id = $1 AND id = $2", userID, entryID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func listPhotos(ctx context.Context, db *sql.DB, userID string, entryID string) ([]Photo, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, entry_id, content_type, width, height, size_bytes, original_key, thumb_key, created_at
+		 FROM photos
+		 WHERE user_id = $1 AND entry_id = $2
+		 ORDER BY created_at`,
+		userID, entryID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+func getPhoto(ctx context.Context, db *sql.DB, userID string, entryID string, photoID string) (Photo, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`SELECT id, entry_id, content_type, width, height, size_bytes, original_key, thumb_key, created_at
+		 FROM photos
+		 WHERE user_id = $1 AND entry_id = $2 AND id = $3`,
+		userID, entryID, photoID,
+	)
+	photo, err := scanPhoto(row)
+	if err == sql.ErrNoRows {
+		return Photo{}, false, nil
+	}
+	if err != nil {
+		return Photo{}, false, err
+	}
+	return photo, true, nil
+}
+
+func deletePhoto(ctx context.Context, db *sql.DB, userID string, entryID string, photoID string) (Photo, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`DELETE FROM photos
+		 WHERE user_id = $1 AND entry_id = $2 AND id = $3
+		 RETURNING id, entry_id, content_type, width, height, size_bytes, original_key, thumb_key, created_at`,
+		userID, entryID, photoID,
+	)
+	photo, err := scanPhoto(row)
+	if err == sql.ErrNoRows {
+		return Photo{}, false, nil
+	}
+	if err != nil {
+		return Photo{}, false, err
+	}
+	return photo, true, nil
+}
+
+// entryPhotoKeys lists the blob keys belonging to an entry so they can be
+// removed once the entry (and, by cascade, its photo rows) is deleted.
+func entryPhotoKeys(ctx context.Context, db *sql.DB, userID string, entryID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT original_key, thumb_key FROM photos WHERE user_id = $1 AND entry_id = $2",
+		userID, entryID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var original, thumb string
+		if err := rows.Scan(&original, &thumb); err != nil {
+			return nil, err
+		}
+		keys = append(keys, original, thumb)
+	}
+	return keys, rows.Err()
+}
+
+func removeBlobs(ctx context.Context, blobs BlobStore, keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			logger(ctx).Warn("failed to remove blob", "key", key, "err", err)
+		}
+	}
+}
+
+func scanPhoto(row rowScanner) (Photo, error) {
+	var photo Photo
+	var created time.Time
+	if err := row.Scan(
+		&photo.ID,
+		&photo.EntryID,
+		&photo.ContentType,
+		&photo.Width,
+		&photo.Height,
+		&photo.SizeBytes,
+		&photo.originalKey,
+		&photo.thumbKey,
+		&created,
+	); err != nil {
+		return Photo{}, err
+	}
+	photo.CreatedAt = created.UTC().Format(time.RFC3339)
+	photo.URL, photo.ThumbnailURL = photoURLs(photo.EntryID, photo.ID)
+	return photo, nil
+}
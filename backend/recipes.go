@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxPourSteps = 50
+
+// PourStep is one stage of a pour schedule: add Water grams at AtSeconds
+// after the brew starts.
+type PourStep struct {
+	AtSeconds int     `json:"at_seconds"`
+	Water     float64 `json:"water"`
+	Note      string  `json:"note"`
+}
+
+// Recipe doses and water are in grams, temperature in degrees Celsius.
+// Version increases whenever a brew parameter changes.
+type Recipe struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Method      string     `json:"method"`
+	Dose        float64    `json:"dose"`
+	Water       float64    `json:"water"`
+	Grind       string     `json:"grind"`
+	Temperature float64    `json:"temperature"`
+	Steps       []PourStep `json:"steps"`
+	Notes       string     `json:"notes"`
+	Version     int        `json:"version"`
+	CreatedAt   string     `json:"created_at"`
+	UpdatedAt   string     `json:"updated_at"`
+}
+
+type RecipeInput struct {
+	ID          string     `json:"id,omitempty"`
+	Name        string     `json:"name"`
+	Method      string     `json:"method"`
+	Dose        float64    `json:"dose"`
+	Water       float64    `json:"water"`
+	Grind       string     `json:"grind"`
+	Temperature float64    `json:"temperature"`
+	Steps       []PourStep `json:"steps"`
+	Notes       string     `json:"notes"`
+}
+
+// RecipeVersionStats summarises the entries brewed from one recipe version.
+type RecipeVersionStats struct {
+	Version       int        `json:"version"`
+	Method        string     `json:"method"`
+	Dose          float64    `json:"dose"`
+	Water         float64    `json:"water"`
+	Grind         string     `json:"grind"`
+	Temperature   float64    `json:"temperature"`
+	Steps         []PourStep `json:"steps"`
+	Brews         int        `json:"brews"`
+	AverageRating float64    `json:"average_rating"`
+	FirstBrewedAt string     `json:"first_brewed_at,omitempty"`
+	LastBrewedAt  string     `json:"last_brewed_at,omitempty"`
+}
+
+const recipeColumns = `id, name, method, dose, water, grind, temperature, steps, notes, version, created_at, updated_at`
+
+func handleListRecipes(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	recipes, err := listRecipes(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load recipes", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recipes)
+}
+
+func handleCreateRecipe(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input RecipeInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateRecipe(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	recipe, err := createRecipe(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save recipe", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, recipe)
+}
+
+func handleGetRecipe(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	recipe, found, err := getRecipe(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load recipe", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "recipe not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, recipe)
+}
+
+func handleUpdateRecipe(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input RecipeInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateRecipe(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	recipe, found, err := updateRecipe(r.Context(), db, userID, id, input)
+	if err != nil {
+		writeServerError(w, r, "failed to update recipe", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "recipe not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, recipe)
+}
+
+func handleDeleteRecipe(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM recipes WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to delete recipe", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "recipe not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleRecipeStats(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	stats, found, err := recipeStats(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load recipe stats", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "recipe not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleBrewRecipe creates an entry from a recipe. The body is an
+// EntryInput in which brew_method, notes and brewed_at may be omitted; they
+// default to the recipe's method and notes and the current time.
+func handleBrewRecipe(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	recipe, found, err := getRecipe(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load recipe", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "recipe not found")
+		return
+	}
+
+	var input EntryInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if strings.TrimSpace(input.BrewMethod) == "" {
+		input.BrewMethod = recipe.Method
+	}
+	if strings.TrimSpace(input.Notes) == "" {
+		input.Notes = recipe.Notes
+	}
+	if strings.TrimSpace(input.BrewedAt) == "" {
+		input.BrewedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	input.recipeID = recipe.ID
+	input.recipeVersion = recipe.Version
+
+	if err := validateEntry(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateEntryRefs(r.Context(), db, userID, input); err != nil {
+		writeServerError(w, r, "failed to check entry references", err)
+		return
+	}
+	entry, err := upsertEntry(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save entry", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+func validateRecipe(input RecipeInput) error {
+	fields := fieldErrors{}
+	fields.id("id", input.ID)
+	if strings.TrimSpace(input.Name) == "" {
+		fields.add("name", "name is required")
+	}
+	if normalizeBrewMethod(input.Method) == "" {
+		fields.add("method", "method is required")
+	}
+	if input.Dose <= 0 || input.Dose > 1000 {
+		fields.add("dose", "dose must be between 0 and 1000 grams")
+	}
+	if input.Water < 0 || input.Water > 10000 {
+		fields.add("water", "water must be between 0 and 10000 grams")
+	}
+	if input.Temperature < 0 || input.Temperature > 100 {
+		fields.add("temperature", "temperature must be between 0 and 100 °C")
+	}
+	if len(input.Steps) > maxPourSteps {
+		fields.add("steps", "too many pour steps")
+	}
+	last := 0
+	for _, step := range input.Steps {
+		if step.AtSeconds < last {
+			fields.add("steps", "pour steps must be in chronological order")
+		}
+		if step.Water < 0 {
+			fields.add("steps", "pour step water cannot be negative")
+		}
+		last = step.AtSeconds
+	}
+	return fields.err()
+}
+
+func listRecipes(ctx context.Context, db *sql.DB, userID string) ([]Recipe, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+recipeColumns+`
+		 FROM recipes
+		 WHERE user_id = $1
+		 ORDER BY name`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipes := []Recipe{}
+	for rows.Next() {
+		recipe, err := scanRecipe(rows)
+		if err != nil {
+			return nil, err
+		}
+		recipes = append(recipes, recipe)
+	}
+	return recipes, rows.Err()
+}
+
+func getRecipe(ctx context.Context, db *sql.DB, userID string, id string) (Recipe, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`SELECT `+recipeColumns+` FROM recipes WHERE user_id = $1 AND id = $2`,
+		userID, id,
+	)
+	recipe, err := scanRecipe(row)
+	if err == sql.ErrNoRows {
+		return Recipe{}, false, nil
+	}
+	if err != nil {
+		return Recipe{}, false, err
+	}
+	return recipe, true, nil
+}
+
+func createRecipe(ctx context.Context, db *sql.DB, userID string, input RecipeInput) (Recipe, error) {
+	id, err := normalizeID(input.ID)
+	if err != nil {
+		return Recipe{}, err
+	}
+	if id == "" {
+		id = newID()
+	}
+	steps, err := marshalSteps(input.Steps)
+	if err != nil {
+		return Recipe{}, err
+	}
+	now := time.Now().UTC()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Recipe{}, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		`INSERT INTO recipes (id, user_id, name, method, dose, water, grind, temperature, steps, notes, version, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 1, $11, $11)
+		 RETURNING `+recipeColumns,
+		id, userID, strings.TrimSpace(input.Name), normalizeBrewMethod(input.Method), input.Dose, input.Water,
+		strings.TrimSpace(input.Grind), input.Temperature, steps, input.Notes, now,
+	)
+	recipe, err := scanRecipe(row)
+	if err != nil {
+		return Recipe{}, err
+	}
+	if err := snapshotRecipeVersion(ctx, tx, userID, recipe, now); err != nil {
+		return Recipe{}, err
+	}
+	return recipe, tx.Commit()
+}
+
+// updateRecipe saves input and bumps the version when any brew parameter
+// changed; renaming a recipe or editing its notes keeps the current version.
+func updateRecipe(ctx context.Context, db *sql.DB, userID string, id string, input RecipeInput) (Recipe, bool, error) {
+	steps, err := marshalSteps(input.Steps)
+	if err != nil {
+		return Recipe{}, false, err
+	}
+	now := time.Now().UTC()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Recipe{}, false, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		`UPDATE recipes
+		 SET name = $1, method = $2, dose = $3, water = $4, grind = $5, temperature = $6, steps = $7, notes = $8,
+		     updated_at = $9,
+		     version = CASE
+		       WHEN (method, dose, water, grind, temperature, steps) IS DISTINCT FROM ($2, $3, $4, $5, $6, $7::jsonb)
+		       THEN version + 1 ELSE version END
+		 WHERE user_id = $10 AND id = $11
+		 RETURNING `+recipeColumns,
+		strings.TrimSpace(input.Name), normalizeBrewMethod(input.Method), input.Dose, input.Water,
+		strings.TrimSpace(input.Grind), input.Temperature, steps, input.Notes, now, userID, id,
+	)
+	recipe, err := scanRecipe(row)
+	if err == sql.ErrNoRows {
+		return Recipe{}, false, nil
+	}
+	if err != nil {
+		return Recipe{}, false, err
+	}
+	if err := snapshotRecipeVersion(ctx, tx, userID, recipe, now); err != nil {
+		return Recipe{}, false, err
+	}
+	return recipe, true, tx.Commit()
+}
+
+func snapshotRecipeVersion(ctx context.Context, tx *sql.Tx, userID string, recipe Recipe, now time.Time) error {
+	steps, err := marshalSteps(recipe.Steps)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO recipe_versions (user_id, recipe_id, version, method, dose, water, grind, temperature, steps, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (user_id, recipe_id, version) DO NOTHING`,
+		userID, recipe.ID, recipe.Version, recipe.Method, recipe.Dose, recipe.Water, recipe.Grind,
+		recipe.Temperature, steps, now,
+	)
+	return err
+}
+
+// recipeStats compares every version of a recipe by the entries brewed from it.
+func recipeStats(ctx context.Context, db *sql.DB, userID string, id string) ([]RecipeVersionStats, bool, error) {
+	if _, found, err := getRecipe(ctx, db, userID, id); err != nil || !found {
+		return nil, found, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT v.version, v.method, v.dose, v.water, v.grind, v.temperature, v.steps,
+		        COUNT(e.id), COALESCE(AVG(e.rating), 0), MIN(e.brewed_at), MAX(e.brewed_at)
+		 FROM recipe_versions v
+		 LEFT JOIN entries e
+		   ON e.user_id = v.user_id AND e.recipe_id = v.recipe_id AND e.recipe_version = v.version
+		 WHERE v.user_id = $1 AND v.recipe_id = $2
+		 GROUP BY v.version, v.method, v.dose, v.water, v.grind, v.temperature, v.steps
+		 ORDER BY v.version`,
+		userID, id,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	stats := []RecipeVersionStats{}
+	for rows.Next() {
+		var s RecipeVersionStats
+		var steps []byte
+		var first, last sql.NullTime
+		if err := rows.Scan(
+			&s.Version,
+			&s.Method,
+			&s.Dose,
+			&s.Water,
+			&s.Grind,
+			&s.Temperature,
+			&steps,
+			&s.Brews,
+			&s.AverageRating,
+			&first,
+			&last,
+		); err != nil {
+			return nil, false, err
+		}
+		if err := json.Unmarshal(steps, &s.Steps); err != nil {
+			return nil, false, err
+		}
+		if first.Valid {
+			s.FirstBrewedAt = first.Time.UTC().Format(time.RFC3339)
+			s.LastBrewedAt = last.Time.UTC().Format(time.RFC3339)
+		}
+		stats = append(stats, s)
+	}
+	return stats, true, rows.Err()
+}
+
+func marshalSteps(steps []PourStep) (string, error) {
+	if steps == nil {
+		steps = []PourStep{}
+	}
+	data, err := json.Marshal(steps)
+	return string(data), err
+}
+
+func scanRecipe(row rowScanner) (Recipe, error) {
+	var recipe Recipe
+	var steps []byte
+	var created time.Time
+	var updated time.Time
+	if err := row.Scan(
+		&recipe.ID,
+		&recipe.Name,
+		&recipe.Method,
+		&recipe.Dose,
+		&recipe.Water,
+		&recipe.Grind,
+		&recipe.Temperature,
+		&steps,
+		&recipe.Notes,
+		&recipe.Version,
+		&created,
+		&updated,
+	); err != nil {
+		return Recipe{}, err
+	}
+	if err := json.Unmarshal(steps, &recipe.Steps); err != nil {
+		return Recipe{}, err
+	}
+	recipe.CreatedAt = created.UTC().Format(time.RFC3339)
+	recipe.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	return recipe, nil
+}
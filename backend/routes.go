@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiV1Prefix is where the current API lives. The same routes are still
+// served under plain /api as deprecated aliases.
+const apiV1Prefix = "/api/v1"
+
+// legacyAPIDeprecated is when the unversioned /api paths were deprecated,
+// as sent in their Deprecation header.
+var legacyAPIDeprecated = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// apiRouter serves everything under /api/ from its own mux, so unknown
+// paths and wrong methods get JSON errors instead of falling through to
+// the frontend or the mux's plain-text replies.
+type apiRouter struct {
+	mux *http.ServeMux
+}
+
+func newAPIRouter() *apiRouter {
+	return &apiRouter{mux: http.NewServeMux()}
+}
+
+// handle registers h for a "METHOD /path" pattern relative to the API
+// root, once under /api/v1 and once as the deprecated /api alias.
+func (a *apiRouter) handle(pattern string, h http.HandlerFunc) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok || !strings.HasPrefix(path, "/") {
+		panic("api route needs a method and a path: " + pattern)
+	}
+	a.mux.HandleFunc(method+" "+apiV1Prefix+path, h)
+	a.mux.HandleFunc(method+" /api"+path, withDeprecation(h))
+}
+
+// ServeHTTP answers CORS preflights itself and otherwise hands the request
+// to the mux unchanged, so the matched pattern is left on r for metrics
+// and tracing. When nothing matches, the mux's own reply is only used for
+// its status and Allow header.
+func (a *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h, pattern := a.mux.Handler(r)
+	if pattern != "" {
+		a.mux.ServeHTTP(w, r)
+		return
+	}
+	rec := &headerRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, r)
+	r.Pattern = ""
+	switch rec.status {
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", rec.header.Get("Allow"))
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	case http.StatusNotFound:
+		writeError(w, r, http.StatusNotFound, "not found")
+	default:
+		// Redirects to the cleaned path.
+		h.ServeHTTP(w, r)
+	}
+}
+
+// headerRecorder keeps the status and headers of a response and drops
+// its body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (h *headerRecorder) Header() http.Header {
+	return h.header
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (h *headerRecorder) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+// withDeprecation marks a response from an unversioned path as deprecated
+// (RFC 9745) and links the /api/v1 path that replaces it.
+func withDeprecation(next http.HandlerFunc) http.HandlerFunc {
+	deprecation := "@" + strconv.FormatInt(legacyAPIDeprecated.Unix(), 10)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", deprecation)
+		successor := apiV1Prefix + strings.TrimPrefix(r.URL.EscapedPath(), "/api")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
+
+// pathID reads the {id} wildcard, answering the request itself when it is
+// not a usable id.
+func pathID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, err := normalizeID(r.PathValue("id"))
+	if err != nil {
+		writeInvalid(w, r, err)
+		return "", false
+	}
+	return id, true
+}
+
+// registerAPIRoutes lists every API route. Paths are relative to the API
+// root; apiRouter.handle mounts each under both prefixes.
+func registerAPIRoutes(api *apiRouter, cfg Config, store Store, blobs BlobStore, hub *eventHub) {
+	db := store.DB()
+
+	api.mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+
+	// user and pg adapt handlers that need the signed-in user; pg ones
+	// also need the Postgres store.
+	user := func(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+		return withAuth(cfg, store, func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, r.Context().Value(userIDKey).(string))
+		})
+	}
+	pg := func(h func(http.ResponseWriter, *http.Request, *sql.DB, string)) http.HandlerFunc {
+		return withPostgres(store, user(func(w http.ResponseWriter, r *http.Request, userID string) {
+			h(w, r, db, userID)
+		}))
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return withAuth(cfg, store, withAdmin(db, h))
+	}
+
+	api.handle("POST /auth/register", func(w http.ResponseWriter, r *http.Request) {
+		handleRegister(w, r, store, cfg)
+	})
+	api.handle("POST /auth/login", func(w http.ResponseWriter, r *http.Request) {
+		handleLogin(w, r, store, cfg)
+	})
+
+	api.handle("GET /entries", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleListEntries(w, r, store, userID)
+	}))
+	api.handle("POST /entries", user(withIdempotency(store, cfg.IdempotencyWindow, func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleCreateEntry(w, r, store, userID)
+	})))
+	api.handle("PUT /entries/{id}", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleUpdateEntry(w, r, store, userID)
+	}))
+	api.handle("PATCH /entries/{id}", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handlePatchEntry(w, r, store, userID)
+	}))
+	api.handle("DELETE /entries/{id}", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleDeleteEntry(w, r, store, blobs, userID)
+	}))
+	api.handle("GET /entries/{id}/photos", pg(handleListPhotos))
+	api.handle("POST /entries/{id}/photos", pg(func(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+		handleUploadPhoto(w, r, db, blobs, cfg, userID)
+	}))
+	api.handle("GET /entries/{id}/photos/{photo_id}", pg(func(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+		handleGetPhoto(w, r, db, blobs, userID)
+	}))
+	api.handle("DELETE /entries/{id}/photos/{photo_id}", pg(func(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+		handleDeletePhoto(w, r, db, blobs, userID)
+	}))
+
+	api.handle("GET /recipes", pg(handleListRecipes))
+	api.handle("POST /recipes", pg(handleCreateRecipe))
+	api.handle("GET /recipes/{id}", pg(handleGetRecipe))
+	api.handle("PUT /recipes/{id}", pg(handleUpdateRecipe))
+	api.handle("DELETE /recipes/{id}", pg(handleDeleteRecipe))
+	api.handle("POST /recipes/{id}/brew", pg(handleBrewRecipe))
+	api.handle("GET /recipes/{id}/stats", pg(handleRecipeStats))
+
+	api.handle("GET /equipment", pg(handleListEquipment))
+	api.handle("POST /equipment", pg(handleCreateEquipment))
+	api.handle("GET /equipment/stats", pg(handleEquipmentStats))
+	api.handle("GET /equipment/{id}", pg(handleGetEquipment))
+	api.handle("PUT /equipment/{id}", pg(handleUpdateEquipment))
+	api.handle("DELETE /equipment/{id}", pg(handleDeleteEquipment))
+
+	api.handle("GET /flavors", func(w http.ResponseWriter, r *http.Request) {
+		handleFlavors(w, r, db)
+	})
+	api.handle("GET /tags", pg(handleListTags))
+	api.handle("PUT /tags/{id}", pg(handleRenameTag))
+	api.handle("DELETE /tags/{id}", pg(handleDeleteTag))
+	api.handle("GET /stats/descriptors", pg(handleDescriptorStats))
+	api.handle("GET /stats/cupping", pg(handleCuppingStats))
+
+	api.handle("GET /sessions", pg(handleListSessions))
+	api.handle("POST /sessions", pg(handleCreateSession))
+	api.handle("GET /sessions/{id}", pg(handleGetSession))
+	api.handle("DELETE /sessions/{id}", pg(handleDeleteSession))
+	api.handle("POST /sessions/{id}/participants", pg(handleInviteParticipant))
+	api.handle("POST /sessions/{id}/scores", pg(handleSubmitScores))
+	api.handle("POST /sessions/{id}/close", pg(handleCloseSession))
+	api.handle("GET /sessions/{id}/results", pg(handleSessionResults))
+
+	api.handle("GET /groups", pg(handleListGroups))
+	api.handle("POST /groups", pg(handleCreateGroup))
+	api.handle("GET /groups/{id}", pg(handleGetGroup))
+	api.handle("PUT /groups/{id}", pg(handleRenameGroup))
+	api.handle("DELETE /groups/{id}", pg(handleDeleteGroup))
+	api.handle("GET /groups/{id}/members", pg(handleListMembers))
+	api.handle("PUT /groups/{id}/members/{user_id}", pg(handleSetMemberRole))
+	api.handle("DELETE /groups/{id}/members/{user_id}", pg(handleRemoveMember))
+	api.handle("GET /groups/{id}/invitations", pg(handleListGroupInvitations))
+	api.handle("POST /groups/{id}/invitations", pg(handleCreateInvitation))
+	api.handle("DELETE /groups/{id}/invitations/{invitation_id}", pg(handleRevokeInvitation))
+	api.handle("GET /invitations", pg(handleMyInvitations))
+	api.handle("POST /invitations/{token}/accept", pg(handleAcceptInvitation))
+
+	api.handle("GET /beans", pg(handleListBeans))
+	api.handle("POST /beans", pg(handleCreateBean))
+	api.handle("GET /beans/{id}", pg(handleGetBean))
+	api.handle("PUT /beans/{id}", pg(handleUpdateBean))
+	api.handle("DELETE /beans/{id}", pg(handleDeleteBean))
+	api.handle("GET /beans/{id}/entries", pg(handleBeanEntries))
+
+	api.handle("GET /shares", pg(handleListShares))
+	api.handle("POST /shares", pg(handleCreateShare))
+	api.handle("GET /shares/{id}", pg(handleGetShare))
+	api.handle("DELETE /shares/{id}", pg(handleRevokeShare))
+	api.handle("GET /public/{slug}", withPostgres(store, func(w http.ResponseWriter, r *http.Request) {
+		handlePublic(w, r, db, cfg)
+	}))
+	api.handle("GET /public/{slug}/image", withPostgres(store, func(w http.ResponseWriter, r *http.Request) {
+		handlePublicImage(w, r, db, blobs)
+	}))
+
+	api.handle("GET /webhooks", pg(handleListWebhooks))
+	api.handle("POST /webhooks", pg(handleCreateWebhook))
+	api.handle("GET /webhooks/{id}", pg(handleGetWebhook))
+	api.handle("PUT /webhooks/{id}", pg(handleUpdateWebhook))
+	api.handle("DELETE /webhooks/{id}", pg(handleDeleteWebhook))
+	api.handle("GET /webhooks/{id}/deliveries", pg(handleListDeliveries))
+	api.handle("GET /webhooks/{id}/deliveries/{delivery_id}", pg(handleGetDelivery))
+	api.handle("POST /webhooks/{id}/deliveries/{delivery_id}/redeliver", pg(handleRedeliver))
+
+	api.handle("POST /exports", pg(handleCreateExport))
+	api.handle("GET /exports/{id}", pg(handleGetExport))
+	api.handle("GET /exports/{id}/download", pg(func(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+		handleDownloadExport(w, r, db, blobs, userID)
+	}))
+
+	api.handle("GET /events", withPostgres(store, withQueryToken(user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleEvents(w, r, hub, userID)
+	}))))
+
+	api.handle("GET /admin/jobs", withPostgres(store, admin(func(w http.ResponseWriter, r *http.Request) {
+		handleListJobs(w, r, db)
+	})))
+	api.handle("GET /admin/jobs/stats", withPostgres(store, admin(func(w http.ResponseWriter, r *http.Request) {
+		handleJobStats(w, r, db)
+	})))
+	api.handle("GET /admin/jobs/{id}", withPostgres(store, admin(func(w http.ResponseWriter, r *http.Request) {
+		handleGetJob(w, r, db)
+	})))
+	api.handle("DELETE /admin/jobs/{id}", withPostgres(store, admin(func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteJob(w, r, db)
+	})))
+	api.handle("POST /admin/jobs/{id}/retry", withPostgres(store, admin(func(w http.ResponseWriter, r *http.Request) {
+		handleRetryJob(w, r, db)
+	})))
+	api.handle("GET /admin/backups", admin(func(w http.ResponseWriter, r *http.Request) {
+		handleListBackups(w, r, cfg)
+	}))
+	api.handle("POST /admin/backups", admin(func(w http.ResponseWriter, r *http.Request) {
+		handleCreateBackup(w, r, store, blobs, cfg)
+	}))
+	api.handle("GET /admin/backups/{name}", admin(func(w http.ResponseWriter, r *http.Request) {
+		handleDownloadBackup(w, r, cfg)
+	}))
+
+	api.handle("GET /push/config", func(w http.ResponseWriter, r *http.Request) {
+		handlePushConfig(w, r, cfg)
+	})
+	api.handle("POST /push/subscribe", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleSubscribe(w, r, store, userID)
+	}))
+	api.handle("DELETE /push/unsubscribe", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleUnsubscribe(w, r, store, userID)
+	}))
+	api.handle("POST /push/test", user(func(w http.ResponseWriter, r *http.Request, userID string) {
+		handleTestPush(w, r, store, cfg, userID)
+	}))
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	minSessionSamples = 2
+	maxSessionSamples = 12
+	sampleLabelChars  = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	sampleLabelLength = 3
+)
+
+// TastingSession is a blind cupping run by a host for invited tasters.
+// Sample beans stay hidden from everyone but the host until it is closed.
+type TastingSession struct {
+	ID           string                  `json:"id"`
+	Name         string                  `json:"name"`
+	HostID       string                  `json:"host_id"`
+	IsHost       bool                    `json:"is_host"`
+	Status       string                  `json:"status"`
+	Samples      []SessionSample         `json:"samples,omitempty"`
+	Participants []SessionParticipant    `json:"participants,omitempty"`
+	MyScores     map[string]CuppingScore `json:"my_scores,omitempty"`
+	CreatedAt    string                  `json:"created_at"`
+	ClosedAt     string                  `json:"closed_at,omitempty"`
+}
+
+type SessionSample struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	Position int    `json:"position"`
+	Beans    string `json:"beans,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// SessionParticipant is a taster in a session. An invited taster is
+// pending, without a user_id, until they next open their sessions.
+type SessionParticipant struct {
+	UserID  string `json:"user_id,omitempty"`
+	Email   string `json:"email"`
+	Pending bool   `json:"pending,omitempty"`
+	Scored  int    `json:"scored"`
+}
+
+type SessionInput struct {
+	Name    string          `json:"name"`
+	Coffees []SessionCoffee `json:"coffees"`
+	Invite  []string        `json:"invite"`
+}
+
+type SessionCoffee struct {
+	Beans string `json:"beans"`
+	Notes string `json:"notes"`
+}
+
+type SessionScoreInput struct {
+	SampleID string       `json:"sample_id"`
+	Cupping  CuppingScore `json:"cupping"`
+}
+
+// SessionResults is revealed once the host closes a session. Agreement is
+// Kendall's coefficient of concordance (0 = no agreement, 1 = every taster
+// ranked the samples identically) over tasters who scored every sample.
+type SessionResults struct {
+	SessionID string         `json:"session_id"`
+	Tasters   int            `json:"tasters"`
+	Agreement *float64       `json:"agreement"`
+	Samples   []SampleResult `json:"samples"`
+}
+
+type SampleResult struct {
+	ID           string             `json:"id"`
+	Label        string             `json:"label"`
+	Beans        string             `json:"beans"`
+	Rank         int                `json:"rank"`
+	Scores       int                `json:"scores"`
+	AverageTotal float64            `json:"average_total"`
+	StdDevTotal  float64            `json:"stddev_total"`
+	MinTotal     float64            `json:"min_total"`
+	MaxTotal     float64            `json:"max_total"`
+	Attributes   map[string]float64 `json:"attributes"`
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	if err := joinInvitedSessions(r.Context(), db, userID); err != nil {
+		writeServerError(w, r, "failed to join sessions", err)
+		return
+	}
+	sessions, err := listSessions(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load sessions", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func handleCreateSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input SessionInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateSession(input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	id, err := createSession(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to create session", err)
+		return
+	}
+	session, _, err := loadSession(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load session", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// pathSession loads the session named by the {id} wildcard as the user
+// sees it, answering the request itself when there is none.
+func pathSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (TastingSession, bool) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return TastingSession{}, false
+	}
+	if err := joinInvitedSessions(r.Context(), db, userID); err != nil {
+		writeServerError(w, r, "failed to join sessions", err)
+		return TastingSession{}, false
+	}
+	session, found, err := loadSession(r.Context(), db, userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to load session", err)
+		return TastingSession{}, false
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "session not found")
+		return TastingSession{}, false
+	}
+	return session, true
+}
+
+func handleGetSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func handleDeleteSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if !session.IsHost {
+		writeError(w, r, http.StatusForbidden, "only the host can delete a session")
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM tasting_sessions WHERE id = $1", session.ID); err != nil {
+		writeServerError(w, r, "failed to delete session", err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleInviteParticipant(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if !session.IsHost {
+		writeError(w, r, http.StatusForbidden, "only the host can invite tasters")
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := inviteParticipant(r.Context(), db, session.ID, body.Email); err != nil {
+		writeServerError(w, r, "failed to invite taster", err)
+		return
+	}
+	session, _, err := loadSession(r.Context(), db, userID, session.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load session", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+func handleSubmitScores(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if session.Status != "open" {
+		writeAPIError(w, r, newAPIError(http.StatusConflict, codeSessionClosed, "session is closed"))
+		return
+	}
+	var scores []SessionScoreInput
+	if err := readJSON(w, r, &scores); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := submitScores(r.Context(), db, session, userID, scores); err != nil {
+		writeServerError(w, r, "failed to save scores", err)
+		return
+	}
+	session, _, err := loadSession(r.Context(), db, userID, session.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load session", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func handleCloseSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if !session.IsHost {
+		writeError(w, r, http.StatusForbidden, "only the host can close a session")
+		return
+	}
+	if _, err := db.ExecContext(r.Context(),
+		"UPDATE tasting_sessions SET status = 'closed', closed_at = $1 WHERE id = $2 AND status = 'open'",
+		time.Now().UTC(), session.ID,
+	); err != nil {
+		writeServerError(w, r, "failed to close session", err)
+		return
+	}
+	results, err := sessionResults(r.Context(), db, session.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load results", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func handleSessionResults(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	session, ok := pathSession(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if session.Status != "closed" {
+		writeAPIError(w, r, newAPIError(http.StatusConflict, codeSessionOpen, "results are revealed once the host closes the session"))
+		return
+	}
+	results, err := sessionResults(r.Context(), db, session.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load results", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func validateSession(input SessionInput) error {
+	fields := fieldErrors{}
+	if strings.TrimSpace(input.Name) == "" {
+		fields.add("name", "name is required")
+	}
+	if len(input.Coffees) < minSessionSamples || len(input.Coffees) > maxSessionSamples {
+		fields.add("coffees", "a session needs between 2 and 12 coffees")
+	}
+	for _, coffee := range input.Coffees {
+		if strings.TrimSpace(coffee.Beans) == "" {
+			fields.add("coffees", "every coffee needs beans")
+		}
+	}
+	for _, email := range input.Invite {
+		if !strings.Contains(email, "@") {
+			fields.add("invite", "every invite needs a valid email")
+		}
+	}
+	return fields.err()
+}
+
+// createSession stores the session with its coffees shuffled into a random
+// serving order, each under a random blind label.
+func createSession(ctx context.Context, db *sql.DB, hostID string, input SessionInput) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	id := newID()
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO tasting_sessions (id, host_id, name, status, created_at) VALUES ($1, $2, $3, 'open', $4)`,
+		id, hostID, strings.TrimSpace(input.Name), now,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO session_participants (session_id, user_id, invited_at) VALUES ($1, $2, $3)`,
+		id, hostID, now,
+	); err != nil {
+		return "", err
+	}
+
+	coffees := append([]SessionCoffee(nil), input.Coffees...)
+	rand.Shuffle(len(coffees), func(i, j int) { coffees[i], coffees[j] = coffees[j], coffees[i] })
+	labels := map[string]bool{}
+	for i, coffee := range coffees {
+		label := randomLabel()
+		for labels[label] {
+			label = randomLabel()
+		}
+		labels[label] = true
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO session_samples (session_id, id, label, position, beans, notes) VALUES ($1, $2, $3, $4, $5, $6)`,
+			id, newID(), label, i+1, strings.TrimSpace(coffee.Beans), coffee.Notes,
+		); err != nil {
+			return "", err
+		}
+	}
+
+	for _, email := range input.Invite {
+		if err := inviteParticipant(ctx, tx, id, email); err != nil {
+			return "", err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// inviteParticipant invites a taster to a session by email. The invite is
+// stored as is, whether or not anyone has registered the address, and is
+// taken up by joinInvitedSessions; the host cannot tell the two apart.
+// Writes go through exec so invitations can join the session-creation
+// transaction.
+func inviteParticipant(ctx context.Context, exec execer, sessionID string, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") {
+		return fieldError("email", "valid email is required")
+	}
+	_, err := exec.ExecContext(ctx,
+		`INSERT INTO session_invites (session_id, email, invited_at) VALUES ($1, $2, $3)
+		 ON CONFLICT DO NOTHING`,
+		sessionID, email, time.Now().UTC(),
+	)
+	return err
+}
+
+// joinInvitedSessions makes the user a participant of every session their
+// email was invited to.
+func joinInvitedSessions(ctx context.Context, db *sql.DB, userID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO session_participants (session_id, user_id, invited_at)
+		 SELECT i.session_id, u.id, i.invited_at
+		 FROM session_invites i
+		 JOIN users u ON u.email = i.email
+		 WHERE u.id = $1
+		 ON CONFLICT DO NOTHING`,
+		userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM session_invites i USING users u WHERE u.id = $1 AND i.email = u.email`,
+		userID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func randomLabel() string {
+	label := make([]byte, sampleLabelLength)
+	for i := range label {
+		label[i] = sampleLabelChars[rand.IntN(len(sampleLabelChars))]
+	}
+	return string(label)
+}
+
+func submitScores(ctx context.Context, db *sql.DB, session TastingSession, userID string, scores []SessionScoreInput) error {
+	samples := map[string]bool{}
+	for _, sample := range session.Samples {
+		samples[sample.ID] = true
+	}
+	if len(scores) == 0 {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "at least one score is required")
+	}
+	for _, score := range scores {
+		if !samples[score.SampleID] {
+			return newAPIError(http.StatusBadRequest, codeInvalidRequest, "unknown sample "+score.SampleID)
+		}
+		if err := validateCupping(score.Cupping); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The host may have closed the session since it was loaded; the row
+	// lock keeps it open until these scores are in.
+	var status string
+	if err := tx.QueryRowContext(ctx,
+		"SELECT status FROM tasting_sessions WHERE id = $1 FOR UPDATE", session.ID,
+	).Scan(&status); err != nil {
+		return err
+	}
+	if status != "open" {
+		return newAPIError(http.StatusConflict, codeSessionClosed, "session is closed")
+	}
+
+	now := time.Now().UTC()
+	for _, score := range scores {
+		score.Cupping.Total = cuppingTotal(score.Cupping)
+		data, err := json.Marshal(score.Cupping)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO session_scores (session_id, sample_id, user_id, score, total, submitted_at)
+			 VALUES ($1, $2, $3, $4, $5, $6)
+			 ON CONFLICT (session_id, sample_id, user_id)
+			 DO UPDATE SET score = $4, total = $5, submitted_at = $6`,
+			session.ID, score.SampleID, userID, string(data), score.Cupping.Total, now,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func listSessions(ctx context.Context, db *sql.DB, userID string) ([]TastingSession, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT s.id, s.name, s.host_id, s.status, s.created_at, s.closed_at
+		 FROM tasting_sessions s
+		 JOIN session_participants p ON p.session_id = s.id
+		 WHERE p.user_id = $1
+		 ORDER BY s.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []TastingSession{}
+	for rows.Next() {
+		session, err := scanSession(rows, userID)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// loadSession returns a session the user takes part in, with samples
+// blinded unless the user is the host or the session is closed.
+func loadSession(ctx context.Context, db *sql.DB, userID string, id string) (TastingSession, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`SELECT s.id, s.name, s.host_id, s.status, s.created_at, s.closed_at
+		 FROM tasting_sessions s
+		 JOIN session_participants p ON p.session_id = s.id
+		 WHERE s.id = $1 AND p.user_id = $2`,
+		id, userID,
+	)
+	session, err := scanSession(row, userID)
+	if err == sql.ErrNoRows {
+		return TastingSession{}, false, nil
+	}
+	if err != nil {
+		return TastingSession{}, false, err
+	}
+	reveal := session.IsHost || session.Status == "closed"
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, label, position, beans, notes FROM session_samples WHERE session_id = $1 ORDER BY position`, id)
+	if err != nil {
+		return TastingSession{}, false, err
+	}
+	defer rows.Close()
+	session.Samples = []SessionSample{}
+	for rows.Next() {
+		var sample SessionSample
+		var beans, notes string
+		if err := rows.Scan(&sample.ID, &sample.Label, &sample.Position, &beans, &notes); err != nil {
+			return TastingSession{}, false, err
+		}
+		if reveal {
+			sample.Beans = beans
+			sample.Notes = notes
+		}
+		session.Samples = append(session.Samples, sample)
+	}
+	if err := rows.Err(); err != nil {
+		return TastingSession{}, false, err
+	}
+
+	participants, err := db.QueryContext(ctx,
+		`SELECT u.id, u.email, FALSE, COUNT(sc.sample_id), p.invited_at
+		 FROM session_participants p
+		 JOIN users u ON u.id = p.user_id
+		 LEFT JOIN session_scores sc ON sc.session_id = p.session_id AND sc.user_id = p.user_id
+		 WHERE p.session_id = $1
+		 GROUP BY u.id, u.email, p.invited_at
+		 UNION ALL
+		 SELECT '', i.email, TRUE, 0, i.invited_at
+		 FROM session_invites i
+		 WHERE i.session_id = $1
+		   AND NOT EXISTS (
+		     SELECT 1 FROM session_participants p JOIN users u ON u.id = p.user_id
+		     WHERE p.session_id = i.session_id AND u.email = i.email
+		   )
+		 ORDER BY 5, 2`,
+		id,
+	)
+	if err != nil {
+		return TastingSession{}, false, err
+	}
+	defer participants.Close()
+	session.Participants = []SessionParticipant{}
+	for participants.Next() {
+		var p SessionParticipant
+		var invited time.Time
+		if err := participants.Scan(&p.UserID, &p.Email, &p.Pending, &p.Scored, &invited); err != nil {
+			return TastingSession{}, false, err
+		}
+		session.Participants = append(session.Participants, p)
+	}
+	if err := participants.Err(); err != nil {
+		return TastingSession{}, false, err
+	}
+
+	scores, err := db.QueryContext(ctx,
+		`SELECT sample_id, score FROM session_scores WHERE session_id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return TastingSession{}, false, err
+	}
+	defer scores.Close()
+	session.MyScores = map[string]CuppingScore{}
+	for scores.Next() {
+		var sampleID string
+		var data []byte
+		var score CuppingScore
+		if err := scores.Scan(&sampleID, &data); err != nil {
+			return TastingSession{}, false, err
+		}
+		if err := json.Unmarshal(data, &score); err != nil {
+			return TastingSession{}, false, err
+		}
+		session.MyScores[sampleID] = score
+	}
+	return session, true, scores.Err()
+}
+
+func scanSession(row rowScanner, userID string) (TastingSession, error) {
+	var session TastingSession
+	var created time.Time
+	var closed sql.NullTime
+	if err := row.Scan(&session.ID, &session.Name, &session.HostID, &session.Status, &created, &closed); err != nil {
+		return TastingSession{}, err
+	}
+	session.IsHost = session.HostID == userID
+	session.CreatedAt = created.UTC().Format(time.RFC3339)
+	if closed.Valid {
+		session.ClosedAt = closed.Time.UTC().Format(time.RFC3339)
+	}
+	return session, nil
+}
+
+func sessionResults(ctx context.Context, db *sql.DB, id string) (SessionResults, error) {
+	results := SessionResults{SessionID: id, Samples: []SampleResult{}}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, label, beans FROM session_samples WHERE session_id = $1 ORDER BY position`, id)
+	if err != nil {
+		return results, err
+	}
+	index := map[string]int{}
+	for rows.Next() {
+		var sample SampleResult
+		if err := rows.Scan(&sample.ID, &sample.Label, &sample.Beans); err != nil {
+			rows.Close()
+			return results, err
+		}
+		index[sample.ID] = len(results.Samples)
+		results.Samples = append(results.Samples, sample)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	rows, err = db.QueryContext(ctx,
+		`SELECT sample_id, user_id, score FROM session_scores WHERE session_id = $1`, id)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	perSample := make([][]CuppingScore, len(results.Samples))
+	perTaster := map[string]map[int]float64{}
+	for rows.Next() {
+		var sampleID, userID string
+		var data []byte
+		var score CuppingScore
+		if err := rows.Scan(&sampleID, &userID, &data); err != nil {
+			return results, err
+		}
+		if err := json.Unmarshal(data, &score); err != nil {
+			return results, err
+		}
+		i := index[sampleID]
+		perSample[i] = append(perSample[i], score)
+		if perTaster[userID] == nil {
+			perTaster[userID] = map[int]float64{}
+		}
+		perTaster[userID][i] = score.Total
+	}
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+	results.Tasters = len(perTaster)
+
+	for i := range results.Samples {
+		summariseSample(&results.Samples[i], perSample[i])
+	}
+
+	complete := [][]float64{}
+	for _, totals := range perTaster {
+		if len(totals) != len(results.Samples) {
+			continue
+		}
+		row := make([]float64, len(results.Samples))
+		for i, total := range totals {
+			row[i] = total
+		}
+		complete = append(complete, row)
+	}
+	results.Agreement = kendallW(complete)
+
+	order := make([]int, len(results.Samples))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return results.Samples[order[a]].AverageTotal > results.Samples[order[b]].AverageTotal
+	})
+	for rank, i := range order {
+		results.Samples[i].Rank = rank + 1
+	}
+	return results, nil
+}
+
+func summariseSample(sample *SampleResult, scores []CuppingScore) {
+	sample.Scores = len(scores)
+	sample.Attributes = map[string]float64{}
+	if len(scores) == 0 {
+		return
+	}
+	sample.MinTotal = math.Inf(1)
+	sample.MaxTotal = math.Inf(-1)
+	var sum float64
+	for _, score := range scores {
+		sum += score.Total
+		sample.MinTotal = math.Min(sample.MinTotal, score.Total)
+		sample.MaxTotal = math.Max(sample.MaxTotal, score.Total)
+		for name, value := range cuppingAttributes(score) {
+			sample.Attributes[name] += value / float64(len(scores))
+		}
+	}
+	mean := sum / float64(len(scores))
+	var variance float64
+	for _, score := range scores {
+		variance += (score.Total - mean) * (score.Total - mean)
+	}
+	sample.AverageTotal = round2(mean)
+	sample.StdDevTotal = round2(math.Sqrt(variance / float64(len(scores))))
+	for name, value := range sample.Attributes {
+		sample.Attributes[name] = round2(value)
+	}
+}
+
+func cuppingAttributes(score CuppingScore) map[string]float64 {
+	return map[string]float64{
+		"fragrance":  score.Fragrance,
+		"flavor":     score.Flavor,
+		"aftertaste": score.Aftertaste,
+		"acidity":    score.Acidity,
+		"body":       score.Body,
+		"balance":    score.Balance,
+		"uniformity": score.Uniformity,
+		"clean_cup":  score.CleanCup,
+		"sweetness":  score.Sweetness,
+		"overall":    score.Overall,
+	}
+}
+
+// kendallW computes Kendall's coefficient of concordance, with the usual
+// correction for tied ranks, for m tasters scoring the same n samples. It
+// returns nil when there are fewer than two tasters or samples.
+func kendallW(totals [][]float64) *float64 {
+	m := len(totals)
+	if m < 2 || len(totals[0]) < 2 {
+		return nil
+	}
+	n := len(totals[0])
+
+	rankSums := make([]float64, n)
+	var ties float64
+	for _, row := range totals {
+		ranks, t := rankWithTies(row)
+		ties += t
+		for i, rank := range ranks {
+			rankSums[i] += rank
+		}
+	}
+
+	mean := float64(m) * float64(n+1) / 2
+	var s float64
+	for _, sum := range rankSums {
+		s += (sum - mean) * (sum - mean)
+	}
+	denominator := float64(m*m)*(math.Pow(float64(n), 3)-float64(n)) - float64(m)*ties
+	if denominator <= 0 {
+		return nil
+	}
+	w := round2(12 * s / denominator)
+	return &w
+}
+
+// rankWithTies ranks values from highest (1) to lowest, giving tied values
+// their average rank. The second result is the tie correction sum(t^3 - t).
+func rankWithTies(values []float64) ([]float64, float64) {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return values[order[a]] > values[order[b]] })
+
+	ranks := make([]float64, len(values))
+	var correction float64
+	for start := 0; start < len(order); {
+		end := start
+		for end+1 < len(order) && values[order[end+1]] == values[order[start]] {
+			end++
+		}
+		rank := float64(start+end)/2 + 1
+		for k := start; k <= end; k++ {
+			ranks[order[k]] = rank
+		}
+		t := float64(end - start + 1)
+		correction += t*t*t - t
+		start = end + 1
+	}
+	return ranks, correction
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Share is a public link to one of the user's entries or recipes.
+type Share struct {
+	ID           string `json:"id"`
+	Kind         string `json:"kind"`
+	TargetID     string `json:"target_id"`
+	Slug         string `json:"slug"`
+	URL          string `json:"url"`
+	Active       bool   `json:"active"`
+	ViewCount    int64  `json:"view_count"`
+	LastViewedAt string `json:"last_viewed_at,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
+	RevokedAt    string `json:"revoked_at,omitempty"`
+}
+
+type ShareInput struct {
+	EntryID        string `json:"entry_id,omitempty"`
+	RecipeID       string `json:"recipe_id,omitempty"`
+	ExpiresInHours int    `json:"expires_in_hours,omitempty"`
+}
+
+// PublicShare is what anonymous visitors see. It deliberately leaves out
+// ids, tags, equipment and anything else that points back at the owner.
+type PublicShare struct {
+	Kind     string        `json:"kind"`
+	Entry    *PublicEntry  `json:"entry,omitempty"`
+	Recipe   *PublicRecipe `json:"recipe,omitempty"`
+	ImageURL string        `json:"image_url,omitempty"`
+}
+
+type PublicEntry struct {
+	Beans       string        `json:"beans"`
+	BrewMethod  string        `json:"brew_method"`
+	Notes       string        `json:"notes"`
+	Rating      int           `json:"rating"`
+	BrewedAt    string        `json:"brewed_at"`
+	Descriptors []string      `json:"descriptors"`
+	Cupping     *CuppingScore `json:"cupping,omitempty"`
+}
+
+type PublicRecipe struct {
+	Name        string     `json:"name"`
+	Method      string     `json:"method"`
+	Dose        float64    `json:"dose"`
+	Water       float64    `json:"water"`
+	Grind       string     `json:"grind"`
+	Temperature float64    `json:"temperature"`
+	Steps       []PourStep `json:"steps"`
+	Notes       string     `json:"notes"`
+}
+
+const shareColumns = `id, slug, entry_id, recipe_id, view_count, last_viewed_at, created_at, expires_at, revoked_at`
+
+func handleListShares(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	shares, err := listShares(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load shares", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
+
+func handleCreateShare(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input ShareInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	share, found, err := createShare(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to create share", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "nothing to share with that id")
+		return
+	}
+	writeJSON(w, http.StatusCreated, share)
+}
+
+func handleGetShare(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	share, found, err := getShare(r.Context(), db, userID, r.PathValue("id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load share", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "share not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, share)
+}
+
+// handleRevokeShare keeps the row so the view count is still reported.
+func handleRevokeShare(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	res, err := db.ExecContext(r.Context(),
+		"UPDATE shares SET revoked_at = $1 WHERE user_id = $2 AND id = $3 AND revoked_at IS NULL",
+		time.Now().UTC(), userID, r.PathValue("id"),
+	)
+	if err != nil {
+		writeServerError(w, r, "failed to revoke share", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "share not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// handlePublic serves a share without authentication. The page is HTML
+// with Open Graph tags unless the client asks for JSON, so links unfurl in
+// chat apps that send */*.
+func handlePublic(w http.ResponseWriter, r *http.Request, db *sql.DB, cfg Config) {
+	slug := r.PathValue("slug")
+	wantsJSON := r.URL.Query().Get("format") == "json" ||
+		(strings.Contains(r.Header.Get("Accept"), "application/json") && !strings.Contains(r.Header.Get("Accept"), "text/html"))
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-store")
+
+	userID, entryID, recipeID, found, err := viewShare(r.Context(), db, slug)
+	if err != nil {
+		writeServerError(w, r, "failed to load share", err)
+		return
+	}
+	if !found {
+		if wantsJSON {
+			writeError(w, r, http.StatusNotFound, "share not found")
+			return
+		}
+		renderShareNotFound(w)
+		return
+	}
+
+	public, found, err := loadPublicShare(r.Context(), db, userID, entryID, recipeID)
+	if err != nil {
+		writeServerError(w, r, "failed to load share", err)
+		return
+	}
+	if !found {
+		if wantsJSON {
+			writeError(w, r, http.StatusNotFound, "share not found")
+			return
+		}
+		renderShareNotFound(w)
+		return
+	}
+	// Links are absolute only when PUBLIC_URL says where the app lives; the
+	// Host and X-Forwarded-* headers are the client's to set, so they are
+	// never used to build them.
+	link := cfg.PublicURL + apiV1Prefix + "/public/" + slug
+	if public.Kind == "entry" {
+		photos, err := listPhotos(r.Context(), db, userID, entryID)
+		if err == nil && len(photos) > 0 {
+			public.ImageURL = link + "/image"
+		}
+	}
+
+	if wantsJSON {
+		writeJSON(w, http.StatusOK, public)
+		return
+	}
+	renderSharePage(w, r, public, link)
+}
+
+// handlePublicImage serves the first photo of a shared entry as the
+// share's preview image. It does not count as a view.
+func handlePublicImage(w http.ResponseWriter, r *http.Request, db *sql.DB, blobs BlobStore) {
+	slug := r.PathValue("slug")
+	w.Header().Set("Cache-Control", "no-store")
+	var userID string
+	var entryID sql.NullString
+	err := db.QueryRowContext(r.Context(),
+		`SELECT user_id, entry_id FROM shares
+		 WHERE slug = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`,
+		slug,
+	).Scan(&userID, &entryID)
+	if err != nil && err != sql.ErrNoRows {
+		writeServerError(w, r, "failed to load share", err)
+		return
+	}
+	if err == sql.ErrNoRows || !entryID.Valid {
+		writeError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+	photos, err := listPhotos(r.Context(), db, userID, entryID.String)
+	if err != nil {
+		writeServerError(w, r, "failed to load photo", err)
+		return
+	}
+	if len(photos) == 0 {
+		writeError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+	servePhoto(w, r, blobs, photos[0], true)
+}
+
+func createShare(ctx context.Context, db *sql.DB, userID string, input ShareInput) (Share, bool, error) {
+	fields := fieldErrors{}
+	fields.id("entry_id", input.EntryID)
+	fields.id("recipe_id", input.RecipeID)
+	if input.ExpiresInHours < 0 {
+		fields.add("expires_in_hours", "expires_in_hours cannot be negative")
+	}
+	if err := fields.err(); err != nil {
+		return Share{}, false, err
+	}
+	entryID, _ := normalizeID(input.EntryID)
+	recipeID, _ := normalizeID(input.RecipeID)
+	if (entryID == "") == (recipeID == "") {
+		return Share{}, false, newAPIError(http.StatusBadRequest, codeInvalidRequest, "exactly one of entry_id or recipe_id is required")
+	}
+
+	var exists bool
+	var err error
+	if entryID != "" {
+		exists, err = entryExists(ctx, db, userID, entryID)
+	} else {
+		_, exists, err = getRecipe(ctx, db, userID, recipeID)
+	}
+	if err != nil {
+		return Share{}, false, err
+	}
+	if !exists {
+		return Share{}, false, nil
+	}
+
+	now := time.Now().UTC()
+	var expires sql.NullTime
+	if input.ExpiresInHours > 0 {
+		expires = sql.NullTime{Time: now.Add(time.Duration(input.ExpiresInHours) * time.Hour), Valid: true}
+	}
+	row := db.QueryRowContext(ctx,
+		`INSERT INTO shares (id, user_id, slug, entry_id, recipe_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING `+shareColumns,
+		newID(), userID, newToken(), nullString(entryID), nullString(recipeID), now, expires,
+	)
+	share, err := scanShare(row)
+	if err != nil {
+		return Share{}, false, err
+	}
+	return share, true, nil
+}
+
+func listShares(ctx context.Context, db *sql.DB, userID string) ([]Share, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+shareColumns+` FROM shares WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func getShare(ctx context.Context, db *sql.DB, userID string, id string) (Share, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`SELECT `+shareColumns+` FROM shares WHERE user_id = $1 AND id = $2`, userID, id)
+	share, err := scanShare(row)
+	if err == sql.ErrNoRows {
+		return Share{}, false, nil
+	}
+	if err != nil {
+		return Share{}, false, err
+	}
+	return share, true, nil
+}
+
+// viewShare resolves an active slug and counts the view in the same
+// statement, so revoked or expired links never increment.
+func viewShare(ctx context.Context, db *sql.DB, slug string) (string, string, string, bool, error) {
+	var userID string
+	var entryID, recipeID sql.NullString
+	err := db.QueryRowContext(ctx,
+		`UPDATE shares SET view_count = view_count + 1, last_viewed_at = now()
+		 WHERE slug = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		 RETURNING user_id, entry_id, recipe_id`,
+		slug,
+	).Scan(&userID, &entryID, &recipeID)
+	if err == sql.ErrNoRows {
+		return "", "", "", false, nil
+	}
+	if err != nil {
+		return "", "", "", false, err
+	}
+	return userID, entryID.String, recipeID.String, true, nil
+}
+
+func loadPublicShare(ctx context.Context, db *sql.DB, userID string, entryID string, recipeID string) (PublicShare, bool, error) {
+	if entryID != "" {
+		entry, found, err := getEntry(ctx, db, userID, entryID)
+		if err != nil || !found {
+			return PublicShare{}, found, err
+		}
+		return PublicShare{Kind: "entry", Entry: &PublicEntry{
+			Beans:       entry.Beans,
+			BrewMethod:  entry.BrewMethod,
+			Notes:       entry.Notes,
+			Rating:      entry.Rating,
+			BrewedAt:    entry.BrewedAt,
+			Descriptors: entry.Descriptors,
+			Cupping:     entry.Cupping,
+		}}, true, nil
+	}
+
+	recipe, found, err := getRecipe(ctx, db, userID, recipeID)
+	if err != nil || !found {
+		return PublicShare{}, found, err
+	}
+	return PublicShare{Kind: "recipe", Recipe: &PublicRecipe{
+		Name:        recipe.Name,
+		Method:      recipe.Method,
+		Dose:        recipe.Dose,
+		Water:       recipe.Water,
+		Grind:       recipe.Grind,
+		Temperature: recipe.Temperature,
+		Steps:       recipe.Steps,
+		Notes:       recipe.Notes,
+	}}, true, nil
+}
+
+func scanShare(row rowScanner) (Share, error) {
+	var share Share
+	var entryID, recipeID sql.NullString
+	var lastViewed, expires, revoked sql.NullTime
+	var created time.Time
+	if err := row.Scan(
+		&share.ID,
+		&share.Slug,
+		&entryID,
+		&recipeID,
+		&share.ViewCount,
+		&lastViewed,
+		&created,
+		&expires,
+		&revoked,
+	); err != nil {
+		return Share{}, err
+	}
+	share.Kind, share.TargetID = "entry", entryID.String
+	if recipeID.Valid {
+		share.Kind, share.TargetID = "recipe", recipeID.String
+	}
+	share.URL = apiV1Prefix + "/public/" + share.Slug
+	share.CreatedAt = created.UTC().Format(time.RFC3339)
+	share.Active = !revoked.Valid && (!expires.Valid || time.Now().Before(expires.Time))
+	if lastViewed.Valid {
+		share.LastViewedAt = lastViewed.Time.UTC().Format(time.RFC3339)
+	}
+	if expires.Valid {
+		share.ExpiresAt = expires.Time.UTC().Format(time.RFC3339)
+	}
+	if revoked.Valid {
+		share.RevokedAt = revoked.Time.UTC().Format(time.RFC3339)
+	}
+	return share, nil
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="article">
+<meta property="og:site_name" content="Coffee Log">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary_large_image">
+{{else}}<meta name="twitter:card" content="summary">
+{{end}}<meta name="robots" content="noindex">
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 2rem auto; padding: 0 1rem; color: #2b2118; }
+h1 { margin-bottom: 0.25rem; }
+.meta { color: #7a6a5c; margin-top: 0; }
+img { max-width: 100%; border-radius: 8px; }
+li { margin: 0.25rem 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">{{.Description}}</p>
+{{if .Image}}<img src="{{.Image}}" alt="">{{end}}
+{{with .Share.Entry}}{{if .Descriptors}}<p>Flavors: {{range $i, $d := .Descriptors}}{{if $i}}, {{end}}{{$d}}{{end}}</p>{{end}}
+{{if .Notes}}<p>{{.Notes}}</p>{{end}}{{end}}
+{{with .Share.Recipe}}{{if .Steps}}<ol>{{range .Steps}}<li>{{.AtSeconds}}s: {{.Water}} g{{if .Note}} - {{.Note}}{{end}}</li>{{end}}</ol>{{end}}
+{{if .Notes}}<p>{{.Notes}}</p>{{end}}{{end}}
+</body>
+</html>
+`))
+
+func renderSharePage(w http.ResponseWriter, r *http.Request, public PublicShare, url string) {
+	data := struct {
+		Title       string
+		Description string
+		URL         string
+		Image       string
+		Share       PublicShare
+	}{URL: url, Image: public.ImageURL, Share: public}
+
+	if entry := public.Entry; entry != nil {
+		data.Title = entry.Beans
+		parts := []string{entry.BrewMethod}
+		if entry.Rating > 0 {
+			parts = append(parts, strings.Repeat("★", entry.Rating)+strings.Repeat("☆", 5-entry.Rating))
+		}
+		if entry.Cupping != nil {
+			parts = append(parts, fmt.Sprintf("cupping %.2f", entry.Cupping.Total))
+		}
+		if entry.Notes != "" {
+			parts = append(parts, truncate(entry.Notes, 140))
+		}
+		data.Description = strings.Join(parts, " · ")
+	}
+	if recipe := public.Recipe; recipe != nil {
+		data.Title = recipe.Name
+		data.Description = fmt.Sprintf("%s · %gg coffee : %gg water · %g°C", recipe.Method, recipe.Dose, recipe.Water, recipe.Temperature)
+		if recipe.Grind != "" {
+			data.Description += " · " + recipe.Grind + " grind"
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := sharePageTemplate.Execute(w, data); err != nil {
+		logger(r.Context()).Error("failed to render share page", "err", err)
+	}
+}
+
+func renderShareNotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte(`<!doctype html><html lang="en"><head><meta charset="utf-8"><meta name="robots" content="noindex">` +
+		`<title>Link unavailable</title></head><body><p>This link has expired or been revoked.</p></body></html>`))
+}
+
+// truncate shortens s to at most n runes, adding an ellipsis when cut.
+func truncate(s string, n int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Database dialects, as selected by the DATABASE_URL scheme. They also name
+// the migration directories.
+const (
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// Store is the persistence behind accounts, entries and push
+// subscriptions, the part of the app that runs on every backend. The other
+// features (recipes, groups, webhooks, jobs and so on) use Postgres
+// directly through DB and are only served when Dialect is postgres.
+type Store interface {
+	Dialect() string
+	DB() *sql.DB
+
+	// CreateUser stores a new account; the email must already be
+	// normalised and the password hashed.
+	CreateUser(ctx context.Context, email string, passwordHash string) (User, error)
+	// UserByEmail returns the account with its password hash, for sign-in.
+	UserByEmail(ctx context.Context, email string) (userRecord, bool, error)
+	// FindUser looks a user up by id or, failing that, by email.
+	FindUser(ctx context.Context, ref string) (User, bool, error)
+	SetUserPassword(ctx context.Context, userID string, passwordHash string) error
+	SetUserDisabled(ctx context.Context, userID string, disabled bool) error
+	// SetUserAdmin grants or revokes access to /api/admin.
+	SetUserAdmin(ctx context.Context, userID string, admin bool) error
+	// UserActive reports whether the user still exists and is not disabled.
+	UserActive(ctx context.Context, userID string) (bool, error)
+	DeleteUser(ctx context.Context, userID string) (bool, error)
+
+	ListEntries(ctx context.Context, userID string, filter EntryFilter) ([]Entry, error)
+	GetEntry(ctx context.Context, userID string, id string) (Entry, bool, error)
+	UpsertEntry(ctx context.Context, userID string, input EntryInput) (Entry, error)
+	UpdateEntry(ctx context.Context, userID string, id string, input EntryInput) (Entry, bool, error)
+	// PatchEntry applies an RFC 7396 merge patch to the stored entry,
+	// validates the merged entry and writes the fields the patch names,
+	// all in one transaction. Invalid results are reported as an APIError.
+	PatchEntry(ctx context.Context, userID string, id string, patch map[string]interface{}) (Entry, bool, error)
+	DeleteEntry(ctx context.Context, userID string, id string) (bool, error)
+	// ValidateEntryRefs checks the parts of an entry that point at other
+	// rows. Bad references are reported as a validation APIError; any
+	// other error comes from the database.
+	ValidateEntryRefs(ctx context.Context, userID string, input EntryInput) error
+
+	UpsertSubscription(ctx context.Context, userID string, sub PushSubscription) error
+	DeleteSubscription(ctx context.Context, userID string, endpoint string) error
+	ListSubscriptions(ctx context.Context, userID string) ([]PushSubscription, error)
+
+	// ClaimIdempotencyKey reserves key for a request whose body hashes to
+	// requestHash until expires, locking it against repeats until
+	// lockedUntil. When the key is already held it returns the stored
+	// record and false instead; an unfinished claim on the same request
+	// whose lock has run out is taken over.
+	ClaimIdempotencyKey(ctx context.Context, userID string, key string, requestHash string, lockedUntil time.Time, expires time.Time) (idempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the response to replay for key.
+	CompleteIdempotencyKey(ctx context.Context, userID string, key string, status int, contentType string, body []byte) error
+	// ReleaseIdempotencyKey forgets key so the request can run again.
+	ReleaseIdempotencyKey(ctx context.Context, userID string, key string) error
+}
+
+// userRecord is a user together with the columns only sign-in needs.
+type userRecord struct {
+	User
+	passwordHash string
+	disabled     bool
+}
+
+// openStore opens the backend DATABASE_URL points at: sqlite:PATH (or
+// sqlite://PATH, and sqlite::memory: for a throwaway database) selects
+// SQLite, anything else is handed to the Postgres driver.
+func openStore(databaseURL string) (Store, error) {
+	if path, ok := strings.CutPrefix(databaseURL, "sqlite:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		if path == "" {
+			return nil, errors.New("DATABASE_URL sqlite: needs a file path")
+		}
+		return openSQLite(path)
+	}
+	db, err := openDatabase(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStore{sqlStore{db: db}}, nil
+}
+
+// sqlStore holds the queries that read the same on both dialects.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func (s *sqlStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, email string, passwordHash string) (User, error) {
+	now := time.Now().UTC()
+	user := User{
+		ID:        newID(),
+		Email:     email,
+		CreatedAt: now.Format(time.RFC3339),
+		UpdatedAt: now.Format(time.RFC3339),
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (id, email, password_hash, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		user.ID, user.Email, passwordHash, now, now)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) UserByEmail(ctx context.Context, email string) (userRecord, bool, error) {
+	var record userRecord
+	var created time.Time
+	var updated time.Time
+	var disabledAt sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, email, password_hash, created_at, updated_at, disabled_at FROM users WHERE email = $1",
+		email,
+	).Scan(&record.ID, &record.Email, &record.passwordHash, &created, &updated, &disabledAt)
+	if err == sql.ErrNoRows {
+		return userRecord{}, false, nil
+	}
+	if err != nil {
+		return userRecord{}, false, err
+	}
+	record.CreatedAt = created.UTC().Format(time.RFC3339)
+	record.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	record.disabled = disabledAt.Valid
+	return record, true, nil
+}
+
+func (s *sqlStore) FindUser(ctx context.Context, ref string) (User, bool, error) {
+	var user User
+	var created time.Time
+	var updated time.Time
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, email, created_at, updated_at FROM users
+		 WHERE id = $1 OR email = lower($1)
+		 ORDER BY id = $1 DESC
+		 LIMIT 1`,
+		strings.TrimSpace(ref),
+	).Scan(&user.ID, &user.Email, &created, &updated)
+	if err == sql.ErrNoRows {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	user.CreatedAt = created.UTC().Format(time.RFC3339)
+	user.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	return user, true, nil
+}
+
+func (s *sqlStore) SetUserPassword(ctx context.Context, userID string, passwordHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3",
+		passwordHash, time.Now().UTC(), userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetUserDisabled(ctx context.Context, userID string, disabled bool) error {
+	now := time.Now().UTC()
+	disabledAt := sql.NullTime{Time: now, Valid: disabled}
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE users SET disabled_at = $1, updated_at = $2 WHERE id = $3",
+		disabledAt, now, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetUserAdmin(ctx context.Context, userID string, admin bool) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE users SET is_admin = $1, updated_at = $2 WHERE id = $3",
+		admin, time.Now().UTC(), userID,
+	)
+	return err
+}
+
+func (s *sqlStore) UserActive(ctx context.Context, userID string) (bool, error) {
+	var disabledAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT disabled_at FROM users WHERE id = $1", userID).Scan(&disabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !disabledAt.Valid, nil
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, userID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *sqlStore) UpsertSubscription(ctx context.Context, userID string, sub PushSubscription) error {
+	if sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return errors.New("invalid subscription")
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO push_subscriptions (id, user_id, endpoint, p256dh, auth, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (endpoint)
+		 DO UPDATE SET p256dh = $4, auth = $5`,
+		newID(), userID, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, time.Now().UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteSubscription(ctx context.Context, userID string, endpoint string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM push_subscriptions WHERE user_id = $1 AND endpoint = $2",
+		userID, endpoint,
+	)
+	return err
+}
+
+func (s *sqlStore) ListSubscriptions(ctx context.Context, userID string) ([]PushSubscription, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1 ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []PushSubscription{}
+	for rows.Next() {
+		var sub PushSubscription
+		if err := rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// postgresStore is the full backend. Its entry methods are the package
+// functions the Postgres-only features (recipes, shares) share.
+type postgresStore struct {
+	sqlStore
+}
+
+func (s *postgresStore) Dialect() string {
+	return dialectPostgres
+}
+
+func (s *postgresStore) ListEntries(ctx context.Context, userID string, filter EntryFilter) ([]Entry, error) {
+	return listEntries(ctx, s.db, userID, filter)
+}
+
+func (s *postgresStore) GetEntry(ctx context.Context, userID string, id string) (Entry, bool, error) {
+	return getEntry(ctx, s.db, userID, id)
+}
+
+func (s *postgresStore) UpsertEntry(ctx context.Context, userID string, input EntryInput) (Entry, error) {
+	return upsertEntry(ctx, s.db, userID, input)
+}
+
+func (s *postgresStore) UpdateEntry(ctx context.Context, userID string, id string, input EntryInput) (Entry, bool, error) {
+	return updateEntry(ctx, s.db, userID, id, input)
+}
+
+func (s *postgresStore) PatchEntry(ctx context.Context, userID string, id string, patch map[string]interface{}) (Entry, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer tx.Rollback()
+
+	entry, found, err := patchEntry(ctx, tx, entryColumns, " FOR UPDATE OF entries", validateEntryRefs, userID, id, patch)
+	if err != nil || !found {
+		return Entry{}, found, err
+	}
+	if err := emitEntryEvent(ctx, tx, userID, eventEntryUpdated, entry); err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, tx.Commit()
+}
+
+func (s *postgresStore) DeleteEntry(ctx context.Context, userID string, id string) (bool, error) {
+	return deleteEntry(ctx, s.db, userID, id)
+}
+
+func (s *postgresStore) ValidateEntryRefs(ctx context.Context, userID string, input EntryInput) error {
+	return validateEntryRefs(ctx, s.db, userID, input)
+}
+
+// withPostgres answers 501 for the features only the Postgres store has.
+func withPostgres(store Store, next http.HandlerFunc) http.HandlerFunc {
+	if store.Dialect() == dialectPostgres {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotImplemented, "not available with the SQLite backend")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteEntryColumns mirrors entryColumns with SQLite's JSON aggregates.
+const sqliteEntryColumns = `entries.id, entries.beans, entries.brew_method, entries.notes, entries.rating, entries.brewed_at, ` +
+	`entries.created_at, entries.updated_at, entries.recipe_id, entries.recipe_version, entries.grinder_id, entries.brewer_id, ` +
+	`entries.bean_id, entries.cupping, ` +
+	`(SELECT json_group_array(descriptor_id) FROM (
+	   SELECT d.descriptor_id FROM entry_descriptors d
+	   WHERE d.user_id = entries.user_id AND d.entry_id = entries.id
+	   ORDER BY d.descriptor_id)), ` +
+	`(SELECT json_group_array(name) FROM (
+	   SELECT t.name FROM entry_tags et
+	   JOIN tags t ON t.user_id = et.user_id AND t.id = et.tag_id
+	   WHERE et.user_id = entries.user_id AND et.entry_id = entries.id
+	   ORDER BY lower(t.name)))`
+
+// sqliteStore keeps accounts, entries and push subscriptions in a single
+// file. It emits no entry events, so live updates and webhooks are
+// Postgres-only too.
+type sqliteStore struct {
+	sqlStore
+}
+
+// openSQLite opens (creating if need be) the database file at path. Times
+// are stored as text that sorts chronologically, and the pool is limited
+// to one connection because SQLite allows a single writer anyway.
+func openSQLite(path string) (*sqliteStore, error) {
+	if path != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Set("_time_format", "sqlite")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &sqliteStore{sqlStore{db: db}}, nil
+}
+
+func (s *sqliteStore) Dialect() string {
+	return dialectSQLite
+}
+
+func (s *sqliteStore) ListEntries(ctx context.Context, userID string, filter EntryFilter) ([]Entry, error) {
+	return queryEntries(ctx, s.db, sqliteEntryColumns, userID, filter)
+}
+
+func (s *sqliteStore) GetEntry(ctx context.Context, userID string, id string) (Entry, bool, error) {
+	return s.getEntry(ctx, s.db, userID, id)
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqliteStore) getEntry(ctx context.Context, q querier, userID string, id string) (Entry, bool, error) {
+	row := q.QueryRowContext(ctx,
+		`SELECT `+sqliteEntryColumns+` FROM entries WHERE user_id = $1 AND id = $2`, userID, id)
+	entry, err := scanEntry(row)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
+func (s *sqliteStore) UpsertEntry(ctx context.Context, userID string, input EntryInput) (Entry, error) {
+	id, err := normalizeID(input.ID)
+	if err != nil {
+		return Entry{}, err
+	}
+	if id == "" {
+		id = newID()
+	}
+	brewed, _ := time.Parse(time.RFC3339, input.BrewedAt)
+	updated := time.Now().UTC()
+	cupping, cuppingTotal, err := cuppingColumns(input.Cupping)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer tx.Rollback()
+
+	brewMethod, err := entryBrewMethod(ctx, tx, userID, input.BrewMethod)
+	if err != nil {
+		return Entry{}, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO entries (id, user_id, beans, brew_method, notes, rating, brewed_at, created_at, updated_at, cupping, cupping_total)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		 ON CONFLICT (user_id, id)
+		 DO UPDATE SET beans = $3, brew_method = $4, notes = $5, rating = $6, brewed_at = $7, updated_at = $9,
+		   cupping = $10, cupping_total = $11`,
+		id, userID, input.Beans, brewMethod, input.Notes, input.Rating, brewed.UTC(), updated, updated,
+		cupping, cuppingTotal,
+	)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := setEntryTags(ctx, tx, userID, id, input.Tags); err != nil {
+		return Entry{}, err
+	}
+	if err := setEntryDescriptors(ctx, tx, userID, id, input.Descriptors); err != nil {
+		return Entry{}, err
+	}
+	entry, _, err := s.getEntry(ctx, tx, userID, id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, tx.Commit()
+}
+
+func (s *sqliteStore) UpdateEntry(ctx context.Context, userID string, id string, input EntryInput) (Entry, bool, error) {
+	id, err := normalizeID(id)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	brewed, _ := time.Parse(time.RFC3339, input.BrewedAt)
+	cupping, cuppingTotal, err := cuppingColumns(input.Cupping)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer tx.Rollback()
+
+	brewMethod, err := entryBrewMethod(ctx, tx, userID, input.BrewMethod)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE entries
+		 SET beans = $1, brew_method = $2, notes = $3, rating = $4, brewed_at = $5, updated_at = $6,
+		     cupping = $7, cupping_total = $8
+		 WHERE user_id = $9 AND id = $10`,
+		input.Beans, brewMethod, input.Notes, input.Rating, brewed.UTC(), time.Now().UTC(),
+		cupping, cuppingTotal, userID, id,
+	)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		return Entry{}, false, nil
+	}
+	if err := setEntryTags(ctx, tx, userID, id, input.Tags); err != nil {
+		return Entry{}, false, err
+	}
+	if err := setEntryDescriptors(ctx, tx, userID, id, input.Descriptors); err != nil {
+		return Entry{}, false, err
+	}
+	entry, _, err := s.getEntry(ctx, tx, userID, id)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// PatchEntry needs no row lock: the pool's single connection already keeps
+// other writes out of the transaction.
+func (s *sqliteStore) PatchEntry(ctx context.Context, userID string, id string, patch map[string]interface{}) (Entry, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer tx.Rollback()
+
+	entry, found, err := patchEntry(ctx, tx, sqliteEntryColumns, "", validateSQLiteEntryRefs, userID, id, patch)
+	if err != nil || !found {
+		return Entry{}, found, err
+	}
+	return entry, true, tx.Commit()
+}
+
+func (s *sqliteStore) DeleteEntry(ctx context.Context, userID string, id string) (bool, error) {
+	id, err := normalizeID(id)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, "DELETE FROM entries WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *sqliteStore) ValidateEntryRefs(ctx context.Context, userID string, input EntryInput) error {
+	return validateSQLiteEntryRefs(ctx, s.db, userID, input)
+}
+
+// validateSQLiteEntryRefs rejects references to equipment and beans, which
+// only exist on Postgres.
+func validateSQLiteEntryRefs(ctx context.Context, q querier, userID string, input EntryInput) error {
+	fields := fieldErrors{}
+	for _, ref := range []struct{ field, value string }{
+		{"grinder_id", input.GrinderID},
+		{"brewer_id", input.BrewerID},
+		{"bean_id", input.BeanID},
+	} {
+		if strings.TrimSpace(ref.value) != "" {
+			fields.add(ref.field, ref.field+" is not supported with the SQLite backend")
+		}
+	}
+	if err := fields.merge(validateEntryDescriptors(ctx, q, input)); err != nil {
+		return err
+	}
+	return fields.err()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// forEachStore runs fn against a freshly migrated SQLite database and, when
+// TEST_DATABASE_URL is set, against that Postgres database as well, so a
+// change to either backend is checked against the behaviour they share.
+func forEachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, openTestStore(t, "sqlite:"+filepath.Join(t.TempDir(), "coffee.db")))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		databaseURL := os.Getenv("TEST_DATABASE_URL")
+		if databaseURL == "" {
+			t.Skip("TEST_DATABASE_URL is not set")
+		}
+		fn(t, openTestStore(t, databaseURL))
+	})
+}
+
+func openTestStore(t *testing.T, databaseURL string) Store {
+	t.Helper()
+	store, err := openStore(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	if err := applyMigrations(context.Background(), store.DB(), store.Dialect(), migrationsFor(store.Dialect())); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newTestUser creates a throwaway account that is deleted when the test
+// ends, so the tests can share a database with real data.
+func newTestUser(t *testing.T, store Store) User {
+	t.Helper()
+	email := "store-check-" + newID() + "@example.invalid"
+	hash, err := bcrypt.GenerateFromPassword([]byte("store-check"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.CreateUser(context.Background(), email, string(hash))
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() {
+		if deleted, err := store.DeleteUser(context.Background(), user.ID); err != nil || !deleted {
+			t.Errorf("delete user: deleted=%v err=%v", deleted, err)
+		}
+	})
+	return user
+}
+
+func TestStore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store)
+		t.Run("users", func(t *testing.T) { testStoreUsers(t, store, user) })
+		t.Run("entries", func(t *testing.T) { testStoreEntries(t, store, user) })
+		t.Run("subscriptions", func(t *testing.T) { testStoreSubscriptions(t, store, user) })
+		t.Run("idempotency keys", func(t *testing.T) { testStoreIdempotencyKeys(t, store, user) })
+	})
+}
+
+func testStoreUsers(t *testing.T, store Store, user User) {
+	t.Helper()
+	ctx := t.Context()
+	record, found, err := store.UserByEmail(ctx, user.Email)
+	if err != nil || !found || record.ID != user.ID || record.passwordHash == "" || record.disabled {
+		t.Fatalf("UserByEmail = %+v, %v, %v", record.User, found, err)
+	}
+	if _, found, err := store.UserByEmail(ctx, "missing-"+user.Email); err != nil || found {
+		t.Fatalf("UserByEmail(missing) found=%v err=%v", found, err)
+	}
+	for _, ref := range []string{user.ID, user.Email, " " + user.Email + " "} {
+		found, ok, err := store.FindUser(ctx, ref)
+		if err != nil || !ok || found.ID != user.ID {
+			t.Fatalf("FindUser(%q) = %+v, %v, %v", ref, found, ok, err)
+		}
+	}
+
+	if err := store.SetUserPassword(ctx, user.ID, "replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _, err := store.UserByEmail(ctx, user.Email); err != nil || record.passwordHash != "replaced" {
+		t.Fatalf("password hash not replaced: %v", err)
+	}
+
+	if err := store.SetUserDisabled(ctx, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	active, err := store.UserActive(ctx, user.ID)
+	if err != nil || active {
+		t.Fatalf("UserActive after disable = %v, %v", active, err)
+	}
+	if record, _, err := store.UserByEmail(ctx, user.Email); err != nil || !record.disabled {
+		t.Fatalf("UserByEmail does not report the account as disabled: %v", err)
+	}
+	if err := store.SetUserDisabled(ctx, user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := store.UserActive(ctx, user.ID); err != nil || !active {
+		t.Fatalf("UserActive after enable = %v, %v", active, err)
+	}
+	if active, err := store.UserActive(ctx, "missing-"+user.ID); err != nil || active {
+		t.Fatalf("UserActive(missing) = %v, %v", active, err)
+	}
+}
+
+func testStoreEntries(t *testing.T, store Store, user User) {
+	t.Helper()
+	ctx := t.Context()
+	first := EntryInput{
+		Beans:       "Store check Ethiopia",
+		BrewMethod:  "hario v60",
+		Notes:       "first",
+		Rating:      4,
+		BrewedAt:    "2024-05-01T08:30:00Z",
+		Tags:        []string{"Morning", "decaf"},
+		Descriptors: []string{"fruity.berry.blueberry", "floral"},
+	}
+	if err := store.ValidateEntryRefs(ctx, user.ID, first); err != nil {
+		t.Fatalf("ValidateEntryRefs: %v", err)
+	}
+	if err := store.ValidateEntryRefs(ctx, user.ID, EntryInput{Descriptors: []string{"not-a-descriptor"}}); err == nil {
+		t.Fatalf("ValidateEntryRefs accepted an unknown descriptor")
+	}
+
+	created, err := store.UpsertEntry(ctx, user.ID, first)
+	if err != nil {
+		t.Fatalf("UpsertEntry: %v", err)
+	}
+	if created.ID == "" || created.BrewMethod != "V60" || created.BrewedAt != first.BrewedAt ||
+		!slices.Equal(created.Tags, []string{"decaf", "Morning"}) ||
+		!slices.Equal(created.Descriptors, []string{"floral", "fruity.berry.blueberry"}) {
+		t.Fatalf("UpsertEntry returned %+v", created)
+	}
+	got, found, err := store.GetEntry(ctx, user.ID, created.ID)
+	if err != nil || !found || got.Notes != "first" || len(got.Tags) != 2 {
+		t.Fatalf("GetEntry = %+v, %v, %v", got, found, err)
+	}
+
+	second, err := store.UpsertEntry(ctx, user.ID, EntryInput{
+		ID:         "store-check-" + newID(),
+		Beans:      "Store check Kenya",
+		BrewMethod: "espresso",
+		Rating:     3,
+		BrewedAt:   "2024-05-02T07:00:00+02:00",
+		Cupping:    &CuppingScore{},
+	})
+	if err != nil {
+		t.Fatalf("UpsertEntry with id: %v", err)
+	}
+	if second.BrewedAt != "2024-05-02T05:00:00Z" || second.Tags == nil || second.Descriptors == nil || second.Cupping == nil {
+		t.Fatalf("UpsertEntry with id returned %+v", second)
+	}
+
+	for _, c := range []struct {
+		filter EntryFilter
+		want   []string
+	}{
+		{EntryFilter{}, []string{second.ID, created.ID}},
+		{EntryFilter{Tags: []string{"MORNING"}}, []string{created.ID}},
+		{EntryFilter{Tags: []string{"morning", "missing"}}, []string{}},
+		{EntryFilter{Descriptors: []string{"fruity"}}, []string{created.ID}},
+		{EntryFilter{Descriptors: []string{"fruity.berry.blue"}}, []string{}},
+	} {
+		entries, err := store.ListEntries(ctx, user.ID, c.filter)
+		if err != nil {
+			t.Fatalf("ListEntries(%+v): %v", c.filter, err)
+		}
+		ids := []string{}
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if !slices.Equal(ids, c.want) {
+			t.Fatalf("ListEntries(%+v) = %v, want %v", c.filter, ids, c.want)
+		}
+	}
+
+	// Omitted tags are kept; everything else, cupping included, is replaced.
+	updated, found, err := store.UpdateEntry(ctx, user.ID, second.ID, EntryInput{
+		Beans: "Store check Kenya AA", BrewMethod: "Espresso", Rating: 5, BrewedAt: "2024-05-02T05:00:00Z",
+		Descriptors: []string{"floral"},
+	})
+	if err != nil || !found || updated.Beans != "Store check Kenya AA" || updated.Rating != 5 ||
+		updated.Cupping != nil || !slices.Equal(updated.Descriptors, []string{"floral"}) {
+		t.Fatalf("UpdateEntry = %+v, %v, %v", updated, found, err)
+	}
+	if _, found, err := store.UpdateEntry(ctx, user.ID, "missing", first); err != nil || found {
+		t.Fatalf("UpdateEntry(missing) found=%v err=%v", found, err)
+	}
+
+	// A patch is merged into the stored entry and writes the fields it names.
+	patched, found, err := store.PatchEntry(ctx, user.ID, second.ID, map[string]interface{}{
+		"rating": 2, "tags": []string{"Patched"},
+	})
+	if err != nil || !found || patched.Rating != 2 || patched.Beans != "Store check Kenya AA" ||
+		patched.BrewMethod != "Espresso" || patched.Cupping != nil || patched.CreatedAt != second.CreatedAt ||
+		!slices.Equal(patched.Tags, []string{"Patched"}) || !slices.Equal(patched.Descriptors, []string{"floral"}) {
+		t.Fatalf("PatchEntry = %+v, %v, %v", patched, found, err)
+	}
+	if got, _, err := store.GetEntry(ctx, user.ID, second.ID); err != nil || got.Rating != 2 || !slices.Equal(got.Tags, patched.Tags) {
+		t.Fatalf("GetEntry after PatchEntry = %+v, %v", got, err)
+	}
+	var apiErr *APIError
+	if _, _, err := store.PatchEntry(ctx, user.ID, second.ID, map[string]interface{}{"beans": nil}); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+		t.Fatalf("PatchEntry removing beans err=%v", err)
+	}
+	if _, found, err := store.PatchEntry(ctx, user.ID, "missing", map[string]interface{}{"notes": "x"}); err != nil || found {
+		t.Fatalf("PatchEntry(missing) found=%v err=%v", found, err)
+	}
+
+	overwrite := first
+	overwrite.ID = created.ID
+	overwrite.Notes = "overwritten"
+	overwrite.Tags = []string{}
+	overwritten, err := store.UpsertEntry(ctx, user.ID, overwrite)
+	if err != nil || overwritten.Notes != "overwritten" || len(overwritten.Tags) != 0 || overwritten.CreatedAt != created.CreatedAt {
+		t.Fatalf("UpsertEntry(existing) = %+v, %v", overwritten, err)
+	}
+
+	for _, id := range []string{created.ID, second.ID} {
+		if deleted, err := store.DeleteEntry(ctx, user.ID, id); err != nil || !deleted {
+			t.Fatalf("DeleteEntry(%s) = %v, %v", id, deleted, err)
+		}
+	}
+	if deleted, err := store.DeleteEntry(ctx, user.ID, created.ID); err != nil || deleted {
+		t.Fatalf("DeleteEntry twice = %v, %v", deleted, err)
+	}
+	if _, found, err := store.GetEntry(ctx, user.ID, created.ID); err != nil || found {
+		t.Fatalf("GetEntry after delete found=%v err=%v", found, err)
+	}
+}
+
+func testStoreSubscriptions(t *testing.T, store Store, user User) {
+	t.Helper()
+	ctx := t.Context()
+	endpoint := "https://push.example.invalid/" + newID()
+	if err := store.UpsertSubscription(ctx, user.ID, PushSubscription{Endpoint: endpoint}); err == nil {
+		t.Fatalf("UpsertSubscription accepted a subscription without keys")
+	}
+	for _, auth := range []string{"auth-1", "auth-2"} {
+		sub := PushSubscription{Endpoint: endpoint, Keys: PushKeys{P256dh: "p256dh", Auth: auth}}
+		if err := store.UpsertSubscription(ctx, user.ID, sub); err != nil {
+			t.Fatalf("UpsertSubscription: %v", err)
+		}
+	}
+	subs, err := store.ListSubscriptions(ctx, user.ID)
+	if err != nil || len(subs) != 1 || subs[0].Endpoint != endpoint || subs[0].Keys.Auth != "auth-2" {
+		t.Fatalf("ListSubscriptions = %+v, %v", subs, err)
+	}
+	if err := store.DeleteSubscription(ctx, user.ID, endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if subs, err := store.ListSubscriptions(ctx, user.ID); err != nil || len(subs) != 0 {
+		t.Fatalf("ListSubscriptions after delete = %+v, %v", subs, err)
+	}
+}
+
+func testStoreIdempotencyKeys(t *testing.T, store Store, user User) {
+	t.Helper()
+	ctx := t.Context()
+	key := "store-check-" + newID()
+	now := time.Now()
+	locked, expires := now.Add(time.Minute), now.Add(time.Hour)
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, user.ID, key, "hash", locked, expires); err != nil || !claimed {
+		t.Fatalf("ClaimIdempotencyKey claimed=%v err=%v", claimed, err)
+	}
+	record, claimed, err := store.ClaimIdempotencyKey(ctx, user.ID, key, "other", locked, expires)
+	if err != nil || claimed || record.RequestHash != "hash" || record.Status != 0 {
+		t.Fatalf("ClaimIdempotencyKey while in progress = %+v, %v, %v", record, claimed, err)
+	}
+	if err := store.CompleteIdempotencyKey(ctx, user.ID, key, 201, "application/json", []byte(`{"id":"x"}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	record, claimed, err = store.ClaimIdempotencyKey(ctx, user.ID, key, "hash", now.Add(-time.Second), expires)
+	if err != nil || claimed || record.Status != 201 || record.ContentType != "application/json" || string(record.Body) != `{"id":"x"}` {
+		t.Fatalf("ClaimIdempotencyKey after complete = %+v, %v, %v", record, claimed, err)
+	}
+	if err := store.ReleaseIdempotencyKey(ctx, user.ID, key); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+
+	// A claim whose lease has run out goes to the next repeat of the same
+	// request, and only to that.
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, user.ID, key, "hash", now.Add(-time.Second), expires); err != nil || !claimed {
+		t.Fatalf("ClaimIdempotencyKey after release claimed=%v err=%v", claimed, err)
+	}
+	record, claimed, err = store.ClaimIdempotencyKey(ctx, user.ID, key, "other", locked, expires)
+	if err != nil || claimed || record.RequestHash != "hash" {
+		t.Fatalf("ClaimIdempotencyKey of another request after the lease = %+v, %v, %v", record, claimed, err)
+	}
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, user.ID, key, "hash", locked, now.Add(-time.Second)); err != nil || !claimed {
+		t.Fatalf("ClaimIdempotencyKey after the lease claimed=%v err=%v", claimed, err)
+	}
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, user.ID, key, "hash", locked, expires); err != nil || !claimed {
+		t.Fatalf("ClaimIdempotencyKey after expiry claimed=%v err=%v", claimed, err)
+	}
+	if err := store.ReleaseIdempotencyKey(ctx, user.ID, key); err != nil {
+		t.Fatal(err)
+	}
+}
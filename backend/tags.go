@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxTagLength          = 40
+	maxTagsPerEntry       = 20
+	maxDescriptorsPerItem = 30
+	defaultTopDescriptors = 5
+)
+
+// FlavorDescriptor is a node of the built-in flavor wheel. Depth 1 nodes
+// are categories, depth 3 nodes the most specific descriptors.
+type FlavorDescriptor struct {
+	ID       string             `json:"id"`
+	Name     string             `json:"name"`
+	Depth    int                `json:"depth"`
+	Children []FlavorDescriptor `json:"children,omitempty"`
+}
+
+type Tag struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	CreatedAt string `json:"created_at"`
+}
+
+type DescriptorCount struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// BeanDescriptors lists the descriptors most often recorded for one bean.
+type BeanDescriptors struct {
+	Beans       string            `json:"beans"`
+	Entries     int               `json:"entries"`
+	Descriptors []DescriptorCount `json:"descriptors"`
+}
+
+// EntryFilter narrows listEntries. Entries must carry every tag and, for
+// each descriptor, that descriptor or one beneath it on the wheel.
+type EntryFilter struct {
+	Tags        []string
+	Descriptors []string
+}
+
+func entryFilterFromQuery(r *http.Request) EntryFilter {
+	query := r.URL.Query()
+	return EntryFilter{
+		Tags:        query["tag"],
+		Descriptors: query["descriptor"],
+	}
+}
+
+// handleFlavors returns the flavor wheel as a tree.
+func handleFlavors(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	wheel, err := flavorWheel(r.Context(), db)
+	if err != nil {
+		writeServerError(w, r, "failed to load flavor wheel", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, wheel)
+}
+
+// handleListTags lists the user's tags. Tags are created implicitly when
+// an entry uses them, so only listing, renaming and deleting are exposed.
+func handleListTags(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	tags, err := listTags(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load tags", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func handleRenameTag(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	name, err := normalizeTag(body.Name)
+	if err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "UPDATE tags SET name = $1 WHERE user_id = $2 AND id = $3", name, userID, id)
+	if isUniqueViolation(err) {
+		writeAPIError(w, r, newAPIError(http.StatusConflict, codeTagExists, "a tag with that name already exists"))
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, "failed to rename tag", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "tag not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "name": name})
+}
+
+func handleDeleteTag(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM tags WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		writeServerError(w, r, "failed to delete tag", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		writeError(w, r, http.StatusNotFound, "tag not found")
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// handleDescriptorStats returns the most common descriptors per bean,
+// optionally restricted with ?beans= and ?limit=.
+func handleDescriptorStats(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	limit := defaultTopDescriptors
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+	stats, err := descriptorsPerBean(r.Context(), db, userID, r.URL.Query().Get("beans"), limit)
+	if err != nil {
+		writeServerError(w, r, "failed to load descriptor stats", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func normalizeTag(raw string) (string, error) {
+	name := strings.Join(strings.Fields(raw), " ")
+	if name == "" {
+		return "", errors.New("tag name is required")
+	}
+	if len([]rune(name)) > maxTagLength {
+		return "", errors.New("tag names are limited to 40 characters")
+	}
+	return name, nil
+}
+
+func validateEntryTags(input EntryInput) error {
+	fields := fieldErrors{}
+	if len(input.Tags) > maxTagsPerEntry {
+		fields.add("tags", "too many tags")
+	}
+	for _, tag := range input.Tags {
+		if _, err := normalizeTag(tag); err != nil {
+			fields.add("tags", err.Error())
+		}
+	}
+	if len(input.Descriptors) > maxDescriptorsPerItem {
+		fields.add("descriptors", "too many descriptors")
+	}
+	return fields.err()
+}
+
+// validateEntryDescriptors checks every descriptor against the flavor wheel.
+func validateEntryDescriptors(ctx context.Context, q querier, input EntryInput) error {
+	for _, id := range input.Descriptors {
+		var found string
+		err := q.QueryRowContext(ctx, "SELECT id FROM flavor_descriptors WHERE id = $1", id).Scan(&found)
+		if err == sql.ErrNoRows {
+			return fieldError("descriptors", "unknown descriptor "+strconv.Quote(id))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEntryTags replaces an entry's tags, creating any that don't exist yet.
+// A nil slice leaves the current tags untouched.
+func setEntryTags(ctx context.Context, tx *sql.Tx, userID string, entryID string, names []string) error {
+	if names == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM entry_tags WHERE user_id = $1 AND entry_id = $2", userID, entryID); err != nil {
+		return err
+	}
+	for _, raw := range names {
+		name, err := normalizeTag(raw)
+		if err != nil {
+			return err
+		}
+		var tagID string
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO tags (id, user_id, name, created_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (user_id, lower(name)) DO UPDATE SET name = tags.name
+			 RETURNING id`,
+			newID(), userID, name, time.Now().UTC(),
+		).Scan(&tagID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO entry_tags (user_id, entry_id, tag_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			userID, entryID, tagID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEntryDescriptors replaces an entry's flavor descriptors. A nil slice
+// leaves the current descriptors untouched.
+func setEntryDescriptors(ctx context.Context, tx *sql.Tx, userID string, entryID string, ids []string) error {
+	if ids == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM entry_descriptors WHERE user_id = $1 AND entry_id = $2", userID, entryID); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO entry_descriptors (user_id, entry_id, descriptor_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			userID, entryID, id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flavorWheel(ctx context.Context, db *sql.DB) ([]FlavorDescriptor, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, COALESCE(parent_id, ''), name, depth FROM flavor_descriptors ORDER BY position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type node struct {
+		descriptor FlavorDescriptor
+		parent     string
+	}
+	nodes := []node{}
+	for rows.Next() {
+		var n node
+		if err := rows.Scan(&n.descriptor.ID, &n.parent, &n.descriptor.Name, &n.descriptor.Depth); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Build bottom-up: rows are ordered depth-first, so walking backwards
+	// visits every child before its parent.
+	children := map[string][]FlavorDescriptor{}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		n.descriptor.Children = children[n.descriptor.ID]
+		children[n.parent] = append([]FlavorDescriptor{n.descriptor}, children[n.parent]...)
+	}
+	if children[""] == nil {
+		return []FlavorDescriptor{}, nil
+	}
+	return children[""], nil
+}
+
+func listTags(ctx context.Context, db *sql.DB, userID string) ([]Tag, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT t.id, t.name, COUNT(et.entry_id), t.created_at
+		 FROM tags t
+		 LEFT JOIN entry_tags et ON et.user_id = t.user_id AND et.tag_id = t.id
+		 WHERE t.user_id = $1
+		 GROUP BY t.id, t.name, t.created_at
+		 ORDER BY lower(t.name)`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		var created time.Time
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Entries, &created); err != nil {
+			return nil, err
+		}
+		tag.CreatedAt = created.UTC().Format(time.RFC3339)
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func descriptorsPerBean(ctx context.Context, db *sql.DB, userID string, beans string, limit int) ([]BeanDescriptors, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT e.beans, d.id, d.name, COUNT(*),
+		        (SELECT COUNT(*) FROM entries b WHERE b.user_id = e.user_id AND b.beans = e.beans)
+		 FROM entry_descriptors ed
+		 JOIN entries e ON e.user_id = ed.user_id AND e.id = ed.entry_id
+		 JOIN flavor_descriptors d ON d.id = ed.descriptor_id
+		 WHERE ed.user_id = $1 AND ($2 = '' OR e.beans = $2)
+		 GROUP BY e.user_id, e.beans, d.id, d.name
+		 ORDER BY e.beans, COUNT(*) DESC, d.name`,
+		userID, beans,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byBean := map[string]*BeanDescriptors{}
+	order := []string{}
+	for rows.Next() {
+		var bean string
+		var count DescriptorCount
+		var entries int
+		if err := rows.Scan(&bean, &count.ID, &count.Name, &count.Count, &entries); err != nil {
+			return nil, err
+		}
+		stats, ok := byBean[bean]
+		if !ok {
+			stats = &BeanDescriptors{Beans: bean, Entries: entries, Descriptors: []DescriptorCount{}}
+			byBean[bean] = stats
+			order = append(order, bean)
+		}
+		if len(stats.Descriptors) < limit {
+			stats.Descriptors = append(stats.Descriptors, count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return byBean[order[i]].Entries > byBean[order[j]].Entries })
+	result := make([]BeanDescriptors, 0, len(order))
+	for _, bean := range order {
+		result = append(result, *byBean[bean])
+	}
+	return result, nil
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	eventEntryCreated = "entry.created"
+	eventEntryUpdated = "entry.updated"
+	eventEntryDeleted = "entry.deleted"
+)
+
+var webhookEvents = []string{eventEntryCreated, eventEntryUpdated, eventEntryDeleted}
+
+const (
+	webhookMaxAttempts     = 8
+	webhookDisableAfter    = 20
+	webhookRequestTimeout  = 10 * time.Second
+	webhookLease           = 2 * time.Minute
+	webhookResponseMaxBody = 2048
+)
+
+const jobWebhookDeliver = "webhook.deliver"
+
+// errWebhookDestination is the only detail recorded when a hook resolves
+// to an address it may not reach, so deliveries cannot be used to map the
+// network the server runs in.
+var errWebhookDestination = errors.New("destination is not a public address")
+
+// blockedWebhookPrefixes are non-public ranges netip has no predicate for.
+var blockedWebhookPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// Webhook is a user-configured endpoint that receives entry events. The
+// secret is only returned when the hook is created.
+type Webhook struct {
+	ID                  string   `json:"id"`
+	URL                 string   `json:"url"`
+	Events              []string `json:"events"`
+	Secret              string   `json:"secret,omitempty"`
+	Active              bool     `json:"active"`
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	DisabledAt          string   `json:"disabled_at,omitempty"`
+	DisabledReason      string   `json:"disabled_reason,omitempty"`
+	CreatedAt           string   `json:"created_at"`
+	UpdatedAt           string   `json:"updated_at"`
+}
+
+// WebhookInput creates or updates a hook. Setting Active to true on a
+// disabled hook re-enables it and resumes its pending deliveries.
+type WebhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Active *bool    `json:"active,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	WebhookID      string          `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  string          `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  string          `json:"last_attempt_at,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	RedeliveryOf   string          `json:"redelivery_of,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+}
+
+// WebhookEvent is the body POSTed to subscribers.
+type WebhookEvent struct {
+	Event      string      `json:"event"`
+	OccurredAt string      `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+const webhookColumns = `id, url, events, consecutive_failures, disabled_at, disabled_reason, created_at, updated_at`
+
+const deliveryColumns = `id, webhook_id, event, status, attempts, next_attempt_at, last_attempt_at, response_status, error, redelivery_of, created_at`
+
+func handleListWebhooks(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hooks, err := listWebhooks(r.Context(), db, userID)
+	if err != nil {
+		writeServerError(w, r, "failed to load webhooks", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	var input WebhookInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateWebhook(&input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	hook, err := createWebhook(r.Context(), db, userID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to save webhook", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// pathWebhook loads the user's webhook named by the {id} wildcard,
+// answering the request itself when there is none.
+func pathWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) (Webhook, bool) {
+	hook, found, err := getWebhook(r.Context(), db, userID, r.PathValue("id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load webhook", err)
+		return Webhook{}, false
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "webhook not found")
+		return Webhook{}, false
+	}
+	return hook, true
+}
+
+func handleGetWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+func handleUpdateWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	var input WebhookInput
+	if err := readJSON(w, r, &input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	if err := validateWebhook(&input); err != nil {
+		writeInvalid(w, r, err)
+		return
+	}
+	hook, err := updateWebhook(r.Context(), db, userID, hook.ID, input)
+	if err != nil {
+		writeServerError(w, r, "failed to update webhook", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(r.Context(),
+		"DELETE FROM webhooks WHERE user_id = $1 AND id = $2", userID, hook.ID); err != nil {
+		writeServerError(w, r, "failed to delete webhook", err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func handleListDeliveries(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	deliveries, err := listDeliveries(r.Context(), db, userID, hook.ID)
+	if err != nil {
+		writeServerError(w, r, "failed to load deliveries", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+func handleGetDelivery(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	delivery, found, err := getDelivery(r.Context(), db, userID, hook.ID, r.PathValue("delivery_id"))
+	if err != nil {
+		writeServerError(w, r, "failed to load delivery", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "delivery not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+func handleRedeliver(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) {
+	hook, ok := pathWebhook(w, r, db, userID)
+	if !ok {
+		return
+	}
+	delivery, found, err := redeliver(r.Context(), db, userID, hook.ID, r.PathValue("delivery_id"))
+	if err != nil {
+		writeServerError(w, r, "failed to queue redelivery", err)
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "delivery not found")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+func validateWebhook(input *WebhookInput) error {
+	fields := fieldErrors{}
+	input.URL = strings.TrimSpace(input.URL)
+	u, err := url.Parse(input.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields.add("url", "url must be an absolute http(s) URL")
+	} else if addr, err := netip.ParseAddr(u.Hostname()); (err == nil && !publicWebhookAddr(addr)) ||
+		strings.EqualFold(u.Hostname(), "localhost") {
+		fields.add("url", "url must point at a public address")
+	}
+	if len(input.Events) == 0 {
+		input.Events = webhookEvents
+		return fields.err()
+	}
+	seen := map[string]bool{}
+	events := []string{}
+	for _, event := range input.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			fields.add("events", fmt.Sprintf("unknown event %q (expected one of %s)", event, strings.Join(webhookEvents, ", ")))
+			continue
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	input.Events = events
+	return fields.err()
+}
+
+func createWebhook(ctx context.Context, db *sql.DB, userID string, input WebhookInput) (Webhook, error) {
+	events, err := json.Marshal(input.Events)
+	if err != nil {
+		return Webhook{}, err
+	}
+	secret := "whsec_" + newToken()
+	now := time.Now().UTC()
+	var disabled sql.NullTime
+	var reason string
+	if input.Active != nil && !*input.Active {
+		disabled = sql.NullTime{Time: now, Valid: true}
+		reason = "disabled by user"
+	}
+	row := db.QueryRowContext(ctx,
+		`INSERT INTO webhooks (id, user_id, url, secret, events, disabled_at, disabled_reason, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		 RETURNING `+webhookColumns,
+		newID(), userID, input.URL, secret, string(events), disabled, nullString(reason), now,
+	)
+	hook, err := scanWebhook(row)
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook.Secret = secret
+	return hook, nil
+}
+
+func updateWebhook(ctx context.Context, db *sql.DB, userID string, id string, input WebhookInput) (Webhook, error) {
+	events, err := json.Marshal(input.Events)
+	if err != nil {
+		return Webhook{}, err
+	}
+	// active: nil leaves the state alone, true re-enables (and forgives past
+	// failures), false disables.
+	var active sql.NullBool
+	if input.Active != nil {
+		active = sql.NullBool{Bool: *input.Active, Valid: true}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Webhook{}, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		`UPDATE webhooks
+		 SET url = $1, events = $2, updated_at = $3,
+		     disabled_at = CASE WHEN $4::boolean IS NULL THEN disabled_at
+		                        WHEN $4 THEN NULL
+		                        ELSE COALESCE(disabled_at, $3) END,
+		     disabled_reason = CASE WHEN $4::boolean IS NULL THEN disabled_reason
+		                            WHEN $4 THEN NULL
+		                            ELSE COALESCE(disabled_reason, 'disabled by user') END,
+		     consecutive_failures = CASE WHEN $4::boolean THEN 0 ELSE consecutive_failures END
+		 WHERE user_id = $5 AND id = $6
+		 RETURNING `+webhookColumns,
+		input.URL, string(events), time.Now().UTC(), active, userID, id,
+	)
+	hook, err := scanWebhook(row)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if active.Valid && active.Bool {
+		if err := resumeDeliveries(ctx, tx, userID, id); err != nil {
+			return Webhook{}, err
+		}
+	}
+	return hook, tx.Commit()
+}
+
+func listWebhooks(ctx context.Context, db *sql.DB, userID string) ([]Webhook, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func getWebhook(ctx context.Context, db *sql.DB, userID string, id string) (Webhook, bool, error) {
+	row := db.QueryRowContext(ctx,
+		`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = $1 AND id = $2`, userID, id)
+	hook, err := scanWebhook(row)
+	if err == sql.ErrNoRows {
+		return Webhook{}, false, nil
+	}
+	if err != nil {
+		return Webhook{}, false, err
+	}
+	return hook, true, nil
+}
+
+func listDeliveries(ctx context.Context, db *sql.DB, userID string, webhookID string) ([]WebhookDelivery, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+deliveryColumns+`
+		 FROM webhook_deliveries
+		 WHERE user_id = $1 AND webhook_id = $2
+		 ORDER BY created_at DESC
+		 LIMIT 100`,
+		userID, webhookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func getDelivery(ctx context.Context, db *sql.DB, userID string, webhookID string, id string) (WebhookDelivery, bool, error) {
+	var payload []byte
+	row := db.QueryRowContext(ctx,
+		`SELECT `+deliveryColumns+`, payload
+		 FROM webhook_deliveries
+		 WHERE user_id = $1 AND webhook_id = $2 AND id = $3`,
+		userID, webhookID, id,
+	)
+	delivery, err := scanDelivery(deliveryPayloadScanner{row, &payload})
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, false, nil
+	}
+	if err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	delivery.Payload = payload
+	return delivery, true, nil
+}
+
+// redeliver queues a fresh copy of an earlier delivery. The original row
+// is left untouched so its log survives.
+func redeliver(ctx context.Context, db *sql.DB, userID string, webhookID string, id string) (WebhookDelivery, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	row := tx.QueryRowContext(ctx,
+		`INSERT INTO webhook_deliveries (id, user_id, webhook_id, event, payload, next_attempt_at, redelivery_of, created_at)
+		 SELECT $1, user_id, webhook_id, event, payload, $2, id, $2
+		 FROM webhook_deliveries
+		 WHERE user_id = $3 AND webhook_id = $4 AND id = $5
+		 RETURNING `+deliveryColumns,
+		newID(), now, userID, webhookID, id,
+	)
+	delivery, err := scanDelivery(row)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, false, nil
+	}
+	if err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	if err := enqueueDelivery(ctx, tx, delivery.ID, now); err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	return delivery, true, tx.Commit()
+}
+
+// enqueueWebhookEvent records a delivery for every enabled hook subscribed
+// to event. It runs inside the transaction that made the change, so an
+// event is queued if and only if the change commits.
+func enqueueWebhookEvent(ctx context.Context, tx *sql.Tx, userID string, event string, data interface{}) error {
+	now := time.Now().UTC()
+	payload, err := json.Marshal(WebhookEvent{
+		Event:      event,
+		OccurredAt: now.Format(time.RFC3339),
+		Data:       data,
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id FROM webhooks
+		 WHERE user_id = $1 AND disabled_at IS NULL AND events @> jsonb_build_array($2::text)`,
+		userID, event,
+	)
+	if err != nil {
+		return err
+	}
+	var hookIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		hookIDs = append(hookIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, hookID := range hookIDs {
+		id := newID()
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO webhook_deliveries (id, user_id, webhook_id, event, payload, next_attempt_at, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+			id, userID, hookID, event, string(payload), now,
+		); err != nil {
+			return err
+		}
+		if err := enqueueDelivery(ctx, tx, id, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookDeliveryJob makes one attempt at a delivery.
+type WebhookDeliveryJob struct {
+	DeliveryID string `json:"delivery_id"`
+}
+
+// enqueueDelivery schedules the next attempt at a delivery for runAt.
+func enqueueDelivery(ctx context.Context, exec execer, deliveryID string, runAt time.Time) error {
+	_, err := enqueueJob(ctx, exec, jobWebhookDeliver, WebhookDeliveryJob{DeliveryID: deliveryID}, JobOptions{RunAt: runAt})
+	return err
+}
+
+// resumeDeliveries queues the pending deliveries of a hook that is being
+// re-enabled; attempts that came due while it was disabled were skipped.
+func resumeDeliveries(ctx context.Context, tx *sql.Tx, userID string, hookID string) error {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, next_attempt_at FROM webhook_deliveries
+		 WHERE user_id = $1 AND webhook_id = $2 AND status = 'pending'`,
+		userID, hookID,
+	)
+	if err != nil {
+		return err
+	}
+	due := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var next time.Time
+		if err := rows.Scan(&id, &next); err != nil {
+			rows.Close()
+			return err
+		}
+		due[id] = next
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, next := range due {
+		if err := enqueueDelivery(ctx, tx, id, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publicWebhookAddr reports whether a hook may be delivered to addr:
+// loopback, private, link-local, unspecified and other non-public ranges
+// are refused.
+func publicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedWebhookPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookTransport checks every address the client actually dials rather
+// than the URL it was given, so neither DNS names nor rebinding between
+// validation and delivery can point a hook inside the network. Proxies
+// are bypassed for the same reason.
+func webhookTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !publicWebhookAddr(addr.Addr()) {
+				return errWebhookDestination
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// newWebhookClient returns the client deliveries are sent with.
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Transport: webhookTransport(),
+		Timeout:   webhookRequestTimeout,
+		// Redirects are treated as failures; subscribers should register
+		// the final URL.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+type claimedDelivery struct {
+	id       string
+	userID   string
+	hookID   string
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverWebhook runs a webhook.deliver job. Claiming the delivery pushes
+// next_attempt_at forward by a lease, so a job that finds it not yet due,
+// already finished, claimed by another job or its hook disabled has
+// nothing to do; a failed attempt queues the next one itself.
+func deliverWebhook(ctx context.Context, db *sql.DB, client *http.Client, job WebhookDeliveryJob) error {
+	var d claimedDelivery
+	err := db.QueryRowContext(ctx,
+		`UPDATE webhook_deliveries d
+		 SET next_attempt_at = $1
+		 FROM webhooks h
+		 WHERE d.id = $2 AND d.status = 'pending' AND d.next_attempt_at <= $3
+		   AND h.user_id = d.user_id AND h.id = d.webhook_id AND h.disabled_at IS NULL
+		 RETURNING d.id, d.user_id, d.webhook_id, d.event, d.payload, d.attempts, h.url, h.secret`,
+		time.Now().UTC().Add(webhookLease), job.DeliveryID, time.Now().UTC(),
+	).Scan(&d.id, &d.userID, &d.hookID, &d.event, &d.payload, &d.attempts, &d.url, &d.secret)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	status, sendErr := sendWebhook(ctx, client, d)
+	return recordDeliveryAttempt(ctx, db, d, status, sendErr)
+}
+
+// sendWebhook POSTs the payload. The signature header follows the
+// "t=<unix>,v1=<hex>" scheme: v1 is HMAC-SHA256 over "<t>.<body>" keyed
+// with the hook's secret, so receivers can also reject stale replays.
+// Only the status of the response is kept; its body never is, since it
+// would be shown to whoever set the hook up.
+func sendWebhook(ctx context.Context, client *http.Client, d claimedDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "coffee-log-webhooks/1")
+	req.Header.Set("X-Coffee-Event", d.event)
+	req.Header.Set("X-Coffee-Delivery", d.id)
+	req.Header.Set("X-Coffee-Signature", "t="+timestamp+",v1="+signWebhook(d.secret, timestamp, d.payload))
+
+	resp, err := client.Do(req)
+	if errors.Is(err, errWebhookDestination) {
+		return 0, errWebhookDestination
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseMaxBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func signWebhook(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordDeliveryAttempt stores the outcome of one attempt, queues the next
+// one with the job backoff, and disables the hook after too many
+// consecutive failures.
+func recordDeliveryAttempt(ctx context.Context, db *sql.DB, d claimedDelivery, status int, sendErr error) error {
+	attempts := d.attempts + 1
+	now := time.Now().UTC()
+	deliveryStatus, next, errText := "succeeded", now, ""
+	if sendErr != nil {
+		errText = sendErr.Error()
+		deliveryStatus = "pending"
+		next = now.Add(jobBackoff(attempts))
+		if attempts >= webhookMaxAttempts {
+			deliveryStatus = "failed"
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE webhook_deliveries
+		 SET status = $1, attempts = $2, next_attempt_at = $3, last_attempt_at = $4,
+		     response_status = $5, error = $6
+		 WHERE id = $7`,
+		deliveryStatus, attempts, next, now,
+		sql.NullInt64{Int64: int64(status), Valid: status != 0}, nullString(errText), d.id,
+	); err != nil {
+		return err
+	}
+
+	if deliveryStatus == "pending" {
+		if err := enqueueDelivery(ctx, tx, d.id, next); err != nil {
+			return err
+		}
+	}
+
+	if sendErr == nil {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE webhooks SET consecutive_failures = 0 WHERE user_id = $1 AND id = $2",
+			d.userID, d.hookID,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var failures int
+	if err := tx.QueryRowContext(ctx,
+		`UPDATE webhooks SET consecutive_failures = consecutive_failures + 1
+		 WHERE user_id = $1 AND id = $2
+		 RETURNING consecutive_failures`,
+		d.userID, d.hookID,
+	).Scan(&failures); err != nil {
+		return err
+	}
+	if failures >= webhookDisableAfter {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE webhooks SET disabled_at = $1, disabled_reason = $2
+			 WHERE user_id = $3 AND id = $4 AND disabled_at IS NULL`,
+			now, fmt.Sprintf("disabled after %d consecutive failed deliveries", failures), d.userID, d.hookID,
+		); err != nil {
+			return err
+		}
+		slog.Warn("webhook disabled", "webhook_id", d.hookID, "user_id", d.userID, "consecutive_failures", failures)
+	}
+	return tx.Commit()
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var hook Webhook
+	var events []byte
+	var disabled sql.NullTime
+	var reason sql.NullString
+	var created, updated time.Time
+	if err := row.Scan(
+		&hook.ID,
+		&hook.URL,
+		&events,
+		&hook.ConsecutiveFailures,
+		&disabled,
+		&reason,
+		&created,
+		&updated,
+	); err != nil {
+		return Webhook{}, err
+	}
+	if err := json.Unmarshal(events, &hook.Events); err != nil {
+		return Webhook{}, err
+	}
+	hook.Active = !disabled.Valid
+	if disabled.Valid {
+		hook.DisabledAt = disabled.Time.UTC().Format(time.RFC3339)
+	}
+	hook.DisabledReason = reason.String
+	hook.CreatedAt = created.UTC().Format(time.RFC3339)
+	hook.UpdatedAt = updated.UTC().Format(time.RFC3339)
+	return hook, nil
+}
+
+func scanDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var next time.Time
+	var last sql.NullTime
+	var status sql.NullInt64
+	var errText, redeliveryOf sql.NullString
+	var created time.Time
+	if err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Status,
+		&delivery.Attempts,
+		&next,
+		&last,
+		&status,
+		&errText,
+		&redeliveryOf,
+		&created,
+	); err != nil {
+		return WebhookDelivery{}, err
+	}
+	if delivery.Status == "pending" {
+		delivery.NextAttemptAt = next.UTC().Format(time.RFC3339)
+	}
+	if last.Valid {
+		delivery.LastAttemptAt = last.Time.UTC().Format(time.RFC3339)
+	}
+	delivery.ResponseStatus = int(status.Int64)
+	delivery.Error = errText.String
+	delivery.RedeliveryOf = redeliveryOf.String
+	delivery.CreatedAt = created.UTC().Format(time.RFC3339)
+	return delivery, nil
+}
+
+// deliveryPayloadScanner appends the payload column to scanDelivery's
+// destinations.
+type deliveryPayloadScanner struct {
+	row     rowScanner
+	payload *[]byte
+}
+
+func (s deliveryPayloadScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.payload)...)
+}
@@ -0,0 +1,37 @@
+// Writes .br and .gz copies of the compressible files in dist/ so the Go
+// binary can serve them without compressing on every request.
+import fs from 'node:fs'
+import path from 'node:path'
+import zlib from 'node:zlib'
+
+const ROOT = new URL('..', import.meta.url).pathname
+const DIST_DIR = path.join(ROOT, 'dist')
+const MIN_BYTES = 1024
+const COMPRESSIBLE = new Set(['.html', '.js', '.mjs', '.css', '.json', '.webmanifest', '.svg', '.txt', '.map'])
+
+const walk = (dir) =>
+  fs.readdirSync(dir, { withFileTypes: true }).flatMap((entry) => {
+    const full = path.join(dir, entry.name)
+    return entry.isDirectory() ? walk(full) : [full]
+  })
+
+let count = 0
+for (const file of walk(DIST_DIR)) {
+  if (!COMPRESSIBLE.has(path.extname(file))) continue
+  const content = fs.readFileSync(file)
+  if (content.length < MIN_BYTES) continue
+
+  const brotli = zlib.brotliCompressSync(content, {
+    params: {
+      [zlib.constants.BROTLI_PARAM_QUALITY]: zlib.constants.BROTLI_MAX_QUALITY,
+      [zlib.constants.BROTLI_PARAM_SIZE_HINT]: content.length,
+    },
+  })
+  const gzip = zlib.gzipSync(content, { level: zlib.constants.Z_BEST_COMPRESSION })
+  // Only keep variants that actually save bytes.
+  if (brotli.length < content.length) fs.writeFileSync(`${file}.br`, brotli)
+  if (gzip.length < content.length) fs.writeFileSync(`${file}.gz`, gzip)
+  count += 1
+}
+
+console.log(`Compressed ${count} files in ${path.relative(process.cwd(), DIST_DIR) || 'dist'}`)
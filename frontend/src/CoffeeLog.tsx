@@ -25,11 +25,12 @@ import {
   fetchEntries,
   getAuthToken,
   getPushConfig,
-  updateEntry,
   loginUser,
+  patchEntry,
   registerUser,
   sendTestPush,
   setAuthToken,
+  subscribeEntryEvents,
   subscribePush,
 } from './data/api'
 
@@ -256,11 +257,13 @@ export default function CoffeeLog() {
     for (const item of items) {
       try {
         if (item.action === 'create' && item.payload) {
-          const created = await createEntry(item.payload)
+          const created = await createEntry(item.payload, item.id)
           await putEntry({ ...created, syncStatus: 'synced' })
         }
         if (item.action === 'update' && item.payload) {
-          const updated = await updateEntry(item.entryId, item.payload)
+          // A patch leaves what this form does not edit (tags, cupping
+          // scores) alone, where a PUT would replace it.
+          const updated = await patchEntry(item.entryId, item.payload)
           await putEntry({ ...updated, syncStatus: 'synced' })
         }
         if (item.action === 'delete') {
@@ -314,6 +317,14 @@ export default function CoffeeLog() {
     }
   }, [runSync])
 
+  useEffect(() => {
+    if (!token) return
+    // Another device changed an entry; pull the server copy.
+    return subscribeEntryEvents(() => {
+      if (navigator.onLine) syncFromServer().catch(() => undefined)
+    })
+  }, [syncFromServer, token])
+
   useEffect(() => {
     if (!token) return
     if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
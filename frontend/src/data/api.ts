@@ -11,6 +11,8 @@ type ServerEntry = {
   updated_at: string
 }
 
+const API = '/api/v1'
+
 const TOKEN_KEY = 'coffee_log_token'
 
 export const getAuthToken = () => {
@@ -37,20 +39,46 @@ const parseJSON = async <T>(response: Response): Promise<T> => {
   return data as T
 }
 
+// ApiError carries the server's error envelope. `code` is stable and is what
+// to branch on; `fields` names each invalid request field.
+export class ApiError extends Error {
+  status: number
+  code: string
+  fields: Record<string, string>
+  requestId?: string
+
+  constructor(
+    status: number,
+    code: string,
+    message: string,
+    fields: Record<string, string> = {},
+    requestId?: string,
+  ) {
+    super(message)
+    this.name = 'ApiError'
+    this.status = status
+    this.code = code
+    this.fields = fields
+    this.requestId = requestId
+  }
+}
+
 const ensureOk = async (response: Response) => {
   if (response.ok) return response
-  let message = `Request failed (${response.status})`
+  let error = new ApiError(response.status, 'unknown', `Request failed (${response.status})`)
   try {
     const data = await response.json()
-    if (typeof data?.error === 'string') message = data.error
+    if (typeof data?.code === 'string' && typeof data?.message === 'string') {
+      error = new ApiError(response.status, data.code, data.message, data.fields ?? {}, data.request_id)
+    }
   } catch {
     // ignore
   }
-  throw new Error(message)
+  throw error
 }
 
 export const fetchEntries = async (): Promise<Entry[]> => {
-  const response = await fetch('/api/entries', {
+  const response = await fetch(`${API}/entries`, {
     headers: { ...authHeaders() },
   })
   await ensureOk(response)
@@ -68,10 +96,19 @@ export const fetchEntries = async (): Promise<Entry[]> => {
   }))
 }
 
-export const createEntry = async (payload: EntryPayload): Promise<Entry> => {
-  const response = await fetch('/api/entries', {
+// createEntry sends idempotencyKey, when given, so the server replays the
+// first response to a retry instead of saving the entry twice.
+export const createEntry = async (
+  payload: EntryPayload,
+  idempotencyKey?: string
+): Promise<Entry> => {
+  const response = await fetch(`${API}/entries`, {
     method: 'POST',
-    headers: { 'Content-Type': 'application/json', ...authHeaders() },
+    headers: {
+      'Content-Type': 'application/json',
+      ...(idempotencyKey ? { 'Idempotency-Key': idempotencyKey } : {}),
+      ...authHeaders(),
+    },
     body: JSON.stringify(payload),
   })
   await ensureOk(response)
@@ -93,7 +130,7 @@ export const updateEntry = async (
   id: string,
   payload: EntryPayload
 ): Promise<Entry> => {
-  const response = await fetch(`/api/entries/${id}`, {
+  const response = await fetch(`${API}/entries/${id}`, {
     method: 'PUT',
     headers: { 'Content-Type': 'application/json', ...authHeaders() },
     body: JSON.stringify(payload),
@@ -113,8 +150,34 @@ export const updateEntry = async (
   }
 }
 
+// patchEntry sends a JSON Merge Patch: only the given fields change, and a
+// null clears one.
+export const patchEntry = async (
+  id: string,
+  patch: { [K in keyof EntryPayload]?: EntryPayload[K] | null }
+): Promise<Entry> => {
+  const response = await fetch(`${API}/entries/${id}`, {
+    method: 'PATCH',
+    headers: { 'Content-Type': 'application/merge-patch+json', ...authHeaders() },
+    body: JSON.stringify(patch),
+  })
+  await ensureOk(response)
+  const entry = await parseJSON<ServerEntry>(response)
+  return {
+    id: entry.id,
+    beans: entry.beans,
+    brewMethod: entry.brew_method,
+    notes: entry.notes,
+    rating: entry.rating,
+    brewedAt: entry.brewed_at,
+    createdAt: entry.created_at,
+    updatedAt: entry.updated_at,
+    syncStatus: 'synced',
+  }
+}
+
 export const deleteEntry = async (id: string): Promise<void> => {
-  const response = await fetch(`/api/entries/${id}`, {
+  const response = await fetch(`${API}/entries/${id}`, {
     method: 'DELETE',
     headers: { ...authHeaders() },
   })
@@ -126,7 +189,7 @@ export const registerUser = async (
   email: string,
   password: string
 ): Promise<{ token: string }> => {
-  const response = await fetch('/api/auth/register', {
+  const response = await fetch(`${API}/auth/register`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ email, password }),
@@ -140,7 +203,7 @@ export const loginUser = async (
   email: string,
   password: string
 ): Promise<{ token: string }> => {
-  const response = await fetch('/api/auth/login', {
+  const response = await fetch(`${API}/auth/login`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ email, password }),
@@ -154,13 +217,13 @@ export const getPushConfig = async (): Promise<{
   publicKey?: string
   subject?: string
 }> => {
-  const response = await fetch('/api/push/config')
+  const response = await fetch(`${API}/push/config`)
   await ensureOk(response)
   return parseJSON<{ publicKey?: string; subject?: string }>(response)
 }
 
 export const subscribePush = async (subscription: PushSubscription) => {
-  const response = await fetch('/api/push/subscribe', {
+  const response = await fetch(`${API}/push/subscribe`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json', ...authHeaders() },
     body: JSON.stringify(subscription),
@@ -169,9 +232,45 @@ export const subscribePush = async (subscription: PushSubscription) => {
 }
 
 export const sendTestPush = async () => {
-  const response = await fetch('/api/push/test', {
+  const response = await fetch(`${API}/push/test`, {
     method: 'POST',
     headers: { ...authHeaders() },
   })
   await ensureOk(response)
 }
+
+export type EntryEventType =
+  | 'entry.created'
+  | 'entry.updated'
+  | 'entry.deleted'
+  | 'resync'
+
+// EventSource can't send an Authorization header, so the token rides in
+// the query string. The browser reconnects on its own and replays missed
+// events via Last-Event-ID.
+export const subscribeEntryEvents = (
+  onEvent: (type: EntryEventType) => void
+): (() => void) => {
+  const token = getAuthToken()
+  if (!token || typeof EventSource === 'undefined') return () => {}
+  const source = new EventSource(
+    `${API}/events?access_token=${encodeURIComponent(token)}`
+  )
+  const types: EntryEventType[] = [
+    'entry.created',
+    'entry.updated',
+    'entry.deleted',
+    'resync',
+  ]
+  const handlers = types.map((type) => {
+    const handler = () => onEvent(type)
+    source.addEventListener(type, handler)
+    return [type, handler] as const
+  })
+  return () => {
+    handlers.forEach(([type, handler]) =>
+      source.removeEventListener(type, handler)
+    )
+    source.close()
+  }
+}